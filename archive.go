@@ -0,0 +1,220 @@
+/*
+Copyright 2018 Pusher Ltd.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package gitstore
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/gobwas/glob"
+	"gopkg.in/src-d/go-git.v4/plumbing/filemode"
+	"gopkg.in/src-d/go-git.v4/plumbing/object"
+)
+
+// ArchiveFormat is the file format of an archive.
+type ArchiveFormat int
+
+const (
+	// ArchiveTar is an uncompressed tar archive.
+	ArchiveTar ArchiveFormat = iota
+	// ArchiveTarGzip is a gzip compressed tar archive.
+	ArchiveTarGzip
+	// ArchiveZip is a zip archive.
+	ArchiveZip
+)
+
+// archiveWriter writes the files of a commit into an archive
+type archiveWriter interface {
+	writeFile(name string, file *object.File, modTime time.Time) error
+	Close() error
+}
+
+// Archive writes an archive of the files of the commit ref resolves to.
+// If pathGlob is set, only the files matching it are included.
+func (r *Repo) Archive(ref string, format ArchiveFormat, pathGlob string, w io.Writer) error {
+	return r.ArchiveWithPrefix(ref, format, pathGlob, "", w)
+}
+
+// ArchiveWithPrefix writes an archive of the files of the commit ref resolves to, prepending prefix to each path.
+// As with git archive, the prefix is prepended verbatim, so should end in a slash to place the files in a directory.
+//
+// Archives are deterministic: files are written in tree order, with the modification time set to the commit time
+// and without ownership information. File modes and symlinks are preserved.
+// Each file is streamed from the repository, so archives are not held in memory.
+func (r *Repo) ArchiveWithPrefix(ref string, format ArchiveFormat, pathGlob, prefix string, w io.Writer) error {
+	var g glob.Glob
+	if pathGlob != "" {
+		var err error
+		g, err = glob.Compile(pathGlob)
+		if err != nil {
+			return fmt.Errorf("unable to compile path matcher: %v", err)
+		}
+	}
+
+	commit, err := r.getCommit(ref)
+	if err != nil {
+		return err
+	}
+	files, err := commit.Files()
+	if err != nil {
+		return fmt.Errorf("unable to load files: %v", err)
+	}
+	defer files.Close()
+
+	var archive archiveWriter
+	switch format {
+	case ArchiveTar:
+		archive = newTarArchiveWriter(w, nil)
+	case ArchiveTarGzip:
+		archive = newTarArchiveWriter(w, gzip.NewWriter(w))
+	case ArchiveZip:
+		archive = &zipArchiveWriter{writer: zip.NewWriter(w)}
+	default:
+		return fmt.Errorf("unsupported archive format %d", format)
+	}
+
+	modTime := commit.Committer.When
+	err = files.ForEach(func(file *object.File) error {
+		if g != nil && !g.Match(file.Name) {
+			return nil
+		}
+		return archive.writeFile(prefix+file.Name, file, modTime)
+	})
+	if err != nil {
+		archive.Close()
+		return fmt.Errorf("unable to write archive: %v", err)
+	}
+	err = archive.Close()
+	if err != nil {
+		return fmt.Errorf("unable to write archive: %v", err)
+	}
+	return nil
+}
+
+// tarArchiveWriter writes files into a tar archive, optionally compressed
+type tarArchiveWriter struct {
+	writer     *tar.Writer
+	compressor io.WriteCloser
+}
+
+// newTarArchiveWriter constructs a tarArchiveWriter writing through the
+// compressor if it is not nil
+func newTarArchiveWriter(w io.Writer, compressor io.WriteCloser) *tarArchiveWriter {
+	if compressor != nil {
+		w = compressor
+	}
+	return &tarArchiveWriter{
+		writer:     tar.NewWriter(w),
+		compressor: compressor,
+	}
+}
+
+// writeFile writes the header and content of the file
+func (a *tarArchiveWriter) writeFile(name string, file *object.File, modTime time.Time) error {
+	header := &tar.Header{
+		Name:     name,
+		ModTime:  modTime,
+		Typeflag: tar.TypeReg,
+		Mode:     0644,
+		Size:     file.Size,
+		Format:   tar.FormatPAX,
+	}
+	switch file.Mode {
+	case filemode.Executable:
+		header.Mode = 0755
+	case filemode.Symlink:
+		target, err := file.Contents()
+		if err != nil {
+			return fmt.Errorf("unable to read symlink %s: %v", file.Name, err)
+		}
+		header.Typeflag = tar.TypeSymlink
+		header.Mode = 0777
+		header.Linkname = target
+		header.Size = 0
+	}
+
+	err := a.writer.WriteHeader(header)
+	if err != nil {
+		return err
+	}
+	if header.Typeflag == tar.TypeSymlink {
+		return nil
+	}
+	return copyFileContents(a.writer, file)
+}
+
+// Close flushes the archive and the compressor
+func (a *tarArchiveWriter) Close() error {
+	err := a.writer.Close()
+	if err != nil {
+		return err
+	}
+	if a.compressor != nil {
+		return a.compressor.Close()
+	}
+	return nil
+}
+
+// zipArchiveWriter writes files into a zip archive
+type zipArchiveWriter struct {
+	writer *zip.Writer
+}
+
+// writeFile writes the header and content of the file, storing symlinks as
+// files containing their target
+func (a *zipArchiveWriter) writeFile(name string, file *object.File, modTime time.Time) error {
+	header := &zip.FileHeader{
+		Name:     name,
+		Method:   zip.Deflate,
+		Modified: modTime.UTC(),
+	}
+	mode := os.FileMode(0644)
+	switch file.Mode {
+	case filemode.Executable:
+		mode = 0755
+	case filemode.Symlink:
+		mode = os.ModeSymlink | 0777
+	}
+	header.SetMode(mode)
+
+	w, err := a.writer.CreateHeader(header)
+	if err != nil {
+		return err
+	}
+	return copyFileContents(w, file)
+}
+
+// Close writes the central directory of the archive
+func (a *zipArchiveWriter) Close() error {
+	return a.writer.Close()
+}
+
+// copyFileContents streams the content of the file into the writer
+func copyFileContents(w io.Writer, file *object.File) error {
+	reader, err := file.Reader()
+	if err != nil {
+		return fmt.Errorf("unable to read %s: %v", file.Name, err)
+	}
+	defer reader.Close()
+	_, err = io.Copy(w, reader)
+	if err != nil {
+		return fmt.Errorf("unable to copy %s: %v", file.Name, err)
+	}
+	return nil
+}
@@ -0,0 +1,157 @@
+/*
+Copyright 2018 Pusher Ltd.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package gitstore
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("GitStore", func() {
+
+	Context("When archiving a revision", func() {
+		var repo *Repo
+		symlinks := map[string]string{
+			"links/example.go": "../go/example.go",
+			"links/short.json": "../json/short.json",
+		}
+
+		// readTar returns the headers and contents of each entry of the tar
+		readTar := func(r io.Reader) ([]*tar.Header, map[string]string) {
+			headers := []*tar.Header{}
+			contents := make(map[string]string)
+			reader := tar.NewReader(r)
+			for {
+				header, err := reader.Next()
+				if err == io.EOF {
+					break
+				}
+				Expect(err).ToNot(HaveOccurred())
+				content, err := ioutil.ReadAll(reader)
+				Expect(err).ToNot(HaveOccurred())
+				headers = append(headers, header)
+				contents[header.Name] = string(content)
+			}
+			return headers, contents
+		}
+
+		BeforeEach(func() {
+			var err error
+			repo, err = NewRepoStore("").Get(&RepoRef{URL: repositoryURL})
+			Expect(err).ToNot(HaveOccurred())
+		})
+
+		It("Should write a tar archive of the commit tree", func() {
+			commit, err := repo.getCommit("master")
+			Expect(err).ToNot(HaveOccurred())
+			buf := &bytes.Buffer{}
+			Expect(repo.Archive("master", ArchiveTar, "", buf)).To(Succeed())
+
+			headers, contents := readTar(buf)
+			Expect(headers).To(HaveLen(11))
+			Expect(contents["CHANGELOG"]).To(Equal("Initial changelog\n"))
+			for _, header := range headers {
+				Expect(header.ModTime.Unix()).To(Equal(commit.Committer.When.Unix()))
+				Expect(header.Uid).To(Equal(0))
+				Expect(header.Uname).To(BeEmpty())
+				if target, ok := symlinks[header.Name]; ok {
+					Expect(header.Typeflag).To(Equal(byte(tar.TypeSymlink)))
+					Expect(header.Linkname).To(Equal(target))
+				} else {
+					Expect(header.Typeflag).To(Equal(byte(tar.TypeReg)))
+					Expect(header.Mode).To(Equal(int64(0644)))
+				}
+			}
+		})
+
+		It("Should only include files matching the glob, under the prefix", func() {
+			buf := &bytes.Buffer{}
+			Expect(repo.ArchiveWithPrefix("master", ArchiveTarGzip, "json/*", "repo/", buf)).To(Succeed())
+
+			gz, err := gzip.NewReader(buf)
+			Expect(err).ToNot(HaveOccurred())
+			headers, _ := readTar(gz)
+			names := []string{}
+			for _, header := range headers {
+				names = append(names, header.Name)
+			}
+			Expect(names).To(Equal([]string{"repo/json/long.json", "repo/json/short.json"}))
+		})
+
+		It("Should write identical archives of the same revision", func() {
+			first, second := &bytes.Buffer{}, &bytes.Buffer{}
+			Expect(repo.Archive("master", ArchiveTarGzip, "", first)).To(Succeed())
+			Expect(repo.Archive("master", ArchiveTarGzip, "", second)).To(Succeed())
+			Expect(first.Bytes()).To(Equal(second.Bytes()))
+
+			first.Reset()
+			second.Reset()
+			Expect(repo.Archive("master", ArchiveZip, "", first)).To(Succeed())
+			Expect(repo.Archive("master", ArchiveZip, "", second)).To(Succeed())
+			Expect(first.Bytes()).To(Equal(second.Bytes()))
+		})
+
+		It("Should write a zip archive preserving symlinks", func() {
+			buf := &bytes.Buffer{}
+			Expect(repo.Archive("master", ArchiveZip, "", buf)).To(Succeed())
+
+			data := buf.Bytes()
+			reader, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(reader.File).To(HaveLen(11))
+			for _, file := range reader.File {
+				target, ok := symlinks[file.Name]
+				if !ok {
+					Expect(file.Mode()).To(Equal(os.FileMode(0644)))
+					continue
+				}
+				Expect(file.Mode() & os.ModeSymlink).ToNot(BeZero())
+				rc, err := file.Open()
+				Expect(err).ToNot(HaveOccurred())
+				content, err := ioutil.ReadAll(rc)
+				rc.Close()
+				Expect(err).ToNot(HaveOccurred())
+				Expect(string(content)).To(Equal(target))
+			}
+		})
+
+		It("Should preserve executable modes", func() {
+			repositoryDir := setupRepository()
+			defer teardownRepository(repositoryDir)
+			runGit(repositoryDir, "update-index", "--chmod=+x", "vendor/foo.go")
+			runGit(repositoryDir, "commit", "-m", "Make foo executable")
+			repo, err := NewRepoStore("").Get(&RepoRef{URL: fmt.Sprintf("file://%s", repositoryDir)})
+			Expect(err).ToNot(HaveOccurred())
+
+			buf := &bytes.Buffer{}
+			Expect(repo.Archive("master", ArchiveTar, "vendor/*", buf)).To(Succeed())
+			headers, _ := readTar(buf)
+			Expect(headers).To(HaveLen(1))
+			Expect(headers[0].Mode).To(Equal(int64(0755)))
+		})
+
+		It("Should reject unknown formats", func() {
+			Expect(repo.Archive("master", ArchiveFormat(42), "", ioutil.Discard)).ToNot(Succeed())
+		})
+	})
+})
@@ -0,0 +1,38 @@
+/*
+Copyright 2018 Pusher Ltd.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package gitstore
+
+import (
+	"fmt"
+
+	git "gopkg.in/src-d/go-git.v4"
+	"gopkg.in/src-d/go-git.v4/plumbing"
+)
+
+// isBare checks whether the repository was cloned without a worktree
+func isBare(repo *git.Repository) bool {
+	_, err := repo.Worktree()
+	return err == git.ErrIsBareRepository
+}
+
+// detachHead points HEAD directly at the commit.
+// As every read goes through commit objects, this is all a checkout of a bare
+// repository needs to do.
+func detachHead(repo *git.Repository, hash plumbing.Hash) error {
+	err := repo.Storer.SetReference(plumbing.NewHashReference(plumbing.HEAD, hash))
+	if err != nil {
+		return fmt.Errorf("unable to update HEAD: %v", err)
+	}
+	return nil
+}
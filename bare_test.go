@@ -0,0 +1,113 @@
+/*
+Copyright 2018 Pusher Ltd.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package gitstore
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	git "gopkg.in/src-d/go-git.v4"
+)
+
+var _ = Describe("GitStore", func() {
+
+	Context("When cloning a bare repository", func() {
+		var repo *Repo
+
+		assertReads := func() {
+			It("Should not have a worktree", func() {
+				_, err := repo.repository.Worktree()
+				Expect(err).To(Equal(git.ErrIsBareRepository))
+			})
+
+			It("Should read files at HEAD", func() {
+				file, err := repo.GetFile("LICENSE")
+				Expect(err).ToNot(HaveOccurred())
+				Expect(file.Contents()).To(ContainSubstring("MIT License"))
+			})
+
+			It("Should move HEAD when checking out", func() {
+				Expect(repo.Checkout("b029517f6300c2da0f4b651b8642506cd6aaf45d")).To(Succeed())
+				commit, err := repo.getHeadCommit()
+				Expect(err).ToNot(HaveOccurred())
+				Expect(commit.Hash.String()).To(Equal("b029517f6300c2da0f4b651b8642506cd6aaf45d"))
+
+				files, err := repo.GetAllFiles("", false)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(files).ToNot(HaveKey("CHANGELOG"))
+				Expect(files).To(HaveKey("LICENSE"))
+
+				Expect(repo.Checkout("master")).To(Succeed())
+				commit, err = repo.getHeadCommit()
+				Expect(err).ToNot(HaveOccurred())
+				Expect(commit.Hash.String()).To(Equal("f835a00b5e29ae3440a08fd51aadf4a07d6abc25"))
+			})
+		}
+
+		Context("in memory", func() {
+			BeforeEach(func() {
+				var err error
+				repo, err = NewRepoStore("").Get(&RepoRef{
+					URL:  repositoryURL,
+					Bare: true,
+				})
+				Expect(err).ToNot(HaveOccurred())
+			})
+
+			assertReads()
+		})
+
+		Context("into a directory", func() {
+			var tmpDir string
+
+			BeforeEach(func() {
+				var err error
+				tmpDir, err = ioutil.TempDir("", "git-store")
+				Expect(err).ToNot(HaveOccurred())
+				repo, err = NewRepoStore(tmpDir).Get(&RepoRef{
+					URL:  repositoryURL,
+					Bare: true,
+				})
+				Expect(err).ToNot(HaveOccurred())
+			})
+
+			AfterEach(func() {
+				os.RemoveAll(tmpDir)
+			})
+
+			assertReads()
+
+			It("Should not write a worktree to disk", func() {
+				infos, err := ioutil.ReadDir(filepath.Join(tmpDir, repositoryURL))
+				Expect(err).ToNot(HaveOccurred())
+				for _, info := range infos {
+					Expect(info.Name()).ToNot(Equal("LICENSE"))
+					Expect(info.Name()).ToNot(Equal(".git"))
+				}
+			})
+		})
+
+		It("Should reject sparse paths", func() {
+			ref := &RepoRef{
+				URL:         repositoryURL,
+				Bare:        true,
+				SparsePaths: []string{"json/**"},
+			}
+			Expect(ref.Validate()).ToNot(Succeed())
+		})
+	})
+})
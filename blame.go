@@ -0,0 +1,124 @@
+/*
+Copyright 2018 Pusher Ltd.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package gitstore
+
+import (
+	"fmt"
+	"time"
+
+	git "gopkg.in/src-d/go-git.v4"
+	"gopkg.in/src-d/go-git.v4/plumbing"
+	"gopkg.in/src-d/go-git.v4/plumbing/object"
+)
+
+// BlameLine contains the blame information for a single line of a file.
+type BlameLine struct {
+	Number    int              // Number is the 1-based line number within the file.
+	Text      string           // Text is the content of the line.
+	Hash      plumbing.Hash    // Hash is the hash of the commit that last modified the line.
+	Author    string           // Author is the email address of the author of the commit.
+	Date      time.Time        // Date is the datetime the line was last modified.
+	Committer object.Signature // Committer contains the name, email and time of the committer of the commit.
+}
+
+// BlameError is returned when blame information cannot be computed for a file.
+type BlameError struct {
+	Path string // Path is the path of the file being blamed.
+	Err  error  // Err is the underlying error.
+}
+
+func (e *BlameError) Error() string {
+	return fmt.Sprintf("unable to get blame for %s: %v", e.Path, e.Err)
+}
+
+// LineRangeError is returned when a requested line range is not within the file.
+type LineRangeError struct {
+	Start int // Start is the requested first line.
+	End   int // End is the requested last line.
+	Lines int // Lines is the number of lines in the file.
+}
+
+func (e *LineRangeError) Error() string {
+	return fmt.Sprintf("invalid line range %d-%d for file with %d lines", e.Start, e.End, e.Lines)
+}
+
+// Blame returns the blame information for every line of the File.
+func (f *File) Blame() ([]BlameLine, error) {
+	blame, err := f.getBlame()
+	if err != nil {
+		return nil, err
+	}
+	return f.blameLines(blame, 1, len(blame.Lines))
+}
+
+// BlameRange returns the blame information for the lines between startLine and endLine of the File.
+// Line numbers are 1-based and the range is inclusive.
+func (f *File) BlameRange(startLine, endLine int) ([]BlameLine, error) {
+	blame, err := f.getBlame()
+	if err != nil {
+		return nil, err
+	}
+	if startLine < 1 || endLine < startLine || endLine > len(blame.Lines) {
+		return nil, &LineRangeError{Start: startLine, End: endLine, Lines: len(blame.Lines)}
+	}
+	return f.blameLines(blame, startLine, endLine)
+}
+
+func (f *File) getBlame() (*git.BlameResult, error) {
+	blame, err := git.Blame(f.headCommit, f.file.Name)
+	if err != nil {
+		return nil, &BlameError{Path: f.file.Name, Err: err}
+	}
+	return blame, nil
+}
+
+// blameLines converts the lines between start and end of a blame result,
+// looking up the committer of each commit referenced
+func (f *File) blameLines(blame *git.BlameResult, start, end int) ([]BlameLine, error) {
+	committers := make(map[plumbing.Hash]object.Signature)
+	lines := []BlameLine{}
+	for i := start; i <= end; i++ {
+		line := blame.Lines[i-1]
+		committer, ok := committers[line.Hash]
+		if !ok {
+			commit, err := f.lookupCommit(line.Hash)
+			if err != nil {
+				return nil, &BlameError{Path: f.file.Name, Err: err}
+			}
+			committer = commit.Committer
+			committers[line.Hash] = committer
+		}
+
+		lines = append(lines, BlameLine{
+			Number:    i,
+			Text:      line.Text,
+			Hash:      line.Hash,
+			Author:    line.Author,
+			Date:      line.Date,
+			Committer: committer,
+		})
+	}
+	return lines, nil
+}
+
+// lookupCommit loads a commit from the repository the File was read from
+func (f *File) lookupCommit(hash plumbing.Hash) (*object.Commit, error) {
+	f.repo.mutex.RLock()
+	defer f.repo.mutex.RUnlock()
+	commit, err := f.repo.repository.CommitObject(hash)
+	if err != nil {
+		return nil, fmt.Errorf("unable to retrieve commit %s: %v", hash, err)
+	}
+	return commit, nil
+}
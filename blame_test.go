@@ -0,0 +1,70 @@
+/*
+Copyright 2018 Pusher Ltd.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package gitstore
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("GitStore", func() {
+
+	Context("When blaming a file", func() {
+		var license *File
+
+		BeforeEach(func() {
+			rs := NewRepoStore("")
+			repo, err := rs.Get(&RepoRef{
+				URL: repositoryURL,
+			})
+			Expect(err).ToNot(HaveOccurred())
+			err = repo.Checkout("master")
+			Expect(err).ToNot(HaveOccurred())
+			license, err = repo.GetFile("LICENSE")
+			Expect(err).ToNot(HaveOccurred())
+		})
+
+		It("Should return blame information for every line", func() {
+			lines, err := license.Blame()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(lines).To(HaveLen(22))
+			Expect(lines[0].Number).To(Equal(1))
+			Expect(lines[0].Text).To(Equal("The MIT License (MIT)"))
+			Expect(lines[0].Hash.String()).To(Equal("b029517f6300c2da0f4b651b8642506cd6aaf45d"))
+			Expect(lines[0].Author).To(Equal("mcuadros@gmail.com"))
+			Expect(lines[0].Committer.Name).To(Equal("Máximo Cuadros"))
+			Expect(lines[0].Committer.Email).To(Equal("mcuadros@gmail.com"))
+		})
+
+		It("Should return blame information for a range of lines", func() {
+			lines, err := license.BlameRange(3, 4)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(lines).To(HaveLen(2))
+			Expect(lines[0].Number).To(Equal(3))
+			Expect(lines[0].Text).To(Equal("Copyright (c) 2015 Tyba"))
+			Expect(lines[1].Number).To(Equal(4))
+		})
+
+		It("Should return a LineRangeError for an invalid range", func() {
+			_, err := license.BlameRange(20, 30)
+			Expect(err).To(HaveOccurred())
+			rangeErr, ok := err.(*LineRangeError)
+			Expect(ok).To(BeTrue())
+			Expect(rangeErr.Lines).To(Equal(22))
+
+			_, err = license.BlameRange(4, 3)
+			Expect(err).To(BeAssignableToTypeOf(&LineRangeError{}))
+		})
+	})
+})
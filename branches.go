@@ -0,0 +1,334 @@
+/*
+Copyright 2018 Pusher Ltd.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package gitstore
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	git "gopkg.in/src-d/go-git.v4"
+	"gopkg.in/src-d/go-git.v4/config"
+	"gopkg.in/src-d/go-git.v4/plumbing"
+	"gopkg.in/src-d/go-git.v4/plumbing/object"
+)
+
+const remoteBranchPrefix = "refs/remotes/origin/"
+
+// Branch represents a branch of the remote repository.
+type Branch struct {
+	Name string        // Name is the short name of the branch, eg. master.
+	Hash plumbing.Hash // Hash is the hash of the commit the branch points to.
+}
+
+// Tag represents a tag in the repository.
+type Tag struct {
+	Name      string           // Name is the short name of the tag, eg. v1.0.0.
+	Hash      plumbing.Hash    // Hash is the hash of the commit the tag points to.
+	Annotated bool             // Annotated indicates whether the tag is an annotated tag object.
+	Tagger    object.Signature // Tagger contains the name, email and time of the tagger for annotated tags.
+	Message   string           // Message is the message of annotated tags.
+}
+
+// RemoteRef represents a reference advertised by the remote repository.
+type RemoteRef struct {
+	Name string        // Name is the full name of the reference, eg. refs/heads/master.
+	Hash plumbing.Hash // Hash is the hash the reference points to.
+}
+
+// Branches returns the branches of the remote repository as of the last fetch, sorted by name.
+func (r *Repo) Branches() ([]Branch, error) {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	refs, err := r.repository.References()
+	if err != nil {
+		return nil, fmt.Errorf("unable to load references: %v", err)
+	}
+
+	branches := []Branch{}
+	err = refs.ForEach(func(ref *plumbing.Reference) error {
+		name := ref.Name().String()
+		if ref.Type() != plumbing.HashReference || !strings.HasPrefix(name, remoteBranchPrefix) {
+			return nil
+		}
+		branches = append(branches, Branch{
+			Name: strings.TrimPrefix(name, remoteBranchPrefix),
+			Hash: ref.Hash(),
+		})
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("unable to iterate references: %v", err)
+	}
+
+	sort.Slice(branches, func(i, j int) bool {
+		return branches[i].Name < branches[j].Name
+	})
+	return branches, nil
+}
+
+// Tags returns the tags of the repository as of the last fetch, sorted by name.
+// Tags that do not point at commits, such as tags of trees or blobs, are skipped.
+func (r *Repo) Tags() ([]Tag, error) {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	refs, err := r.repository.Tags()
+	if err != nil {
+		return nil, fmt.Errorf("unable to load tags: %v", err)
+	}
+
+	tags := []Tag{}
+	err = refs.ForEach(func(ref *plumbing.Reference) error {
+		tag, ok, err := r.newTag(ref)
+		if err != nil {
+			return err
+		}
+		if ok {
+			tags = append(tags, tag)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("unable to iterate tags: %v", err)
+	}
+
+	sort.Slice(tags, func(i, j int) bool {
+		return tags[i].Name < tags[j].Name
+	})
+	return tags, nil
+}
+
+// newTag constructs a Tag from a tag reference, resolving annotated tags to
+// the commit they point to, or returns false if the tag does not point at a
+// commit
+func (r *Repo) newTag(ref *plumbing.Reference) (Tag, bool, error) {
+	tag := Tag{
+		Name: ref.Name().Short(),
+		Hash: ref.Hash(),
+	}
+
+	tagObject, err := r.repository.TagObject(ref.Hash())
+	if err == plumbing.ErrObjectNotFound {
+		// Lightweight tag pointing directly at an object
+		_, err = r.repository.CommitObject(ref.Hash())
+		return tag, err == nil, nil
+	}
+	if err != nil {
+		return Tag{}, false, fmt.Errorf("unable to load tag %s: %v", tag.Name, err)
+	}
+	tag.Annotated = true
+	tag.Tagger = tagObject.Tagger
+	// Go Git only separates OpenPGP signatures from the message
+	message, _ := splitTagSignature([]byte(tagObject.Message))
+	tag.Message = string(message)
+
+	// Peel tags of tags down to the object they finally point at
+	target := tagObject
+	for target.TargetType == plumbing.TagObject {
+		target, err = r.repository.TagObject(target.Target)
+		if err != nil {
+			return Tag{}, false, fmt.Errorf("unable to resolve target of tag %s: %v", tag.Name, err)
+		}
+	}
+	if target.TargetType != plumbing.CommitObject {
+		return tag, false, nil
+	}
+	tag.Hash = target.Target
+	return tag, true, nil
+}
+
+// ListRemoteRefs queries the remote repository for the references it currently advertises, without fetching any objects.
+// Symbolic references such as HEAD are omitted.
+func (r *Repo) ListRemoteRefs(ctx context.Context) ([]RemoteRef, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, fmt.Errorf("unable to list remote references: %v", err)
+	}
+
+	r.mutex.RLock()
+	remote, err := r.repository.Remote(git.DefaultRemoteName)
+	auth := r.auth
+	r.mutex.RUnlock()
+	if err != nil {
+		return nil, fmt.Errorf("unable to load remote: %v", err)
+	}
+
+	type result struct {
+		refs []*plumbing.Reference
+		err  error
+	}
+	c := make(chan result, 1)
+	go func() {
+		refs, err := remote.List(&git.ListOptions{Auth: auth})
+		c <- result{refs: refs, err: err}
+	}()
+
+	select {
+	case <-ctx.Done():
+		return nil, fmt.Errorf("unable to list remote references: %v", ctx.Err())
+	case res := <-c:
+		if res.err != nil {
+			return nil, fmt.Errorf("unable to list remote references: %v", res.err)
+		}
+		remoteRefs := []RemoteRef{}
+		for _, ref := range res.refs {
+			if ref.Type() != plumbing.HashReference {
+				continue
+			}
+			remoteRefs = append(remoteRefs, RemoteRef{
+				Name: ref.Name().String(),
+				Hash: ref.Hash(),
+			})
+		}
+		sort.Slice(remoteRefs, func(i, j int) bool {
+			return remoteRefs[i].Name < remoteRefs[j].Name
+		})
+		return remoteRefs, nil
+	}
+}
+
+// CreateBranch creates a branch on the remote repository pointing at the commit fromRef resolves to.
+func (r *Repo) CreateBranch(name, fromRef string) error {
+	return r.CreateBranchContext(context.Background(), name, fromRef)
+}
+
+// CreateBranchContext creates a branch on the remote repository pointing at the commit fromRef resolves to.
+// It returns an error if the branch already exists as of the last fetch.
+//
+// Note: Only the remote tracking branch is updated, no local branch is created.
+func (r *Repo) CreateBranchContext(ctx context.Context, name, fromRef string) error {
+	commit, err := r.getCommit(fromRef)
+	if err != nil {
+		return err
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	remoteName := plumbing.NewRemoteReferenceName(git.DefaultRemoteName, name)
+	if _, err := r.repository.Storer.Reference(remoteName); err == nil {
+		return fmt.Errorf("branch %s already exists", name)
+	}
+
+	err = r.pushHash(ctx, commit.Hash, plumbing.NewBranchReferenceName(name), false)
+	if err != nil {
+		return fmt.Errorf("unable to push branch %s: %v", name, err)
+	}
+	err = r.repository.Storer.SetReference(plumbing.NewHashReference(remoteName, commit.Hash))
+	if err != nil {
+		return fmt.Errorf("unable to update remote branch: %v", err)
+	}
+	return nil
+}
+
+// DeleteBranch deletes a branch from the remote repository.
+func (r *Repo) DeleteBranch(name string) error {
+	return r.DeleteBranchContext(context.Background(), name)
+}
+
+// DeleteBranchContext deletes a branch from the remote repository.
+// It returns an error if the branch does not exist as of the last fetch.
+func (r *Repo) DeleteBranchContext(ctx context.Context, name string) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	remoteName := plumbing.NewRemoteReferenceName(git.DefaultRemoteName, name)
+	if _, err := r.repository.Storer.Reference(remoteName); err != nil {
+		return fmt.Errorf("unable to find branch %s: %v", name, err)
+	}
+
+	err := r.pushRefSpecs(ctx, config.RefSpec(fmt.Sprintf(":%s", plumbing.NewBranchReferenceName(name))))
+	if err != nil {
+		return fmt.Errorf("unable to delete branch %s: %v", name, err)
+	}
+	err = r.repository.Storer.RemoveReference(remoteName)
+	if err != nil {
+		return fmt.Errorf("unable to remove remote branch: %v", err)
+	}
+	return nil
+}
+
+// CreateTag creates an annotated tag on the remote repository pointing at the commit ref resolves to.
+func (r *Repo) CreateTag(name, ref, message string, tagger object.Signature) error {
+	return r.CreateTagContext(context.Background(), name, ref, message, tagger)
+}
+
+// CreateTagContext creates an annotated tag on the remote repository pointing at the commit ref resolves to.
+// It returns an error if the tag already exists as of the last fetch.
+// If the RepoRef has a SigningKey, the tag is signed with it.
+func (r *Repo) CreateTagContext(ctx context.Context, name, ref, message string, tagger object.Signature) error {
+	commit, err := r.getCommit(ref)
+	if err != nil {
+		return err
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	tagName := plumbing.NewTagReferenceName(name)
+	if _, err := r.repository.Storer.Reference(tagName); err == nil {
+		return fmt.Errorf("tag %s already exists", name)
+	}
+
+	tag := &object.Tag{
+		Name:       name,
+		Tagger:     tagger,
+		Message:    message,
+		TargetType: plumbing.CommitObject,
+		Target:     commit.Hash,
+	}
+	if r.signingKey != nil {
+		err = signTag(tag, r.signingKey)
+		if err != nil {
+			return fmt.Errorf("unable to sign tag %s: %v", name, err)
+		}
+	}
+	hash, err := writeObject(r.repository.Storer, tag)
+	if err != nil {
+		return fmt.Errorf("unable to create tag %s: %v", name, err)
+	}
+
+	err = r.pushHash(ctx, hash, tagName, false)
+	if err != nil {
+		return fmt.Errorf("unable to push tag %s: %v", name, err)
+	}
+	err = r.repository.Storer.SetReference(plumbing.NewHashReference(tagName, hash))
+	if err != nil {
+		return fmt.Errorf("unable to store tag %s: %v", name, err)
+	}
+	return nil
+}
+
+// DeleteTag deletes a tag from the remote repository.
+func (r *Repo) DeleteTag(name string) error {
+	return r.DeleteTagContext(context.Background(), name)
+}
+
+// DeleteTagContext deletes a tag from the remote repository.
+// It returns an error if the tag does not exist as of the last fetch.
+func (r *Repo) DeleteTagContext(ctx context.Context, name string) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	tagName := plumbing.NewTagReferenceName(name)
+	if _, err := r.repository.Storer.Reference(tagName); err != nil {
+		return fmt.Errorf("unable to find tag %s: %v", name, err)
+	}
+
+	err := r.pushRefSpecs(ctx, config.RefSpec(fmt.Sprintf(":%s", tagName)))
+	if err != nil {
+		return fmt.Errorf("unable to delete tag %s: %v", name, err)
+	}
+	err = r.repository.Storer.RemoveReference(tagName)
+	if err != nil {
+		return fmt.Errorf("unable to remove tag %s: %v", name, err)
+	}
+	return nil
+}
@@ -0,0 +1,224 @@
+/*
+Copyright 2018 Pusher Ltd.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package gitstore
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"gopkg.in/src-d/go-git.v4/plumbing"
+	"gopkg.in/src-d/go-git.v4/plumbing/object"
+)
+
+var _ = Describe("GitStore", func() {
+
+	Context("When listing branches and tags", func() {
+		var repositoryDir string
+		var repo *Repo
+
+		BeforeEach(func() {
+			repositoryDir = setupRepository()
+			runGit(repositoryDir, "branch", "staging", "b029517f6300c2da0f4b651b8642506cd6aaf45d")
+			runGit(repositoryDir, "tag", "v1.0.0", "6ecf0ef2c2dffb796033e5a02219af86ec6584e5")
+			runGit(repositoryDir, "tag", "-a", "v1.1.0", "-m", "Release v1.1.0")
+			// Tags of trees are not releases and are skipped
+			runGit(repositoryDir, "tag", "-a", "v1.2.0-tree", "-m", "Tree", "master^{tree}")
+			runGit(repositoryDir, "tag", "v1.2.1-tree", "master^{tree}")
+
+			rs := NewRepoStore("")
+			var err error
+			repo, err = rs.Get(&RepoRef{
+				URL: fmt.Sprintf("file://%s", repositoryDir),
+			})
+			Expect(err).ToNot(HaveOccurred())
+			err = repo.Fetch()
+			Expect(err).ToNot(HaveOccurred())
+		})
+
+		AfterEach(func() {
+			teardownRepository(repositoryDir)
+		})
+
+		It("Should list the remote branches", func() {
+			branches, err := repo.Branches()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(branches).To(Equal([]Branch{
+				{Name: "master", Hash: plumbing.NewHash("f835a00b5e29ae3440a08fd51aadf4a07d6abc25")},
+				{Name: "staging", Hash: plumbing.NewHash("b029517f6300c2da0f4b651b8642506cd6aaf45d")},
+			}))
+		})
+
+		It("Should list lightweight and annotated tags", func() {
+			tags, err := repo.Tags()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(tags).To(HaveLen(2))
+
+			Expect(tags[0].Name).To(Equal("v1.0.0"))
+			Expect(tags[0].Hash.String()).To(Equal("6ecf0ef2c2dffb796033e5a02219af86ec6584e5"))
+			Expect(tags[0].Annotated).To(BeFalse())
+
+			Expect(tags[1].Name).To(Equal("v1.1.0"))
+			Expect(tags[1].Hash.String()).To(Equal("f835a00b5e29ae3440a08fd51aadf4a07d6abc25"))
+			Expect(tags[1].Annotated).To(BeTrue())
+			Expect(tags[1].Tagger.Email).To(Equal("git-store@example.com"))
+			Expect(tags[1].Message).To(Equal("Release v1.1.0\n"))
+		})
+
+		It("Should resolve tags of annotated tags to the commit", func() {
+			runGit(repositoryDir, "tag", "-a", "v1.1.1", "-m", "Release v1.1.1", "v1.1.0")
+			Expect(repo.Fetch()).To(Succeed())
+
+			tags, err := repo.Tags()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(tags).To(HaveLen(3))
+			Expect(tags[2].Name).To(Equal("v1.1.1"))
+			Expect(tags[2].Hash.String()).To(Equal("f835a00b5e29ae3440a08fd51aadf4a07d6abc25"))
+		})
+
+		It("Should list the references advertised by the remote", func() {
+			runGit(repositoryDir, "branch", "production", "master")
+			refs, err := repo.ListRemoteRefs(context.Background())
+			Expect(err).ToNot(HaveOccurred())
+
+			names := []string{}
+			for _, ref := range refs {
+				names = append(names, ref.Name)
+			}
+			Expect(names).To(ContainElement("refs/heads/production"))
+			Expect(names).To(ContainElement("refs/heads/staging"))
+			Expect(names).To(ContainElement("refs/tags/v1.0.0"))
+			Expect(names).ToNot(ContainElement("HEAD"))
+
+			branches, err := repo.Branches()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(branches).To(HaveLen(2))
+		})
+
+		It("Should respect context cancellation", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			cancel()
+			_, err := repo.ListRemoteRefs(ctx)
+			Expect(err).To(HaveOccurred())
+		})
+	})
+
+	Context("When creating and deleting branches and tags", func() {
+		var sourceDir, remoteDir string
+		var repo *Repo
+		var tagger object.Signature
+
+		BeforeEach(func() {
+			sourceDir = setupRepository()
+			var err error
+			remoteDir, err = ioutil.TempDir("", "git-store-remote")
+			Expect(err).ToNot(HaveOccurred())
+			runGit(remoteDir, "clone", "--bare", "--quiet", sourceDir, ".")
+
+			repo, err = NewRepoStore("").Get(&RepoRef{
+				URL: fmt.Sprintf("file://%s", remoteDir),
+			})
+			Expect(err).ToNot(HaveOccurred())
+			tagger = object.Signature{Name: "Git Store", Email: "git-store@example.com", When: time.Unix(1540000000, 0)}
+		})
+
+		AfterEach(func() {
+			teardownRepository(sourceDir)
+			os.RemoveAll(remoteDir)
+		})
+
+		It("Should create a branch on the remote", func() {
+			Expect(repo.CreateBranch("release", "b029517f6300c2da0f4b651b8642506cd6aaf45d")).To(Succeed())
+			Expect(runGit(remoteDir, "rev-parse", "refs/heads/release")).To(Equal("b029517f6300c2da0f4b651b8642506cd6aaf45d"))
+
+			branches, err := repo.Branches()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(branches).To(ContainElement(Branch{Name: "release", Hash: plumbing.NewHash("b029517f6300c2da0f4b651b8642506cd6aaf45d")}))
+		})
+
+		It("Should not leave local branches or references behind", func() {
+			Expect(repo.CreateBranch("release", "master")).To(Succeed())
+			Expect(repo.CreateTag("v2.0.0", "master", "Release v2.0.0", tagger)).To(Succeed())
+
+			refs, err := repo.repository.References()
+			Expect(err).ToNot(HaveOccurred())
+			refs.ForEach(func(ref *plumbing.Reference) error {
+				Expect(ref.Name().IsBranch()).To(BeFalse())
+				Expect(ref.Name().String()).ToNot(HavePrefix("refs/gitstore/"))
+				return nil
+			})
+		})
+
+		It("Should not create a branch that already exists", func() {
+			Expect(repo.CreateBranch("master", "b029517f6300c2da0f4b651b8642506cd6aaf45d")).ToNot(Succeed())
+			Expect(runGit(remoteDir, "rev-parse", "refs/heads/master")).To(Equal("f835a00b5e29ae3440a08fd51aadf4a07d6abc25"))
+		})
+
+		It("Should delete a branch from the remote", func() {
+			Expect(repo.CreateBranch("release", "master")).To(Succeed())
+			Expect(repo.DeleteBranch("release")).To(Succeed())
+			Expect(runGit(remoteDir, "branch", "--list", "release")).To(BeEmpty())
+
+			branches, err := repo.Branches()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(branches).To(HaveLen(1))
+		})
+
+		It("Should not delete a branch that does not exist", func() {
+			Expect(repo.DeleteBranch("missing")).ToNot(Succeed())
+		})
+
+		It("Should create an annotated tag on the remote", func() {
+			Expect(repo.CreateTag("v2.0.0", "master", "Release v2.0.0", tagger)).To(Succeed())
+			Expect(runGit(remoteDir, "cat-file", "-t", "refs/tags/v2.0.0")).To(Equal("tag"))
+			Expect(runGit(remoteDir, "rev-parse", "v2.0.0^{commit}")).To(Equal("f835a00b5e29ae3440a08fd51aadf4a07d6abc25"))
+			runGit(remoteDir, "fsck", "--strict")
+
+			tags, err := repo.Tags()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(tags).To(ContainElement(Tag{
+				Name:      "v2.0.0",
+				Hash:      plumbing.NewHash("f835a00b5e29ae3440a08fd51aadf4a07d6abc25"),
+				Annotated: true,
+				Tagger:    tagger,
+				Message:   "Release v2.0.0",
+			}))
+		})
+
+		It("Should not create a tag that already exists", func() {
+			Expect(repo.CreateTag("v2.0.0", "master", "Release v2.0.0", tagger)).To(Succeed())
+			Expect(repo.CreateTag("v2.0.0", "master", "Release v2.0.0", tagger)).ToNot(Succeed())
+		})
+
+		It("Should delete a tag from the remote", func() {
+			Expect(repo.CreateTag("v2.0.0", "master", "Release v2.0.0", tagger)).To(Succeed())
+			Expect(repo.DeleteTag("v2.0.0")).To(Succeed())
+			Expect(runGit(remoteDir, "tag", "--list", "v2.0.0")).To(BeEmpty())
+
+			tags, err := repo.Tags()
+			Expect(err).ToNot(HaveOccurred())
+			for _, tag := range tags {
+				Expect(tag.Name).ToNot(Equal("v2.0.0"))
+			}
+		})
+
+		It("Should not delete a tag that does not exist", func() {
+			Expect(repo.DeleteTag("missing")).ToNot(Succeed())
+		})
+	})
+})
@@ -1,12 +1,15 @@
 package gitstore
 
 import (
+	"context"
 	"fmt"
 	"sync"
 
 	git "gopkg.in/src-d/go-git.v4"
 
+	"gopkg.in/src-d/go-billy.v4"
 	"gopkg.in/src-d/go-billy.v4/memfs"
+	"gopkg.in/src-d/go-git.v4/plumbing"
 	"gopkg.in/src-d/go-git.v4/plumbing/transport"
 	"gopkg.in/src-d/go-git.v4/storage/memory"
 )
@@ -19,6 +22,8 @@ type AsyncRepoCloner struct {
 	Error   error    // Error is the last error encountered during the clone operation or nil.
 	repoDir string   // repoDir is the path to clone the repository into.
 	mutex   sync.Mutex
+
+	signingKey SigningKey // signingKey signs the commits and tags created through the Repo, nil if they are unsigned.
 }
 
 // Clone starts an asynchronous clone of the requested repository and sets Ready to true when the repository is cloned successfully.
@@ -27,24 +32,15 @@ func (rc *AsyncRepoCloner) Clone(auth transport.AuthMethod) <-chan struct{} {
 	done := make(chan struct{})
 	go func() {
 		defer close(done)
-		cloneOptions := &git.CloneOptions{
-			URL:  rc.RepoRef.URL,
-			Auth: auth,
-		}
-
-		var err error
-		var repository *git.Repository
-		if rc.repoDir != "" {
-			repository, err = git.PlainClone(rc.repoDir, false, cloneOptions)
-			if err == git.ErrRepositoryAlreadyExists {
-				repository, err = git.PlainOpen(rc.repoDir)
-			}
-		} else {
-			// No repoDir provided, default to in memory clone
-			fs := memfs.New()
-			storer := memory.NewStorage()
-			repository, err = git.Clone(storer, fs, cloneOptions)
+		sparsePaths, err := compileSparsePaths(rc.RepoRef.SparsePaths)
+		if err != nil {
+			rc.mutex.Lock()
+			defer rc.mutex.Unlock()
+			rc.Error = err
+			return
 		}
+		cloneOptions := newCloneOptions(rc.RepoRef, auth)
+		repository, err := cloneRepository(context.Background(), rc.repoDir, rc.RepoRef.Bare, cloneOptions)
 
 		rc.mutex.Lock()
 		defer rc.mutex.Unlock()
@@ -52,13 +48,99 @@ func (rc *AsyncRepoCloner) Clone(auth transport.AuthMethod) <-chan struct{} {
 			rc.Error = err
 			return
 		}
-		err = cleanNewRepo(repository)
+		err = cleanNewRepo(repository, sparsePaths)
 		if err != nil {
 			rc.Error = fmt.Errorf("unable to clean new repo: %v", err)
 			return
 		}
-		rc.Repo = newRepo(repository, auth)
+		var lfs *lfsClient
+		if rc.RepoRef.LFS {
+			lfs, err = newLFSClient(rc.RepoRef, rc.repoDir)
+			if err != nil {
+				rc.Error = fmt.Errorf("unable to configure Git LFS: %v", err)
+				return
+			}
+		}
+		rc.Repo = newRepo(repository, auth, repoOptions{
+			clone:       cloneOptions,
+			repoDir:     rc.repoDir,
+			sparsePaths: sparsePaths,
+			submodules:  rc.RepoRef.Submodules,
+			credentials: rc.RepoRef.SubmoduleCredentials,
+			lfs:         lfs,
+			ignoreFiles: rc.RepoRef.IgnoreFiles,
+		})
+		rc.Repo.setSigningKey(rc.signingKey)
+		if rc.RepoRef.Submodules {
+			err = rc.Repo.updateSubmodules(context.Background())
+			if err != nil {
+				rc.Repo = nil
+				rc.Error = fmt.Errorf("unable to update submodules: %v", err)
+				return
+			}
+		}
 		rc.Ready = true
 	}()
 	return done
 }
+
+// setSigningKey sets the key signing the commits and tags created through the
+// Repo if none is set yet, a different key cannot replace it since the Repo is
+// shared by every user of the repository.
+// Keys are compared by their public key, so separately constructed keys for
+// the same key material are accepted. A nil key keeps the key already set, so
+// callers without a key still sign with the key of an earlier caller
+func (rc *AsyncRepoCloner) setSigningKey(key SigningKey) error {
+	rc.mutex.Lock()
+	defer rc.mutex.Unlock()
+	if key == nil || sameSigningKey(key, rc.signingKey) {
+		return nil
+	}
+	if rc.signingKey != nil {
+		return fmt.Errorf("repository %s is already in use with a different SigningKey", rc.RepoRef.URL)
+	}
+	rc.signingKey = key
+	if rc.Repo != nil {
+		rc.Repo.setSigningKey(key)
+	}
+	return nil
+}
+
+// newCloneOptions constructs the options for cloning the repository
+// described by the RepoRef
+func newCloneOptions(ref *RepoRef, auth transport.AuthMethod) *git.CloneOptions {
+	options := &git.CloneOptions{
+		URL:   ref.URL,
+		Auth:  auth,
+		Depth: ref.Depth,
+		Tags:  ref.Tags.gitTagMode(),
+		// Sparse checkouts are performed once the repository is cloned
+		NoCheckout: len(ref.SparsePaths) > 0,
+	}
+	if ref.Branch != "" {
+		options.ReferenceName = plumbing.NewBranchReferenceName(ref.Branch)
+		options.SingleBranch = true
+	}
+	return options
+}
+
+// cloneRepository clones a repository into repoDir, or into memory if repoDir
+// is empty. Bare repositories are cloned without a worktree.
+// If repoDir already contains a repository, it is opened instead.
+func cloneRepository(ctx context.Context, repoDir string, bare bool, options *git.CloneOptions) (*git.Repository, error) {
+	if repoDir == "" {
+		// No repoDir provided, default to in memory clone
+		var fs billy.Filesystem
+		if !bare {
+			fs = memfs.New()
+		}
+		storer := memory.NewStorage()
+		return git.CloneContext(ctx, storer, fs, options)
+	}
+
+	repository, err := git.PlainCloneContext(ctx, repoDir, bare, options)
+	if err == git.ErrRepositoryAlreadyExists {
+		return git.PlainOpen(repoDir)
+	}
+	return repository, err
+}
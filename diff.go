@@ -0,0 +1,219 @@
+/*
+Copyright 2018 Pusher Ltd.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package gitstore
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/gobwas/glob"
+	"gopkg.in/src-d/go-git.v4/plumbing"
+	"gopkg.in/src-d/go-git.v4/plumbing/object"
+	"gopkg.in/src-d/go-git.v4/utils/merkletrie"
+)
+
+// ChangeType describes how a file was changed between two references.
+type ChangeType int
+
+const (
+	// Added indicates the file does not exist in the from reference.
+	Added ChangeType = iota + 1
+	// Modified indicates the contents or mode of the file changed.
+	Modified
+	// Deleted indicates the file does not exist in the to reference.
+	Deleted
+	// Renamed indicates the file was moved without changing its contents.
+	Renamed
+)
+
+func (c ChangeType) String() string {
+	switch c {
+	case Added:
+		return "Added"
+	case Modified:
+		return "Modified"
+	case Deleted:
+		return "Deleted"
+	case Renamed:
+		return "Renamed"
+	}
+	return "Unknown"
+}
+
+// FileChange describes a change to a single file between two references.
+type FileChange struct {
+	Type    ChangeType    // Type is the kind of change made to the file.
+	OldPath string        // OldPath is the path of the file in the from reference, empty if the file was added.
+	NewPath string        // NewPath is the path of the file in the to reference, empty if the file was deleted.
+	OldHash plumbing.Hash // OldHash is the blob hash of the file in the from reference, zero if the file was added.
+	NewHash plumbing.Hash // NewHash is the blob hash of the file in the to reference, zero if the file was deleted.
+	change  *object.Change
+}
+
+// Path returns the path of the file after the change, or before the change if the file was deleted.
+func (c *FileChange) Path() string {
+	if c.NewPath != "" {
+		return c.NewPath
+	}
+	return c.OldPath
+}
+
+// Patch returns the change as a unified diff.
+//
+// Note: The patch is computed on demand and reads both versions of the file into memory.
+func (c *FileChange) Patch() (string, error) {
+	patch, err := c.change.Patch()
+	if err != nil {
+		return "", fmt.Errorf("unable to compute patch for %s: %v", c.Path(), err)
+	}
+	return patch.String(), nil
+}
+
+// Diff returns the files changed between the fromRef and toRef references.
+// If pathGlob is set, only changes where either the old or new path matches the glob are returned.
+//
+// Files which were moved without changing their contents are reported as a single Renamed change.
+func (r *Repo) Diff(fromRef, toRef, pathGlob string) ([]*FileChange, error) {
+	var g glob.Glob
+	var err error
+	if pathGlob != "" {
+		g, err = glob.Compile(pathGlob)
+		if err != nil {
+			return nil, fmt.Errorf("unable to compile pathGlob matcher: %v", err)
+		}
+	}
+
+	fromCommit, err := r.getCommit(fromRef)
+	if err != nil {
+		return nil, fmt.Errorf("unable to load from reference: %v", err)
+	}
+	toCommit, err := r.getCommit(toRef)
+	if err != nil {
+		return nil, fmt.Errorf("unable to load to reference: %v", err)
+	}
+
+	changes, err := diffCommits(fromCommit, toCommit)
+	if err != nil {
+		return nil, err
+	}
+
+	var fileChanges []*FileChange
+	for _, change := range changes {
+		// If pathGlob is set, skip the change if neither path matches
+		if g != nil && !g.Match(change.OldPath) && !g.Match(change.NewPath) {
+			continue
+		}
+		fileChanges = append(fileChanges, change)
+	}
+	return fileChanges, nil
+}
+
+// diffCommits computes the file changes between the trees of two commits,
+// sorted by path
+func diffCommits(from, to *object.Commit) ([]*FileChange, error) {
+	fromTree, err := from.Tree()
+	if err != nil {
+		return nil, fmt.Errorf("unable to fetch commit tree: %v", err)
+	}
+	toTree, err := to.Tree()
+	if err != nil {
+		return nil, fmt.Errorf("unable to fetch commit tree: %v", err)
+	}
+
+	changes, err := object.DiffTree(fromTree, toTree)
+	if err != nil {
+		return nil, fmt.Errorf("unable to diff trees: %v", err)
+	}
+
+	var fileChanges []*FileChange
+	for _, change := range changes {
+		fileChange, err := newFileChange(change)
+		if err != nil {
+			return nil, err
+		}
+		fileChanges = append(fileChanges, fileChange)
+	}
+
+	fileChanges = detectRenames(fileChanges)
+	sort.Slice(fileChanges, func(i, j int) bool {
+		return fileChanges[i].Path() < fileChanges[j].Path()
+	})
+	return fileChanges, nil
+}
+
+// newFileChange converts a go-git tree change into a FileChange
+func newFileChange(change *object.Change) (*FileChange, error) {
+	action, err := change.Action()
+	if err != nil {
+		return nil, fmt.Errorf("unable to determine change action: %v", err)
+	}
+
+	fileChange := &FileChange{
+		OldPath: change.From.Name,
+		NewPath: change.To.Name,
+		OldHash: change.From.TreeEntry.Hash,
+		NewHash: change.To.TreeEntry.Hash,
+		change:  change,
+	}
+	switch action {
+	case merkletrie.Insert:
+		fileChange.Type = Added
+	case merkletrie.Delete:
+		fileChange.Type = Deleted
+	case merkletrie.Modify:
+		fileChange.Type = Modified
+	}
+	return fileChange, nil
+}
+
+// detectRenames pairs deleted and added files with identical contents and
+// replaces them with a single Renamed change
+func detectRenames(changes []*FileChange) []*FileChange {
+	deleted := make(map[plumbing.Hash][]*FileChange)
+	for _, change := range changes {
+		if change.Type == Deleted {
+			deleted[change.OldHash] = append(deleted[change.OldHash], change)
+		}
+	}
+
+	renamed := make(map[*FileChange]bool)
+	var result []*FileChange
+	for _, change := range changes {
+		if change.Type != Added || len(deleted[change.NewHash]) == 0 {
+			continue
+		}
+		from := deleted[change.NewHash][0]
+		deleted[change.NewHash] = deleted[change.NewHash][1:]
+		renamed[from] = true
+		renamed[change] = true
+		result = append(result, &FileChange{
+			Type:    Renamed,
+			OldPath: from.OldPath,
+			NewPath: change.NewPath,
+			OldHash: from.OldHash,
+			NewHash: change.NewHash,
+			change: &object.Change{
+				From: from.change.From,
+				To:   change.change.To,
+			},
+		})
+	}
+
+	for _, change := range changes {
+		if !renamed[change] {
+			result = append(result, change)
+		}
+	}
+	return result
+}
@@ -0,0 +1,112 @@
+/*
+Copyright 2018 Pusher Ltd.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package gitstore
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("GitStore", func() {
+
+	Context("When diffing two references", func() {
+		var repositoryDir string
+		var repo *Repo
+
+		BeforeEach(func() {
+			repositoryDir = setupRepository()
+			err := ioutil.WriteFile(filepath.Join(repositoryDir, "CHANGELOG"), []byte("Updated changelog\n"), 0644)
+			Expect(err).ToNot(HaveOccurred())
+			runGit(repositoryDir, "mv", "json/short.json", "json/tiny.json")
+			runGit(repositoryDir, "rm", "php/crappy.php")
+			runGit(repositoryDir, "commit", "-a", "-m", "Change some files")
+
+			rs := NewRepoStore("")
+			repo, err = rs.Get(&RepoRef{
+				URL: fmt.Sprintf("file://%s", repositoryDir),
+			})
+			Expect(err).ToNot(HaveOccurred())
+		})
+
+		AfterEach(func() {
+			teardownRepository(repositoryDir)
+		})
+
+		It("Should list files added between two commits", func() {
+			changes, err := repo.Diff("b029517f6300c2da0f4b651b8642506cd6aaf45d", "6ecf0ef2c2dffb796033e5a02219af86ec6584e5", "")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(changes).To(HaveLen(7))
+			for _, change := range changes {
+				Expect(change.Type).To(Equal(Added))
+				Expect(change.OldPath).To(BeEmpty())
+				Expect(change.OldHash.IsZero()).To(BeTrue())
+				Expect(change.NewHash.IsZero()).To(BeFalse())
+			}
+		})
+
+		It("Should filter changes by the path glob", func() {
+			changes, err := repo.Diff("b029517f6300c2da0f4b651b8642506cd6aaf45d", "6ecf0ef2c2dffb796033e5a02219af86ec6584e5", "json/*")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(changes).To(HaveLen(2))
+			Expect(changes[0].NewPath).To(Equal("json/long.json"))
+			Expect(changes[1].NewPath).To(Equal("json/short.json"))
+		})
+
+		It("Should report modified, deleted and renamed files", func() {
+			changes, err := repo.Diff("f835a00b5e29ae3440a08fd51aadf4a07d6abc25", "master", "")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(changes).To(HaveLen(3))
+
+			Expect(changes[0].Type).To(Equal(Modified))
+			Expect(changes[0].OldPath).To(Equal("CHANGELOG"))
+			Expect(changes[0].NewPath).To(Equal("CHANGELOG"))
+			Expect(changes[0].OldHash).ToNot(Equal(changes[0].NewHash))
+
+			Expect(changes[1].Type).To(Equal(Renamed))
+			Expect(changes[1].OldPath).To(Equal("json/short.json"))
+			Expect(changes[1].NewPath).To(Equal("json/tiny.json"))
+			Expect(changes[1].OldHash).To(Equal(changes[1].NewHash))
+
+			Expect(changes[2].Type).To(Equal(Deleted))
+			Expect(changes[2].OldPath).To(Equal("php/crappy.php"))
+			Expect(changes[2].NewPath).To(BeEmpty())
+		})
+
+		It("Should match renamed files by either path", func() {
+			changes, err := repo.Diff("f835a00b5e29ae3440a08fd51aadf4a07d6abc25", "master", "json/short.json")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(changes).To(HaveLen(1))
+			Expect(changes[0].Type).To(Equal(Renamed))
+		})
+
+		It("Should produce a unified patch for a change", func() {
+			changes, err := repo.Diff("f835a00b5e29ae3440a08fd51aadf4a07d6abc25", "master", "CHANGELOG")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(changes).To(HaveLen(1))
+			patch, err := changes[0].Patch()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(patch).To(ContainSubstring("-Initial changelog"))
+			Expect(patch).To(ContainSubstring("+Updated changelog"))
+		})
+
+		It("Should return an error for an unknown reference", func() {
+			_, err := repo.Diff("not-a-ref", "master", "")
+			Expect(err).To(HaveOccurred())
+		})
+	})
+})
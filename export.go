@@ -0,0 +1,277 @@
+/*
+Copyright 2018 Pusher Ltd.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package gitstore
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/gobwas/glob"
+	"github.com/golang/glog"
+	"gopkg.in/src-d/go-git.v4/plumbing"
+	"gopkg.in/src-d/go-git.v4/plumbing/filemode"
+	"gopkg.in/src-d/go-git.v4/plumbing/object"
+)
+
+// ExportMarker is the file written into exported directories recording the commit and path glob they were exported from.
+const ExportMarker = ".gitstore-export"
+
+// ExportTo writes the files of the commit ref resolves to into dir, preserving file modes and symlinks.
+// If pathGlob is set, only the files matching it are written.
+//
+// Each export is written to a new versioned directory alongside dir, and dir is a symlink that is atomically switched to
+// the new version once it is complete, so readers resolving dir see either the previous or the new export, never a
+// partial one. The previous version is then removed. A plain directory left at dir by an earlier release is replaced
+// once by moving it aside, during which dir briefly does not exist. Any other existing dir without an ExportMarker is
+// left untouched and an error is returned.
+// If dir contains a previous export with the same pathGlob, only the files that differ between the commits are written,
+// unchanged files are hard linked from the previous export, so exported files should not be modified in place.
+func (r *Repo) ExportTo(ref, dir, pathGlob string) error {
+	var g glob.Glob
+	if pathGlob != "" {
+		var err error
+		g, err = glob.Compile(pathGlob)
+		if err != nil {
+			return fmt.Errorf("unable to compile path matcher: %v", err)
+		}
+	}
+
+	commit, err := r.getCommit(ref)
+	if err != nil {
+		return err
+	}
+	dir, err = filepath.Abs(dir)
+	if err != nil {
+		return fmt.Errorf("unable to resolve export directory: %v", err)
+	}
+
+	changed, err := r.changedExportFiles(dir, pathGlob, commit)
+	if err != nil {
+		glog.V(2).Infof("Unable to update previous export of %s, exporting all files: %v", dir, err)
+		changed = nil
+	}
+
+	err = os.MkdirAll(filepath.Dir(dir), 0755)
+	if err != nil {
+		return fmt.Errorf("unable to create export parent directory: %v", err)
+	}
+	tmpDir, err := ioutil.TempDir(filepath.Dir(dir), exportVersionPrefix(dir))
+	if err != nil {
+		return fmt.Errorf("unable to create temporary export directory: %v", err)
+	}
+	switched := false
+	defer func() {
+		if !switched {
+			os.RemoveAll(tmpDir)
+		}
+	}()
+
+	err = writeExport(tmpDir, dir, commit, g, changed)
+	if err != nil {
+		return fmt.Errorf("unable to export %s: %v", ref, err)
+	}
+	marker := fmt.Sprintf("commit %s\nglob %s\n", commit.Hash, pathGlob)
+	err = ioutil.WriteFile(filepath.Join(tmpDir, ExportMarker), []byte(marker), 0644)
+	if err != nil {
+		return fmt.Errorf("unable to write export marker: %v", err)
+	}
+	err = os.Chmod(tmpDir, 0755)
+	if err != nil {
+		return fmt.Errorf("unable to set export directory mode: %v", err)
+	}
+
+	err = switchExport(tmpDir, dir)
+	if err != nil {
+		return err
+	}
+	switched = true
+	return nil
+}
+
+// exportVersionPrefix is the prefix of the names of the versioned directories
+// holding the exports of dir
+func exportVersionPrefix(dir string) string {
+	return fmt.Sprintf(".%s.export", filepath.Base(dir))
+}
+
+// changedExportFiles returns the paths that differ between the previous
+// export of dir and the commit, or nil if there is no usable previous export
+func (r *Repo) changedExportFiles(dir, pathGlob string, commit *object.Commit) (map[string]bool, error) {
+	marker, err := ioutil.ReadFile(filepath.Join(dir, ExportMarker))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to read export marker: %v", err)
+	}
+
+	var previousHash, previousGlob string
+	for _, line := range strings.Split(string(marker), "\n") {
+		parts := strings.SplitN(line, " ", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		switch parts[0] {
+		case "commit":
+			previousHash = parts[1]
+		case "glob":
+			previousGlob = parts[1]
+		}
+	}
+	if previousGlob != pathGlob {
+		return nil, fmt.Errorf("previous export used path glob %q", previousGlob)
+	}
+	previous, err := r.commitObject(plumbing.NewHash(previousHash))
+	if err != nil {
+		return nil, err
+	}
+
+	previousTree, err := previous.Tree()
+	if err != nil {
+		return nil, fmt.Errorf("unable to fetch commit tree: %v", err)
+	}
+	tree, err := commit.Tree()
+	if err != nil {
+		return nil, fmt.Errorf("unable to fetch commit tree: %v", err)
+	}
+	changes, err := object.DiffTree(previousTree, tree)
+	if err != nil {
+		return nil, fmt.Errorf("unable to diff commits: %v", err)
+	}
+	changed := make(map[string]bool)
+	for _, change := range changes {
+		changed[change.From.Name] = true
+		changed[change.To.Name] = true
+	}
+	return changed, nil
+}
+
+// writeExport writes the files of the commit matching the glob into dir.
+// If changed is not nil, files not in it are hard linked from the previous
+// export instead.
+func writeExport(dir, previousDir string, commit *object.Commit, g glob.Glob, changed map[string]bool) error {
+	files, err := commit.Files()
+	if err != nil {
+		return fmt.Errorf("unable to load files: %v", err)
+	}
+	defer files.Close()
+
+	return files.ForEach(func(file *object.File) error {
+		if g != nil && !g.Match(file.Name) {
+			return nil
+		}
+		name := filepath.FromSlash(file.Name)
+		if strings.HasPrefix(filepath.Clean(name), "..") || filepath.IsAbs(name) {
+			return fmt.Errorf("invalid path %s", file.Name)
+		}
+		target := filepath.Join(dir, name)
+		err := os.MkdirAll(filepath.Dir(target), 0755)
+		if err != nil {
+			return fmt.Errorf("unable to create directory for %s: %v", file.Name, err)
+		}
+
+		if changed != nil && !changed[file.Name] && file.Mode != filemode.Symlink {
+			err = os.Link(filepath.Join(previousDir, name), target)
+			if err == nil {
+				return nil
+			}
+			// Fall back to writing the file if the previous export was modified
+		}
+		return writeExportFile(target, file)
+	})
+}
+
+// writeExportFile writes a single file or symlink
+func writeExportFile(target string, file *object.File) error {
+	if file.Mode == filemode.Symlink {
+		link, err := file.Contents()
+		if err != nil {
+			return fmt.Errorf("unable to read symlink %s: %v", file.Name, err)
+		}
+		return os.Symlink(link, target)
+	}
+
+	mode := os.FileMode(0644)
+	if file.Mode == filemode.Executable {
+		mode = 0755
+	}
+	f, err := os.OpenFile(target, os.O_CREATE|os.O_EXCL|os.O_WRONLY, mode)
+	if err != nil {
+		return fmt.Errorf("unable to create %s: %v", file.Name, err)
+	}
+	err = copyFileContents(f, file)
+	if err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// switchExport atomically points the dir symlink at the version directory,
+// then removes the version it pointed at previously
+func switchExport(version, dir string) error {
+	info, err := os.Lstat(dir)
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("unable to stat %s: %v", dir, err)
+	}
+	if err == nil && info.Mode()&os.ModeSymlink == 0 {
+		// Never delete a directory that was not written by an export
+		_, err = os.Stat(filepath.Join(dir, ExportMarker))
+		if err != nil {
+			return fmt.Errorf("unable to replace %s, it is not a previous export: %v", dir, err)
+		}
+		return replaceDirectory(version, dir)
+	}
+	previous, _ := os.Readlink(dir)
+
+	// Renaming a symlink over another replaces it atomically
+	link := fmt.Sprintf("%s.link", version)
+	err = os.Symlink(filepath.Base(version), link)
+	if err != nil {
+		return fmt.Errorf("unable to create export symlink: %v", err)
+	}
+	err = os.Rename(link, dir)
+	if err != nil {
+		os.Remove(link)
+		return fmt.Errorf("unable to switch export: %v", err)
+	}
+
+	// Only remove directories created by a previous export
+	if previous != "" && filepath.Base(previous) == previous && strings.HasPrefix(previous, exportVersionPrefix(dir)) {
+		err = os.RemoveAll(filepath.Join(filepath.Dir(dir), previous))
+		if err != nil {
+			glog.Warningf("Unable to remove previous export of %s: %v", dir, err)
+		}
+	}
+	return nil
+}
+
+// replaceDirectory replaces the plain directory at dst with a symlink to src,
+// moving the directory aside first since a symlink cannot be renamed over it
+func replaceDirectory(src, dst string) error {
+	old := fmt.Sprintf("%s.old", src)
+	err := os.Rename(dst, old)
+	if err != nil {
+		return fmt.Errorf("unable to move previous export: %v", err)
+	}
+	err = os.Symlink(filepath.Base(src), dst)
+	if err != nil {
+		os.Rename(old, dst)
+		return fmt.Errorf("unable to move export into place: %v", err)
+	}
+	return os.RemoveAll(old)
+}
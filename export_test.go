@@ -0,0 +1,178 @@
+/*
+Copyright 2018 Pusher Ltd.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package gitstore
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("GitStore", func() {
+
+	Context("When exporting a revision to a directory", func() {
+		var repo *Repo
+		var parentDir, exportDir string
+
+		// listExport returns the paths of the files in the export, excluding
+		// the marker
+		listExport := func() []string {
+			paths := []string{}
+			versionDir, err := filepath.EvalSymlinks(exportDir)
+			Expect(err).ToNot(HaveOccurred())
+			err = filepath.Walk(versionDir, func(p string, info os.FileInfo, err error) error {
+				if err != nil || info.IsDir() {
+					return err
+				}
+				rel, err := filepath.Rel(versionDir, p)
+				if err != nil || rel == ExportMarker {
+					return err
+				}
+				paths = append(paths, filepath.ToSlash(rel))
+				return nil
+			})
+			Expect(err).ToNot(HaveOccurred())
+			return paths
+		}
+
+		BeforeEach(func() {
+			var err error
+			repo, err = NewRepoStore("").Get(&RepoRef{URL: repositoryURL})
+			Expect(err).ToNot(HaveOccurred())
+			parentDir, err = ioutil.TempDir("", "git-store-export")
+			Expect(err).ToNot(HaveOccurred())
+			exportDir = filepath.Join(parentDir, "export")
+		})
+
+		AfterEach(func() {
+			os.RemoveAll(parentDir)
+		})
+
+		It("Should write the files of the commit", func() {
+			Expect(repo.ExportTo("master", exportDir, "")).To(Succeed())
+			Expect(listExport()).To(HaveLen(11))
+
+			content, err := ioutil.ReadFile(filepath.Join(exportDir, "CHANGELOG"))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(string(content)).To(Equal("Initial changelog\n"))
+			info, err := os.Lstat(filepath.Join(exportDir, "CHANGELOG"))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(info.Mode().Perm()).To(Equal(os.FileMode(0644)))
+
+			link, err := os.Readlink(filepath.Join(exportDir, "links", "example.go"))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(link).To(Equal("../go/example.go"))
+			_, err = os.Stat(filepath.Join(exportDir, "links", "example.go"))
+			Expect(err).ToNot(HaveOccurred())
+		})
+
+		It("Should only write files matching the glob", func() {
+			Expect(repo.ExportTo("master", exportDir, "json/*")).To(Succeed())
+			Expect(listExport()).To(ConsistOf("json/long.json", "json/short.json"))
+		})
+
+		It("Should preserve executable modes", func() {
+			repositoryDir := setupRepository()
+			defer teardownRepository(repositoryDir)
+			runGit(repositoryDir, "update-index", "--chmod=+x", "vendor/foo.go")
+			runGit(repositoryDir, "commit", "-m", "Make foo executable")
+			repo, err := NewRepoStore("").Get(&RepoRef{URL: fmt.Sprintf("file://%s", repositoryDir)})
+			Expect(err).ToNot(HaveOccurred())
+
+			Expect(repo.ExportTo("master", exportDir, "")).To(Succeed())
+			info, err := os.Stat(filepath.Join(exportDir, "vendor", "foo.go"))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(info.Mode().Perm()).To(Equal(os.FileMode(0755)))
+		})
+
+		It("Should update a previous export with the changes", func() {
+			Expect(repo.ExportTo("b029517f6300c2da0f4b651b8642506cd6aaf45d", exportDir, "")).To(Succeed())
+			Expect(listExport()).To(ConsistOf(".gitignore", "LICENSE"))
+			license, err := os.Stat(filepath.Join(exportDir, "LICENSE"))
+			Expect(err).ToNot(HaveOccurred())
+
+			Expect(repo.ExportTo("master", exportDir, "")).To(Succeed())
+			Expect(listExport()).To(HaveLen(11))
+			// Unchanged files are reused from the previous export
+			updated, err := os.Stat(filepath.Join(exportDir, "LICENSE"))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(os.SameFile(license, updated)).To(BeTrue())
+
+			Expect(repo.ExportTo("b029517f6300c2da0f4b651b8642506cd6aaf45d", exportDir, "")).To(Succeed())
+			Expect(listExport()).To(ConsistOf(".gitignore", "LICENSE"))
+		})
+
+		It("Should export all files when the glob changes", func() {
+			Expect(repo.ExportTo("master", exportDir, "json/*")).To(Succeed())
+			Expect(repo.ExportTo("master", exportDir, "")).To(Succeed())
+			Expect(listExport()).To(HaveLen(11))
+		})
+
+		It("Should not leave temporary directories behind", func() {
+			Expect(repo.ExportTo("master", exportDir, "")).To(Succeed())
+			Expect(repo.ExportTo("b029517f6300c2da0f4b651b8642506cd6aaf45d", exportDir, "")).To(Succeed())
+			entries, err := ioutil.ReadDir(parentDir)
+			Expect(err).ToNot(HaveOccurred())
+			// The export symlink and the version it points at
+			Expect(entries).To(HaveLen(2))
+		})
+
+		It("Should switch the export directory atomically", func() {
+			Expect(repo.ExportTo("master", exportDir, "")).To(Succeed())
+			previous, err := os.Readlink(exportDir)
+			Expect(err).ToNot(HaveOccurred())
+
+			Expect(repo.ExportTo("b029517f6300c2da0f4b651b8642506cd6aaf45d", exportDir, "")).To(Succeed())
+			current, err := os.Readlink(exportDir)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(current).ToNot(Equal(previous))
+			_, err = os.Stat(filepath.Join(parentDir, previous))
+			Expect(os.IsNotExist(err)).To(BeTrue())
+		})
+
+		It("Should replace a plain export directory", func() {
+			Expect(os.MkdirAll(filepath.Join(exportDir, "stale"), 0755)).To(Succeed())
+			Expect(ioutil.WriteFile(filepath.Join(exportDir, ExportMarker), []byte("glob \n"), 0644)).To(Succeed())
+			Expect(repo.ExportTo("master", exportDir, "")).To(Succeed())
+			info, err := os.Lstat(exportDir)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(info.Mode() & os.ModeSymlink).ToNot(BeZero())
+			Expect(listExport()).To(HaveLen(11))
+		})
+
+		It("Should not replace a directory which is not an export", func() {
+			Expect(os.MkdirAll(exportDir, 0755)).To(Succeed())
+			Expect(ioutil.WriteFile(filepath.Join(exportDir, "important.txt"), []byte("keep\n"), 0644)).To(Succeed())
+			Expect(repo.ExportTo("master", exportDir, "")).To(MatchError(ContainSubstring("not a previous export")))
+
+			info, err := os.Lstat(exportDir)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(info.IsDir()).To(BeTrue())
+			Expect(ioutil.ReadFile(filepath.Join(exportDir, "important.txt"))).To(Equal([]byte("keep\n")))
+			entries, err := ioutil.ReadDir(parentDir)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(entries).To(HaveLen(1))
+		})
+
+		It("Should leave the previous export in place on failure", func() {
+			Expect(repo.ExportTo("master", exportDir, "")).To(Succeed())
+			Expect(repo.ExportTo("missing", exportDir, "")).ToNot(Succeed())
+			Expect(listExport()).To(HaveLen(11))
+		})
+	})
+})
@@ -7,6 +7,7 @@ import (
 	"os"
 	"os/exec"
 	"path/filepath"
+	"strings"
 	"testing"
 
 	. "github.com/onsi/ginkgo"
@@ -38,6 +39,16 @@ func teardownRepository(dir string) {
 	os.RemoveAll(dir)
 }
 
+// runGit runs a git command against the repository in dir, using a fixed
+// identity so that tests can create commits and tags in fixture copies.
+func runGit(dir string, args ...string) string {
+	args = append([]string{"-C", dir, "-c", "user.name=Git Store", "-c", "user.email=git-store@example.com"}, args...)
+	cmd := exec.Command("git", args...)
+	out, err := cmd.CombinedOutput()
+	Expect(err).ToNot(HaveOccurred(), string(out))
+	return strings.TrimSpace(string(out))
+}
+
 var _ = BeforeSuite(func() {
 	repositoryPath = setupRepository()
 	repositoryURL = fmt.Sprintf("file://%s", repositoryPath)
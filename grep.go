@@ -0,0 +1,226 @@
+/*
+Copyright 2018 Pusher Ltd.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package gitstore
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"regexp"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/gobwas/glob"
+	"gopkg.in/src-d/go-git.v4/plumbing/filemode"
+	"gopkg.in/src-d/go-git.v4/plumbing/object"
+)
+
+// binaryDetectionLength is the number of bytes checked for a NUL byte to
+// detect binary files, as git does
+const binaryDetectionLength = 8000
+
+// GrepOptions configures a search of the files of a revision.
+type GrepOptions struct {
+	FixedString  bool   // FixedString matches the pattern literally rather than as a regular expression.
+	IgnoreCase   bool   // IgnoreCase matches without regard to case.
+	PathGlob     string // PathGlob limits the search to the files matching it, all files are searched if empty.
+	ContextLines int    // ContextLines is the number of lines to include before and after each matching line.
+	Concurrency  int    // Concurrency is the number of files searched at once, defaults to the number of CPUs.
+}
+
+// GrepMatch is a single match of a pattern within a file.
+type GrepMatch struct {
+	Path   string   // Path is the path of the file containing the match.
+	Line   int      // Line is the line number of the match, starting at 1.
+	Column int      // Column is the byte offset of the match within the line, starting at 1.
+	Text   string   // Text is the content of the line containing the match.
+	Before []string // Before contains up to ContextLines lines preceding the matching line.
+	After  []string // After contains up to ContextLines lines following the matching line.
+}
+
+// Grep searches the files of the commit ref resolves to for the pattern and returns the matches sorted by path, line and column.
+// Binary files and symlinks are skipped.
+func (r *Repo) Grep(ref, pattern string, opts GrepOptions) ([]GrepMatch, error) {
+	expr, err := compileGrepPattern(pattern, opts)
+	if err != nil {
+		return nil, err
+	}
+	var g glob.Glob
+	if opts.PathGlob != "" {
+		g, err = glob.Compile(opts.PathGlob)
+		if err != nil {
+			return nil, fmt.Errorf("unable to compile path matcher: %v", err)
+		}
+	}
+	if opts.ContextLines < 0 {
+		return nil, fmt.Errorf("context lines must not be negative")
+	}
+	concurrency := opts.Concurrency
+	if concurrency <= 0 {
+		concurrency = runtime.NumCPU()
+	}
+
+	commit, err := r.getCommit(ref)
+	if err != nil {
+		return nil, err
+	}
+	files, err := commit.Files()
+	if err != nil {
+		return nil, fmt.Errorf("unable to load files: %v", err)
+	}
+	defer files.Close()
+
+	type result struct {
+		matches []GrepMatch
+		err     error
+	}
+	queue := make(chan *object.File)
+	results := make(chan result)
+	wg := sync.WaitGroup{}
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for file := range queue {
+				matches, err := grepFile(file, expr, opts.ContextLines)
+				results <- result{matches: matches, err: err}
+			}
+		}()
+	}
+
+	walkErr := make(chan error, 1)
+	go func() {
+		walkErr <- files.ForEach(func(file *object.File) error {
+			if file.Mode == filemode.Symlink || (g != nil && !g.Match(file.Name)) {
+				return nil
+			}
+			queue <- file
+			return nil
+		})
+		close(queue)
+		wg.Wait()
+		close(results)
+	}()
+
+	matches := []GrepMatch{}
+	var searchErr error
+	for res := range results {
+		if res.err != nil && searchErr == nil {
+			searchErr = res.err
+		}
+		matches = append(matches, res.matches...)
+	}
+	if err := <-walkErr; err != nil {
+		return nil, fmt.Errorf("unable to load files: %v", err)
+	}
+	if searchErr != nil {
+		return nil, searchErr
+	}
+
+	sort.Slice(matches, func(i, j int) bool {
+		if matches[i].Path != matches[j].Path {
+			return matches[i].Path < matches[j].Path
+		}
+		if matches[i].Line != matches[j].Line {
+			return matches[i].Line < matches[j].Line
+		}
+		return matches[i].Column < matches[j].Column
+	})
+	return matches, nil
+}
+
+// compileGrepPattern compiles the pattern according to the options
+func compileGrepPattern(pattern string, opts GrepOptions) (*regexp.Regexp, error) {
+	if pattern == "" {
+		return nil, fmt.Errorf("pattern must not be empty")
+	}
+	if opts.FixedString {
+		pattern = regexp.QuoteMeta(pattern)
+	}
+	if opts.IgnoreCase {
+		pattern = fmt.Sprintf("(?i)%s", pattern)
+	}
+	expr, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, fmt.Errorf("unable to compile pattern: %v", err)
+	}
+	return expr, nil
+}
+
+// grepFile returns the matches of the expression in the file, or nothing if
+// the file is binary
+func grepFile(file *object.File, expr *regexp.Regexp, contextLines int) ([]GrepMatch, error) {
+	reader, err := file.Reader()
+	if err != nil {
+		return nil, fmt.Errorf("unable to read %s: %v", file.Name, err)
+	}
+	defer reader.Close()
+	content, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read %s: %v", file.Name, err)
+	}
+	if isBinary(content) {
+		return nil, nil
+	}
+
+	lines := strings.Split(strings.TrimSuffix(string(content), "\n"), "\n")
+	matches := []GrepMatch{}
+	for i, line := range lines {
+		for _, loc := range expr.FindAllStringIndex(line, -1) {
+			matches = append(matches, GrepMatch{
+				Path:   file.Name,
+				Line:   i + 1,
+				Column: loc[0] + 1,
+				Text:   line,
+				Before: contextBefore(lines, i, contextLines),
+				After:  contextAfter(lines, i, contextLines),
+			})
+		}
+	}
+	return matches, nil
+}
+
+// isBinary checks for a NUL byte near the start of the content
+func isBinary(content []byte) bool {
+	if len(content) > binaryDetectionLength {
+		content = content[:binaryDetectionLength]
+	}
+	return bytes.IndexByte(content, 0) >= 0
+}
+
+// contextBefore returns up to n lines preceding line i
+func contextBefore(lines []string, i, n int) []string {
+	if n == 0 {
+		return nil
+	}
+	start := i - n
+	if start < 0 {
+		start = 0
+	}
+	return lines[start:i]
+}
+
+// contextAfter returns up to n lines following line i
+func contextAfter(lines []string, i, n int) []string {
+	if n == 0 {
+		return nil
+	}
+	end := i + 1 + n
+	if end > len(lines) {
+		end = len(lines)
+	}
+	return lines[i+1 : end]
+}
@@ -0,0 +1,104 @@
+/*
+Copyright 2018 Pusher Ltd.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package gitstore
+
+import (
+	"fmt"
+	"strings"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("GitStore", func() {
+
+	Context("When searching the files of a revision", func() {
+		var repo *Repo
+
+		// locations returns the path, line and column of each match
+		locations := func(matches []GrepMatch) []string {
+			locs := []string{}
+			for _, match := range matches {
+				locs = append(locs, fmt.Sprintf("%s:%d:%d", match.Path, match.Line, match.Column))
+			}
+			return locs
+		}
+
+		BeforeEach(func() {
+			var err error
+			repo, err = NewRepoStore("").Get(&RepoRef{URL: repositoryURL})
+			Expect(err).ToNot(HaveOccurred())
+		})
+
+		It("Should find regular expression matches", func() {
+			matches, err := repo.Grep("master", `^package \w+`, GrepOptions{})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(locations(matches)).To(Equal([]string{"go/example.go:1:1", "vendor/foo.go:1:1"}))
+			Expect(matches[0].Text).To(Equal("package harvesterd"))
+		})
+
+		It("Should find every fixed string match within the glob", func() {
+			matches, err := repo.Grep("master", "SGML", GrepOptions{FixedString: true, PathGlob: "json/*"})
+			Expect(err).ToNot(HaveOccurred())
+
+			expected := strings.Split(runGit(repositoryPath, "grep", "-o", "-n", "--column", "-F", "SGML", "master", "--", "json"), "\n")
+			for i := range expected {
+				expected[i] = strings.TrimPrefix(expected[i], "master:")
+				expected[i] = strings.TrimSuffix(expected[i], ":SGML")
+			}
+			Expect(locations(matches)).To(Equal(expected))
+		})
+
+		It("Should ignore case when requested", func() {
+			matches, err := repo.Grep("master", "license", GrepOptions{PathGlob: "LICENSE"})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(matches).To(HaveLen(1))
+
+			matches, err = repo.Grep("master", "license", GrepOptions{PathGlob: "LICENSE", IgnoreCase: true})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(locations(matches)).To(Equal([]string{"LICENSE:1:9", "LICENSE:8:54"}))
+		})
+
+		It("Should include context lines", func() {
+			matches, err := repo.Grep("master", `"ID": "SGML"`, GrepOptions{FixedString: true, PathGlob: "json/short.json", ContextLines: 2})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(matches).To(HaveLen(1))
+			Expect(matches[0].Line).To(Equal(8))
+			Expect(matches[0].Before).To(Equal([]string{`            "GlossList": {`, `                "GlossEntry": {`}))
+			Expect(matches[0].After).To(Equal([]string{`                    "SortAs": "SGML",`, `                    "GlossTerm": "Standard Generalized Markup Language",`}))
+		})
+
+		It("Should skip binary files", func() {
+			matches, err := repo.Grep("master", "JFIF", GrepOptions{FixedString: true})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(matches).To(BeEmpty())
+		})
+
+		It("Should return the same matches regardless of concurrency", func() {
+			concurrent, err := repo.Grep("master", "SGML", GrepOptions{Concurrency: 8})
+			Expect(err).ToNot(HaveOccurred())
+			serial, err := repo.Grep("master", "SGML", GrepOptions{Concurrency: 1})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(concurrent).To(Equal(serial))
+			Expect(concurrent).ToNot(BeEmpty())
+		})
+
+		It("Should reject invalid patterns", func() {
+			_, err := repo.Grep("master", "(", GrepOptions{})
+			Expect(err).To(HaveOccurred())
+			_, err = repo.Grep("master", "", GrepOptions{})
+			Expect(err).To(HaveOccurred())
+		})
+	})
+})
@@ -0,0 +1,155 @@
+/*
+Copyright 2018 Pusher Ltd.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package gitstore
+
+import (
+	"fmt"
+
+	"gopkg.in/src-d/go-git.v4/plumbing"
+	"gopkg.in/src-d/go-git.v4/plumbing/object"
+	"gopkg.in/src-d/go-git.v4/plumbing/storer"
+)
+
+// History returns up to n commits that modified the file, newest first, starting from the commit the File was read from.
+// If n is zero, the full history is returned.
+// If followRenames is set, the history continues past commits that renamed the file without changing its contents.
+func (f *File) History(n int, followRenames bool) ([]GitLog, error) {
+	path := f.file.Name
+	commitIter := object.NewCommitIterCTime(f.headCommit, nil, nil)
+
+	logs := []GitLog{}
+	err := commitIter.ForEach(func(c *object.Commit) error {
+		if n > 0 && len(logs) >= n {
+			return storer.ErrStop
+		}
+
+		changed, renamedFrom, err := commitChangesPath(c, path, followRenames)
+		if err != nil {
+			return err
+		}
+		if !changed {
+			return nil
+		}
+
+		logs = append(logs, newGitLog(c))
+		if renamedFrom != "" {
+			path = renamedFrom
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("unable to walk history for %s: %v", f.file.Name, err)
+	}
+	return logs, nil
+}
+
+// LastCommit returns the most recent commit that modified the file.
+func (f *File) LastCommit() (GitLog, error) {
+	logs, err := f.History(1, false)
+	if err != nil {
+		return GitLog{}, err
+	}
+	if len(logs) == 0 {
+		return GitLog{}, fmt.Errorf("no commit found modifying %s", f.file.Name)
+	}
+	return logs[0], nil
+}
+
+// commitChangesPath checks whether the commit changed the file at path
+// compared to its parents.
+// A merge commit only changes the path if it differs from every parent.
+// If detectRename is set and the commit created the path by moving a file,
+// the previous path of the file is returned.
+func commitChangesPath(c *object.Commit, path string, detectRename bool) (bool, string, error) {
+	hash, err := pathHash(c, path)
+	if err != nil {
+		return false, "", err
+	}
+
+	parents := []*object.Commit{}
+	err = c.Parents().ForEach(func(parent *object.Commit) error {
+		parents = append(parents, parent)
+		return nil
+	})
+	if err != nil {
+		return false, "", fmt.Errorf("unable to load parents of %s: %v", c.Hash, err)
+	}
+	if len(parents) == 0 {
+		return !hash.IsZero(), "", nil
+	}
+
+	existedBefore := false
+	for _, parent := range parents {
+		parentHash, err := pathHash(parent, path)
+		if err != nil {
+			return false, "", err
+		}
+		if parentHash == hash {
+			return false, "", nil
+		}
+		if !parentHash.IsZero() {
+			existedBefore = true
+		}
+	}
+
+	if !detectRename || existedBefore || hash.IsZero() {
+		return true, "", nil
+	}
+	renamedFrom, err := findRenameSource(c, parents[0], hash)
+	if err != nil {
+		return false, "", err
+	}
+	return true, renamedFrom, nil
+}
+
+// pathHash returns the hash of the tree entry at path, or the zero hash if
+// the path does not exist in the commit
+func pathHash(c *object.Commit, path string) (plumbing.Hash, error) {
+	tree, err := c.Tree()
+	if err != nil {
+		return plumbing.ZeroHash, fmt.Errorf("unable to fetch commit tree: %v", err)
+	}
+	entry, err := tree.FindEntry(path)
+	if err == object.ErrDirectoryNotFound || err == object.ErrEntryNotFound {
+		return plumbing.ZeroHash, nil
+	}
+	if err != nil {
+		return plumbing.ZeroHash, fmt.Errorf("error looking up path: %v", err)
+	}
+	return entry.Hash, nil
+}
+
+// findRenameSource looks for a file removed between parent and c whose
+// contents match hash, returning its path in parent
+func findRenameSource(c, parent *object.Commit, hash plumbing.Hash) (string, error) {
+	tree, err := c.Tree()
+	if err != nil {
+		return "", fmt.Errorf("unable to fetch commit tree: %v", err)
+	}
+	parentTree, err := parent.Tree()
+	if err != nil {
+		return "", fmt.Errorf("unable to fetch parent commit tree: %v", err)
+	}
+
+	changes, err := object.DiffTree(parentTree, tree)
+	if err != nil {
+		return "", fmt.Errorf("unable to diff trees: %v", err)
+	}
+	for _, change := range changes {
+		if change.To.Name == "" && change.From.TreeEntry.Hash == hash {
+			return change.From.Name, nil
+		}
+	}
+	return "", nil
+}
@@ -0,0 +1,105 @@
+/*
+Copyright 2018 Pusher Ltd.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package gitstore
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("GitStore", func() {
+
+	Context("When reading the history of a file", func() {
+		var repositoryDir string
+		var repo *Repo
+		var renameCommit, emptyCommit string
+
+		BeforeEach(func() {
+			repositoryDir = setupRepository()
+			runGit(repositoryDir, "mv", "json/short.json", "json/tiny.json")
+			runGit(repositoryDir, "commit", "-m", "Rename short.json")
+			renameCommit = runGit(repositoryDir, "rev-parse", "HEAD")
+			err := ioutil.WriteFile(filepath.Join(repositoryDir, "empty"), []byte{}, 0644)
+			Expect(err).ToNot(HaveOccurred())
+			runGit(repositoryDir, "add", "empty")
+			runGit(repositoryDir, "commit", "-m", "Add empty file")
+			emptyCommit = runGit(repositoryDir, "rev-parse", "HEAD")
+
+			rs := NewRepoStore("")
+			repo, err = rs.Get(&RepoRef{
+				URL: fmt.Sprintf("file://%s", repositoryDir),
+			})
+			Expect(err).ToNot(HaveOccurred())
+			err = repo.Checkout("master")
+			Expect(err).ToNot(HaveOccurred())
+		})
+
+		AfterEach(func() {
+			teardownRepository(repositoryDir)
+		})
+
+		It("Should return the commit that last modified the file", func() {
+			foo, err := repo.GetFile("vendor/foo.go")
+			Expect(err).ToNot(HaveOccurred())
+			log, err := foo.LastCommit()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(log.Hash.String()).To(Equal("6ecf0ef2c2dffb796033e5a02219af86ec6584e5"))
+			Expect(log.Text).To(Equal("vendor stuff\n"))
+		})
+
+		It("Should return the last commit of an empty file", func() {
+			empty, err := repo.GetFile("empty")
+			Expect(err).ToNot(HaveOccurred())
+			log, err := empty.LastCommit()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(log.Hash.String()).To(Equal(emptyCommit))
+		})
+
+		It("Should not include merge commits that did not change the file", func() {
+			changelog, err := repo.GetFile("CHANGELOG")
+			Expect(err).ToNot(HaveOccurred())
+			logs, err := changelog.History(0, false)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(logs).To(HaveLen(1))
+			Expect(logs[0].Hash.String()).To(Equal("b8e471f58bcbca63b07bda20e428190409c2db47"))
+		})
+
+		It("Should stop at a rename unless following renames", func() {
+			tiny, err := repo.GetFile("json/tiny.json")
+			Expect(err).ToNot(HaveOccurred())
+			logs, err := tiny.History(0, false)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(logs).To(HaveLen(1))
+			Expect(logs[0].Hash.String()).To(Equal(renameCommit))
+
+			logs, err = tiny.History(0, true)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(logs).To(HaveLen(2))
+			Expect(logs[0].Hash.String()).To(Equal(renameCommit))
+			Expect(logs[1].Hash.String()).To(Equal("af2d6a6954d532f8ffb47615169c8fdf9d383a1a"))
+		})
+
+		It("Should limit the number of commits returned", func() {
+			tiny, err := repo.GetFile("json/tiny.json")
+			Expect(err).ToNot(HaveOccurred())
+			logs, err := tiny.History(1, true)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(logs).To(HaveLen(1))
+		})
+	})
+})
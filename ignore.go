@@ -0,0 +1,185 @@
+/*
+Copyright 2018 Pusher Ltd.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package gitstore
+
+import (
+	"fmt"
+	"io"
+	"path"
+	"sort"
+	"strings"
+
+	"gopkg.in/src-d/go-git.v4/plumbing/format/gitignore"
+	"gopkg.in/src-d/go-git.v4/plumbing/object"
+)
+
+const (
+	// GitStoreIgnoreFile is the name of the files, in gitignore syntax, listing paths to exclude from GetAllFiles.
+	GitStoreIgnoreFile = ".gitstoreignore"
+	// gitAttributesFile is the name of the files assigning attributes to paths
+	gitAttributesFile = ".gitattributes"
+	// exportIgnoreAttribute marks paths git archive excludes
+	exportIgnoreAttribute = "export-ignore"
+)
+
+// ignoreRules determines which files are excluded by ignore and attribute
+// files
+type ignoreRules struct {
+	ignore     gitignore.Matcher
+	attributes []attributeRule
+}
+
+// attributeRule sets or unsets the export-ignore attribute for the paths
+// matching the pattern
+type attributeRule struct {
+	pattern      gitignore.Pattern
+	exportIgnore bool
+}
+
+// ruleFile is a .gitstoreignore or .gitattributes file in a tree
+type ruleFile struct {
+	name  string
+	entry object.TreeEntry
+}
+
+// ignoreRulesAt returns the ignore rules of the commit, which are cached for
+// the last commit they were loaded for
+func (r *Repo) ignoreRulesAt(commit *object.Commit) (*ignoreRules, error) {
+	r.ignoreMutex.Lock()
+	defer r.ignoreMutex.Unlock()
+	if r.ignoreRules != nil && r.ignoreCommit == commit.Hash {
+		return r.ignoreRules, nil
+	}
+	rules, err := loadIgnoreRules(commit)
+	if err != nil {
+		return nil, err
+	}
+	r.ignoreRules = rules
+	r.ignoreCommit = commit.Hash
+	return rules, nil
+}
+
+// loadIgnoreRules reads every .gitstoreignore and .gitattributes file in the
+// tree of the commit, in order of increasing precedence.
+// Only the trees and the blobs of those files are read.
+func loadIgnoreRules(commit *object.Commit) (*ignoreRules, error) {
+	tree, err := commit.Tree()
+	if err != nil {
+		return nil, fmt.Errorf("unable to fetch commit tree: %v", err)
+	}
+	walker := object.NewTreeWalker(tree, true, nil)
+	defer walker.Close()
+
+	ruleFiles := []ruleFile{}
+	for {
+		name, entry, err := walker.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("unable to walk tree: %v", err)
+		}
+		if !entry.Mode.IsFile() {
+			continue
+		}
+		if entry.Name == GitStoreIgnoreFile || entry.Name == gitAttributesFile {
+			ruleFiles = append(ruleFiles, ruleFile{name: name, entry: entry})
+		}
+	}
+	// Files deeper in the tree take precedence
+	sort.SliceStable(ruleFiles, func(i, j int) bool {
+		return strings.Count(ruleFiles[i].name, "/") < strings.Count(ruleFiles[j].name, "/")
+	})
+
+	patterns := []gitignore.Pattern{}
+	rules := &ignoreRules{}
+	for _, ruleFile := range ruleFiles {
+		file, err := tree.TreeEntryFile(&ruleFile.entry)
+		if err != nil {
+			return nil, fmt.Errorf("unable to load %s: %v", ruleFile.name, err)
+		}
+		content, err := file.Contents()
+		if err != nil {
+			return nil, fmt.Errorf("unable to read %s: %v", ruleFile.name, err)
+		}
+		var domain []string
+		if dir := path.Dir(ruleFile.name); dir != "." {
+			domain = strings.Split(dir, "/")
+		}
+
+		for _, line := range strings.Split(content, "\n") {
+			line = strings.TrimRight(line, "\r")
+			if strings.TrimSpace(line) == "" || strings.HasPrefix(line, "#") {
+				continue
+			}
+			if ruleFile.entry.Name == GitStoreIgnoreFile {
+				patterns = append(patterns, gitignore.ParsePattern(line, domain))
+				continue
+			}
+			if rule, ok := parseAttributeRule(line, domain); ok {
+				rules.attributes = append(rules.attributes, rule)
+			}
+		}
+	}
+	rules.ignore = gitignore.NewMatcher(patterns)
+	return rules, nil
+}
+
+// parseAttributeRule parses a .gitattributes line, returning false if it
+// does not set or unset export-ignore
+func parseAttributeRule(line string, domain []string) (attributeRule, bool) {
+	fields := strings.Fields(line)
+	// Negative patterns are not allowed in .gitattributes
+	if len(fields) < 2 || strings.HasPrefix(fields[0], "!") {
+		return attributeRule{}, false
+	}
+
+	found := false
+	rule := attributeRule{pattern: gitignore.ParsePattern(fields[0], domain)}
+	for _, attribute := range fields[1:] {
+		switch attribute {
+		case exportIgnoreAttribute:
+			rule.exportIgnore = true
+			found = true
+		case "-" + exportIgnoreAttribute, "!" + exportIgnoreAttribute:
+			rule.exportIgnore = false
+			found = true
+		}
+	}
+	return rule, found
+}
+
+// excludes checks whether the file at the path, or any directory containing
+// it, is ignored or marked export-ignore
+func (i *ignoreRules) excludes(filePath string) bool {
+	parts := strings.Split(filePath, "/")
+	for depth := 1; depth <= len(parts); depth++ {
+		isDir := depth < len(parts)
+		if i.ignore.Match(parts[:depth], isDir) || i.exportIgnored(parts[:depth], isDir) {
+			return true
+		}
+	}
+	return false
+}
+
+// exportIgnored returns the export-ignore attribute of the path, as set by
+// the last matching rule
+func (i *ignoreRules) exportIgnored(parts []string, isDir bool) bool {
+	for j := len(i.attributes) - 1; j >= 0; j-- {
+		if i.attributes[j].pattern.Match(parts, isDir) == gitignore.Exclude {
+			return i.attributes[j].exportIgnore
+		}
+	}
+	return false
+}
@@ -0,0 +1,135 @@
+/*
+Copyright 2018 Pusher Ltd.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package gitstore
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("GitStore", func() {
+
+	Context("When listing files with ignore files", func() {
+		var repositoryDir string
+		var repoRef *RepoRef
+
+		writeFile := func(name, content string) {
+			path := filepath.Join(repositoryDir, name)
+			Expect(os.MkdirAll(filepath.Dir(path), 0755)).To(Succeed())
+			Expect(ioutil.WriteFile(path, []byte(content), 0644)).To(Succeed())
+		}
+
+		BeforeEach(func() {
+			repositoryDir = setupRepository()
+			writeFile("docs/guide.md", "Guide\n")
+			writeFile("docs/keep.yaml", "kind: ConfigMap\n")
+			writeFile("README.md", "Readme\n")
+			writeFile("json/notes.md", "Notes\n")
+			writeFile("json/important.md", "Important\n")
+			writeFile("json/tests/fixture.json", "{}\n")
+			writeFile("vendor/keep/lib.go", "package keep\n")
+			writeFile(GitStoreIgnoreFile, "# Documentation\ndocs/\n*.md\n")
+			writeFile(filepath.Join("json", GitStoreIgnoreFile), "!important.md\ntests\n")
+			writeFile(".gitattributes", "*.jpg binary\n*.go export-ignore\n/go/*.go -export-ignore\n")
+			runGit(repositoryDir, "add", "-A")
+			runGit(repositoryDir, "commit", "-m", "Add ignore files")
+
+			repoRef = &RepoRef{
+				URL:         fmt.Sprintf("file://%s", repositoryDir),
+				IgnoreFiles: true,
+			}
+		})
+
+		AfterEach(func() {
+			teardownRepository(repositoryDir)
+		})
+
+		It("Should exclude files matched by .gitstoreignore files", func() {
+			repo, err := NewRepoStore("").Get(repoRef)
+			Expect(err).ToNot(HaveOccurred())
+
+			files, err := repo.GetAllFiles("", true)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(files).ToNot(HaveKey("README.md"))
+			Expect(files).ToNot(HaveKey("docs/guide.md"))
+			Expect(files).ToNot(HaveKey("docs/keep.yaml"))
+			Expect(files).ToNot(HaveKey("json/notes.md"))
+			Expect(files).ToNot(HaveKey("json/tests/fixture.json"))
+			Expect(files).To(HaveKey("json/important.md"))
+			Expect(files).To(HaveKey("json/short.json"))
+			Expect(files).To(HaveKey("LICENSE"))
+		})
+
+		It("Should exclude files marked export-ignore", func() {
+			repo, err := NewRepoStore("").Get(repoRef)
+			Expect(err).ToNot(HaveOccurred())
+
+			files, err := repo.GetAllFiles("", true)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(files).ToNot(HaveKey("vendor/foo.go"))
+			Expect(files).ToNot(HaveKey("vendor/keep/lib.go"))
+			Expect(files).To(HaveKey("go/example.go"))
+			Expect(files).To(HaveKey("binary.jpg"))
+		})
+
+		It("Should apply ignore files to globbed subpaths", func() {
+			repo, err := NewRepoStore("").Get(repoRef)
+			Expect(err).ToNot(HaveOccurred())
+
+			files, err := repo.GetAllFiles("json/**", true)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(files).To(HaveLen(4))
+			Expect(files).To(HaveKey("json/important.md"))
+			Expect(files).To(HaveKey("json/" + GitStoreIgnoreFile))
+		})
+
+		It("Should reload the rules when HEAD moves", func() {
+			repo, err := NewRepoStore("").Get(repoRef)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(repo.Checkout("master")).To(Succeed())
+
+			_, err = repo.GetAllFiles("", true)
+			Expect(err).ToNot(HaveOccurred())
+			rules := repo.ignoreRules
+			_, err = repo.GetAllFiles("", true)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(repo.ignoreRules).To(BeIdenticalTo(rules))
+
+			writeFile(GitStoreIgnoreFile, "docs/\n")
+			runGit(repositoryDir, "commit", "-am", "Stop ignoring markdown")
+			Expect(repo.Checkout("master")).To(Succeed())
+			files, err := repo.GetAllFiles("", true)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(files).To(HaveKey("README.md"))
+			Expect(repo.ignoreRules).ToNot(BeIdenticalTo(rules))
+		})
+
+		It("Should not exclude files unless enabled", func() {
+			repoRef.IgnoreFiles = false
+			repo, err := NewRepoStore("").Get(repoRef)
+			Expect(err).ToNot(HaveOccurred())
+
+			files, err := repo.GetAllFiles("", true)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(files).To(HaveKey("README.md"))
+			Expect(files).To(HaveKey("docs/guide.md"))
+			Expect(files).To(HaveKey("vendor/foo.go"))
+		})
+	})
+})
@@ -0,0 +1,46 @@
+package kube
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/pusher/git-store/test"
+)
+
+var fixturesRepoPath, _ = filepath.Abs("../fixtures/repo.tgz")
+
+func TestKube(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecsWithDefaultAndCustomReporters(t, "Kube Suite", test.Reporters())
+}
+
+func setupRepository() string {
+	dir, err := ioutil.TempDir("", "git-store")
+	Expect(err).ToNot(HaveOccurred())
+
+	cmd := exec.Command("tar", "-zxf", fixturesRepoPath, "-C", dir, "--strip-components", "1")
+	err = cmd.Run()
+	Expect(err).ToNot(HaveOccurred())
+
+	return dir
+}
+
+func teardownRepository(dir string) {
+	os.RemoveAll(dir)
+}
+
+// runGit runs a git command against the repository in dir, using a fixed
+// identity so that tests can create commits in fixture copies.
+func runGit(dir string, args ...string) string {
+	args = append([]string{"-C", dir, "-c", "user.name=Git Store", "-c", "user.email=git-store@example.com"}, args...)
+	cmd := exec.Command("git", args...)
+	out, err := cmd.CombinedOutput()
+	Expect(err).ToNot(HaveOccurred(), string(out))
+	return strings.TrimSpace(string(out))
+}
@@ -0,0 +1,116 @@
+/*
+Copyright 2018 Pusher Ltd.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package kube
+
+import (
+	"bytes"
+	"fmt"
+
+	gitstore "github.com/pusher/git-store"
+	corev1 "k8s.io/api/core/v1"
+)
+
+// Secret keys understood by RepoRefFromSecret.
+// Where Flux and Argo CD use different keys for the same value, either may be used.
+const (
+	UsernameKey      = "username"      // UsernameKey holds the username for HTTP basic auth.
+	PasswordKey      = "password"      // PasswordKey holds the password for HTTP basic auth, or the passphrase of the SSH key.
+	TokenKey         = "token"         // TokenKey holds an access token used in place of a password for HTTP auth.
+	IdentityKey      = "identity"      // IdentityKey holds the SSH private key, as used by Flux.
+	SSHPrivateKeyKey = "sshPrivateKey" // SSHPrivateKeyKey holds the SSH private key, as used by Argo CD.
+	KnownHostsKey    = "known_hosts"   // KnownHostsKey holds a known_hosts file used to verify the SSH host key.
+	CAKey            = "ca.crt"        // CAKey holds PEM encoded certificate authorities trusted for HTTPS.
+	CAFileKey        = "caFile"        // CAFileKey holds PEM encoded certificate authorities trusted for HTTPS, as used by Flux.
+)
+
+// tokenUser is the username sent with token auth when none is given;
+// Git hosts ignore the username when authenticating with a token
+const tokenUser = "git"
+
+// RepoRefFromSecret constructs a validated RepoRef for the repository URL using the credentials in the Secret.
+// A nil Secret yields a RepoRef without credentials.
+//
+// Keys which may hold the same value under different conventions must agree if both are set,
+// and a token may not be combined with a password.
+func RepoRefFromSecret(url string, secret *corev1.Secret) (*gitstore.RepoRef, error) {
+	ref := &gitstore.RepoRef{URL: url}
+	if secret != nil {
+		err := setCredentials(ref, secret.Data)
+		if err != nil {
+			return nil, fmt.Errorf("invalid secret %s/%s: %v", secret.Namespace, secret.Name, err)
+		}
+	}
+
+	err := ref.Validate()
+	if err != nil {
+		if secret != nil {
+			return nil, fmt.Errorf("invalid repository reference from secret %s/%s: %v", secret.Namespace, secret.Name, err)
+		}
+		return nil, fmt.Errorf("invalid repository reference: %v", err)
+	}
+	return ref, nil
+}
+
+// setCredentials copies credentials from the secret data into the RepoRef
+func setCredentials(ref *gitstore.RepoRef, data map[string][]byte) error {
+	privateKey, err := oneOf(data, IdentityKey, SSHPrivateKeyKey)
+	if err != nil {
+		return err
+	}
+	ca, err := oneOf(data, CAKey, CAFileKey)
+	if err != nil {
+		return err
+	}
+
+	ref.User = string(data[UsernameKey])
+	ref.Pass = string(data[PasswordKey])
+	ref.PrivateKey = privateKey
+	ref.KnownHosts = data[KnownHostsKey]
+	ref.CABundle = ca
+
+	if token, ok := data[TokenKey]; ok {
+		if ref.Pass != "" {
+			return fmt.Errorf("keys %q and %q are mutually exclusive", TokenKey, PasswordKey)
+		}
+		if len(token) == 0 {
+			return fmt.Errorf("key %q is empty", TokenKey)
+		}
+		ref.Pass = string(token)
+		if ref.User == "" {
+			ref.User = tokenUser
+		}
+	}
+	return nil
+}
+
+// oneOf returns the value of whichever of the keys is set, returning an error
+// if they are set to conflicting values
+func oneOf(data map[string][]byte, keys ...string) ([]byte, error) {
+	var value []byte
+	var valueKey string
+	for _, key := range keys {
+		v, ok := data[key]
+		if !ok {
+			continue
+		}
+		if len(v) == 0 {
+			return nil, fmt.Errorf("key %q is empty", key)
+		}
+		if value != nil && !bytes.Equal(value, v) {
+			return nil, fmt.Errorf("keys %q and %q have conflicting values", valueKey, key)
+		}
+		value, valueKey = v, key
+	}
+	return value, nil
+}
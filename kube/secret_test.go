@@ -0,0 +1,116 @@
+/*
+Copyright 2018 Pusher Ltd.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package kube
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+var _ = Describe("RepoRefFromSecret", func() {
+	newSecret := func(data map[string]string) *corev1.Secret {
+		secret := &corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "credentials"},
+			Data:       make(map[string][]byte),
+		}
+		for key, value := range data {
+			secret.Data[key] = []byte(value)
+		}
+		return secret
+	}
+
+	It("Should allow a nil secret", func() {
+		ref, err := RepoRefFromSecret("https://example.com/org/repo", nil)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(ref.URL).To(Equal("https://example.com/org/repo"))
+	})
+
+	It("Should set the username and password", func() {
+		ref, err := RepoRefFromSecret("https://example.com/org/repo", newSecret(map[string]string{
+			"username": "user",
+			"password": "pass",
+		}))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(ref.User).To(Equal("user"))
+		Expect(ref.Pass).To(Equal("pass"))
+	})
+
+	It("Should use a token as the password", func() {
+		ref, err := RepoRefFromSecret("https://example.com/org/repo", newSecret(map[string]string{
+			"token": "abc123",
+		}))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(ref.User).To(Equal("git"))
+		Expect(ref.Pass).To(Equal("abc123"))
+	})
+
+	It("Should reject a token and password together", func() {
+		_, err := RepoRefFromSecret("https://example.com/org/repo", newSecret(map[string]string{
+			"username": "user",
+			"password": "pass",
+			"token":    "abc123",
+		}))
+		Expect(err).To(MatchError(ContainSubstring("mutually exclusive")))
+	})
+
+	It("Should reject a username without a password", func() {
+		_, err := RepoRefFromSecret("https://example.com/org/repo", newSecret(map[string]string{
+			"username": "user",
+		}))
+		Expect(err).To(MatchError(ContainSubstring("default/credentials")))
+	})
+
+	for _, key := range []string{"identity", "sshPrivateKey"} {
+		key := key
+		It("Should read the private key from "+key, func() {
+			ref, err := RepoRefFromSecret("git@example.com:org/repo.git", newSecret(map[string]string{
+				key:           "private key",
+				"known_hosts": "example.com ssh-rsa AAAA",
+			}))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(string(ref.PrivateKey)).To(Equal("private key"))
+			Expect(string(ref.KnownHosts)).To(Equal("example.com ssh-rsa AAAA"))
+		})
+	}
+
+	It("Should reject conflicting private keys", func() {
+		_, err := RepoRefFromSecret("git@example.com:org/repo.git", newSecret(map[string]string{
+			"identity":      "first key",
+			"sshPrivateKey": "second key",
+		}))
+		Expect(err).To(MatchError(ContainSubstring("conflicting values")))
+	})
+
+	It("Should require a private key for ssh URLs", func() {
+		_, err := RepoRefFromSecret("git@example.com:org/repo.git", newSecret(map[string]string{}))
+		Expect(err).To(MatchError(ContainSubstring("PrivateKey is required")))
+	})
+
+	It("Should read the CA bundle", func() {
+		ref, err := RepoRefFromSecret("https://example.com/org/repo", newSecret(map[string]string{
+			"ca.crt": "bundle",
+		}))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(string(ref.CABundle)).To(Equal("bundle"))
+	})
+
+	It("Should reject an empty key", func() {
+		_, err := RepoRefFromSecret("https://example.com/org/repo", newSecret(map[string]string{
+			"caFile": "",
+		}))
+		Expect(err).To(MatchError(ContainSubstring("is empty")))
+	})
+})
@@ -0,0 +1,156 @@
+/*
+Copyright 2018 Pusher Ltd.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package kube provides helpers for using GitStore within Kubernetes controllers.
+package kube
+
+import (
+	"fmt"
+	"sync"
+
+	gitstore "github.com/pusher/git-store"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/util/workqueue"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+	"sigs.k8s.io/controller-runtime/pkg/source"
+)
+
+// Source is a controller-runtime source.Source that emits events for objects which registered interest
+// in a repository reference whenever that reference moves.
+//
+// Events are GenericEvents carrying only the name and namespace of the registered object in Meta; Object is nil.
+// The Watcher the Source is constructed with must be running for events to be produced.
+type Source struct {
+	watcher       *gitstore.Watcher
+	registrations map[types.NamespacedName]*registration
+	started       chan struct{}
+	handler       handler.EventHandler
+	queue         workqueue.RateLimitingInterface
+	predicates    []predicate.Predicate
+	mutex         sync.Mutex
+}
+
+// registration holds the subscriptions made on behalf of a single object
+type registration struct {
+	subscriptions []*gitstore.Subscription
+	stop          chan struct{}
+}
+
+var _ source.Source = &Source{}
+
+// NewSource constructs a Source that subscribes to repository changes through the Watcher.
+func NewSource(watcher *gitstore.Watcher) *Source {
+	return &Source{
+		watcher:       watcher,
+		registrations: make(map[types.NamespacedName]*registration),
+		started:       make(chan struct{}),
+		mutex:         sync.Mutex{},
+	}
+}
+
+// Register records that the named object should be reconciled when gitRef in the repository moves.
+// If pathGlob is set, only changes to files matching the glob are considered.
+// An object may register interest in several references.
+func (s *Source) Register(name types.NamespacedName, ref *gitstore.RepoRef, gitRef, pathGlob string) error {
+	sub, err := s.watcher.Watch(ref, gitRef, pathGlob)
+	if err != nil {
+		return fmt.Errorf("unable to watch repository: %v", err)
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	reg, ok := s.registrations[name]
+	if !ok {
+		reg = &registration{stop: make(chan struct{})}
+		s.registrations[name] = reg
+	}
+	reg.subscriptions = append(reg.subscriptions, sub)
+	go s.forward(name, sub, reg.stop)
+	return nil
+}
+
+// Unregister removes every registration for the named object.
+func (s *Source) Unregister(name types.NamespacedName) {
+	s.mutex.Lock()
+	reg, ok := s.registrations[name]
+	delete(s.registrations, name)
+	s.mutex.Unlock()
+	if !ok {
+		return
+	}
+
+	close(reg.stop)
+	for _, sub := range reg.subscriptions {
+		sub.Close()
+	}
+}
+
+// Start implements source.Source, delivering events to the handler.
+// Events received before Start is called are held until it is.
+func (s *Source) Start(h handler.EventHandler, q workqueue.RateLimitingInterface, prct ...predicate.Predicate) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	select {
+	case <-s.started:
+		return fmt.Errorf("source has already been started")
+	default:
+	}
+
+	s.handler = h
+	s.queue = q
+	s.predicates = prct
+	close(s.started)
+	return nil
+}
+
+// forward converts events from the subscription into events for the named
+// object until the registration is stopped or the subscription is closed
+func (s *Source) forward(name types.NamespacedName, sub *gitstore.Subscription, stop <-chan struct{}) {
+	for {
+		select {
+		case <-stop:
+			return
+		case _, ok := <-sub.Events():
+			if !ok {
+				return
+			}
+		}
+
+		select {
+		case <-stop:
+			return
+		case <-s.started:
+		}
+		s.emit(name)
+	}
+}
+
+// emit sends a GenericEvent for the named object to the handler if it
+// passes the predicates
+func (s *Source) emit(name types.NamespacedName) {
+	evt := event.GenericEvent{
+		Meta: &metav1.ObjectMeta{
+			Name:      name.Name,
+			Namespace: name.Namespace,
+		},
+	}
+	for _, p := range s.predicates {
+		if !p.Generic(evt) {
+			return
+		}
+	}
+	s.handler.Generic(evt, s.queue)
+}
@@ -0,0 +1,116 @@
+/*
+Copyright 2018 Pusher Ltd.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package kube
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	gitstore "github.com/pusher/git-store"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/util/workqueue"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+)
+
+var _ = Describe("Source", func() {
+	var repositoryDir string
+	var repoRef *gitstore.RepoRef
+	var src *Source
+	var queue workqueue.RateLimitingInterface
+	var cancel context.CancelFunc
+	name := types.NamespacedName{Namespace: "default", Name: "example"}
+
+	commitFile := func(path, content string) {
+		err := ioutil.WriteFile(filepath.Join(repositoryDir, path), []byte(content), 0644)
+		Expect(err).ToNot(HaveOccurred())
+		runGit(repositoryDir, "add", path)
+		runGit(repositoryDir, "commit", "-m", fmt.Sprintf("Update %s", path))
+	}
+
+	BeforeEach(func() {
+		repositoryDir = setupRepository()
+		repoRef = &gitstore.RepoRef{
+			URL: fmt.Sprintf("file://%s", repositoryDir),
+		}
+		watcher := gitstore.NewRepoStore("").NewWatcher(50*time.Millisecond, 10*time.Millisecond)
+		src = NewSource(watcher)
+		queue = workqueue.NewRateLimitingQueue(workqueue.DefaultControllerRateLimiter())
+
+		var ctx context.Context
+		ctx, cancel = context.WithCancel(context.Background())
+		go watcher.Run(ctx)
+	})
+
+	AfterEach(func() {
+		cancel()
+		queue.ShutDown()
+		teardownRepository(repositoryDir)
+	})
+
+	It("Should enqueue a request for the registered object when the reference moves", func() {
+		Expect(src.Start(&handler.EnqueueRequestForObject{}, queue)).To(Succeed())
+		Expect(src.Register(name, repoRef, "master", "")).To(Succeed())
+		defer src.Unregister(name)
+
+		commitFile("CHANGELOG", "Updated changelog\n")
+		Eventually(queue.Len, 5*time.Second).Should(Equal(1))
+		item, _ := queue.Get()
+		Expect(item).To(Equal(reconcile.Request{NamespacedName: name}))
+	})
+
+	It("Should hold events received before being started", func() {
+		Expect(src.Register(name, repoRef, "master", "")).To(Succeed())
+		defer src.Unregister(name)
+
+		commitFile("CHANGELOG", "Updated changelog\n")
+		Consistently(queue.Len, 500*time.Millisecond).Should(Equal(0))
+
+		Expect(src.Start(&handler.EnqueueRequestForObject{}, queue)).To(Succeed())
+		Eventually(queue.Len, 5*time.Second).Should(Equal(1))
+	})
+
+	It("Should not enqueue requests once unregistered", func() {
+		Expect(src.Start(&handler.EnqueueRequestForObject{}, queue)).To(Succeed())
+		Expect(src.Register(name, repoRef, "master", "")).To(Succeed())
+		src.Unregister(name)
+
+		commitFile("CHANGELOG", "Updated changelog\n")
+		Consistently(queue.Len, 500*time.Millisecond).Should(Equal(0))
+	})
+
+	It("Should apply predicates to events", func() {
+		reject := predicate.Funcs{
+			GenericFunc: func(event.GenericEvent) bool { return false },
+		}
+		Expect(src.Start(&handler.EnqueueRequestForObject{}, queue, reject)).To(Succeed())
+		Expect(src.Register(name, repoRef, "master", "")).To(Succeed())
+		defer src.Unregister(name)
+
+		commitFile("CHANGELOG", "Updated changelog\n")
+		Consistently(queue.Len, 500*time.Millisecond).Should(Equal(0))
+	})
+
+	It("Should refuse to be started twice", func() {
+		Expect(src.Start(&handler.EnqueueRequestForObject{}, queue)).To(Succeed())
+		Expect(src.Start(&handler.EnqueueRequestForObject{}, queue)).ToNot(Succeed())
+	})
+})
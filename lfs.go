@@ -0,0 +1,369 @@
+/*
+Copyright 2018 Pusher Ltd.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package gitstore
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	"gopkg.in/src-d/go-git.v4/plumbing/transport"
+	transportHTTP "gopkg.in/src-d/go-git.v4/plumbing/transport/http"
+)
+
+const (
+	lfsMediaType = "application/vnd.git-lfs+json"
+	// maxLFSPointerSize is the largest file git-lfs considers to be a pointer
+	maxLFSPointerSize = 1024
+	// lfsFetchTimeout bounds downloads made when reading a file's contents,
+	// which do not take a context
+	lfsFetchTimeout = 5 * time.Minute
+)
+
+// lfsPointerRegex matches the contents of a Git LFS pointer file
+var lfsPointerRegex = regexp.MustCompile(`^version https://git-lfs\.github\.com/spec/v1\n(?:[a-z0-9.-]+ .*\n)*?oid sha256:([0-9a-f]{64})\n(?:[a-z0-9.-]+ .*\n)*?size ([0-9]+)\n`)
+
+// LFSPointer identifies an object stored in Git LFS.
+type LFSPointer struct {
+	OID  string // OID is the SHA256 hash of the object.
+	Size int64  // Size is the size of the object in bytes.
+}
+
+// lfsClient downloads objects from a Git LFS server and caches them
+type lfsClient struct {
+	endpoint string            // endpoint is the URL of the LFS server, eg. https://github.com/org/repo.git/info/lfs.
+	cacheDir string            // cacheDir is the directory objects are cached in, empty to cache in memory.
+	cache    map[string][]byte // cache contains the objects cached in memory, keyed by OID.
+	client   *http.Client
+	mutex    sync.Mutex
+}
+
+// lfsBatchRequest is the body of a request to the LFS batch API
+type lfsBatchRequest struct {
+	Operation string           `json:"operation"`
+	Transfers []string         `json:"transfers"`
+	Objects   []lfsBatchObject `json:"objects"`
+}
+
+// lfsBatchResponse is the body of a response from the LFS batch API
+type lfsBatchResponse struct {
+	Objects []lfsBatchObject `json:"objects"`
+}
+
+// lfsBatchObject describes a single object in LFS batch requests and responses
+type lfsBatchObject struct {
+	OID     string `json:"oid"`
+	Size    int64  `json:"size"`
+	Actions *struct {
+		Download *struct {
+			Href   string            `json:"href"`
+			Header map[string]string `json:"header"`
+		} `json:"download"`
+	} `json:"actions,omitempty"`
+	Error *struct {
+		Code    int    `json:"code"`
+		Message string `json:"message"`
+	} `json:"error,omitempty"`
+}
+
+// LFSPointer returns the Git LFS pointer stored in the file, if it is one.
+func (f *File) LFSPointer() (*LFSPointer, bool) {
+	if f.file == nil || f.file.Size > maxLFSPointerSize {
+		return nil, false
+	}
+	content, err := f.file.Contents()
+	if err != nil {
+		return nil, false
+	}
+	return parseLFSPointer(content)
+}
+
+// LFSContents returns the content of the Git LFS object the file points to.
+// Objects are cached, so are only downloaded once.
+//
+// Note: The RepoRef must have LFS enabled.
+func (f *File) LFSContents(ctx context.Context) ([]byte, error) {
+	pointer, ok := f.LFSPointer()
+	if !ok {
+		return nil, fmt.Errorf("%s is not a Git LFS pointer", f.file.Name)
+	}
+	if f.repo == nil || f.repo.options.lfs == nil {
+		return nil, fmt.Errorf("Git LFS is not enabled for the repository")
+	}
+
+	f.repo.mutex.RLock()
+	auth := f.repo.auth
+	f.repo.mutex.RUnlock()
+	return f.repo.options.lfs.fetch(ctx, auth, pointer)
+}
+
+// parseLFSPointer parses the contents of a Git LFS pointer file
+func parseLFSPointer(content string) (*LFSPointer, bool) {
+	matches := lfsPointerRegex.FindStringSubmatch(content)
+	if matches == nil {
+		return nil, false
+	}
+	size, err := strconv.ParseInt(matches[2], 10, 64)
+	if err != nil {
+		return nil, false
+	}
+	return &LFSPointer{OID: matches[1], Size: size}, true
+}
+
+// resolveLFS replaces the content of Git LFS pointers with the objects they
+// point to if LFS is enabled for the repository.
+// If the object cannot be fetched the pointer is returned unchanged, so that
+// a failed download is never mistaken for an empty file
+func (f *File) resolveLFS(content string) string {
+	if f.repo == nil || f.repo.options.lfs == nil || len(content) > maxLFSPointerSize {
+		return content
+	}
+	if _, ok := parseLFSPointer(content); !ok {
+		return content
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), lfsFetchTimeout)
+	defer cancel()
+	object, err := f.LFSContents(ctx)
+	if err != nil {
+		glog.Errorf("Unable to fetch Git LFS object for %s: %v", f.file.Name, err)
+		return content
+	}
+	return string(object)
+}
+
+// newLFSClient constructs an lfsClient for the repository, caching objects
+// alongside repoDir if set
+func newLFSClient(ref *RepoRef, repoDir string) (*lfsClient, error) {
+	endpoint := ref.LFSURL
+	if endpoint == "" {
+		var err error
+		endpoint, err = lfsEndpoint(ref.URL)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var cacheDir string
+	if repoDir != "" {
+		cacheDir = fmt.Sprintf("%s.lfs", repoDir)
+	}
+	return &lfsClient{
+		endpoint: strings.TrimSuffix(endpoint, "/"),
+		cacheDir: cacheDir,
+		cache:    make(map[string][]byte),
+		client:   &http.Client{Transport: httpsTransport},
+	}, nil
+}
+
+// lfsEndpoint derives the default Git LFS server URL from the repository URL
+func lfsEndpoint(repoURL string) (string, error) {
+	var host, path string
+	u, err := url.Parse(repoURL)
+	switch {
+	case err == nil && (u.Scheme == "http" || u.Scheme == "https"):
+		u.User = nil
+		u.Path = strings.TrimSuffix(u.Path, "/")
+		if !strings.HasSuffix(u.Path, ".git") {
+			u.Path = fmt.Sprintf("%s.git", u.Path)
+		}
+		return fmt.Sprintf("%s/info/lfs", u.String()), nil
+	case err == nil && u.Scheme == "ssh":
+		host, path = u.Hostname(), u.Path
+	case err == nil && (u.Host != "" || u.Scheme == "file"):
+		return "", fmt.Errorf("unable to determine Git LFS endpoint for %s URLs", u.Scheme)
+	case scpLikeURLRegex.MatchString(repoURL):
+		matches := scpLikeURLRegex.FindStringSubmatch(repoURL)
+		host, path = matches[1], matches[2]
+	default:
+		return "", fmt.Errorf("unable to determine Git LFS endpoint for %s", repoURL)
+	}
+
+	// SSH servers are assumed to serve LFS over HTTPS
+	path = strings.TrimSuffix(strings.Trim(path, "/"), ".git")
+	return fmt.Sprintf("https://%s/%s.git/info/lfs", host, path), nil
+}
+
+// fetch returns the object from the cache, downloading it if it is not cached
+func (c *lfsClient) fetch(ctx context.Context, auth transport.AuthMethod, pointer *LFSPointer) ([]byte, error) {
+	if object, ok := c.cached(pointer); ok {
+		return object, nil
+	}
+
+	object, err := c.download(ctx, auth, pointer)
+	if err != nil {
+		return nil, err
+	}
+
+	err = c.store(pointer, object)
+	if err != nil {
+		return nil, fmt.Errorf("unable to cache object: %v", err)
+	}
+	return object, nil
+}
+
+// cached returns the object if it has already been downloaded
+func (c *lfsClient) cached(pointer *LFSPointer) ([]byte, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.cacheDir == "" {
+		object, ok := c.cache[pointer.OID]
+		return object, ok
+	}
+
+	object, err := ioutil.ReadFile(c.cachePath(pointer))
+	if err != nil {
+		return nil, false
+	}
+	return object, true
+}
+
+// store adds the object to the cache
+func (c *lfsClient) store(pointer *LFSPointer, object []byte) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.cacheDir == "" {
+		c.cache[pointer.OID] = object
+		return nil
+	}
+
+	path := c.cachePath(pointer)
+	err := os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		return err
+	}
+	// Write to a temporary file first so a partial object is never cached
+	tmp := fmt.Sprintf("%s.tmp", path)
+	err = ioutil.WriteFile(tmp, object, 0644)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// cachePath returns the path of the object within the cache directory, using
+// the same layout as git-lfs
+func (c *lfsClient) cachePath(pointer *LFSPointer) string {
+	return filepath.Join(c.cacheDir, pointer.OID[0:2], pointer.OID[2:4], pointer.OID)
+}
+
+// download requests the object from the LFS batch API and downloads it,
+// verifying its size and hash
+func (c *lfsClient) download(ctx context.Context, auth transport.AuthMethod, pointer *LFSPointer) ([]byte, error) {
+	object, err := c.batch(ctx, auth, pointer)
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequest(http.MethodGet, object.Actions.Download.Href, nil)
+	if err != nil {
+		return nil, fmt.Errorf("unable to construct download request: %v", err)
+	}
+	for key, value := range object.Actions.Download.Header {
+		req.Header.Set(key, value)
+	}
+	resp, err := c.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, fmt.Errorf("unable to download object: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unable to download object: unexpected status %s", resp.Status)
+	}
+
+	content, err := ioutil.ReadAll(io.LimitReader(resp.Body, pointer.Size+1))
+	if err != nil {
+		return nil, fmt.Errorf("unable to read object: %v", err)
+	}
+	if int64(len(content)) != pointer.Size {
+		return nil, fmt.Errorf("object %s has size %d, expected %d", pointer.OID, len(content), pointer.Size)
+	}
+	hash := sha256.Sum256(content)
+	if hex.EncodeToString(hash[:]) != pointer.OID {
+		return nil, fmt.Errorf("object %s failed hash verification", pointer.OID)
+	}
+	return content, nil
+}
+
+// batch requests the download action for the object from the LFS batch API.
+// Only basic auth credentials are sent to the server, as SSH authentication
+// would require the git-lfs-authenticate exchange over SSH
+func (c *lfsClient) batch(ctx context.Context, auth transport.AuthMethod, pointer *LFSPointer) (*lfsBatchObject, error) {
+	body, err := json.Marshal(lfsBatchRequest{
+		Operation: "download",
+		Transfers: []string{"basic"},
+		Objects:   []lfsBatchObject{{OID: pointer.OID, Size: pointer.Size}},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("unable to encode batch request: %v", err)
+	}
+
+	req, err := http.NewRequest(http.MethodPost, fmt.Sprintf("%s/objects/batch", c.endpoint), bytes.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("unable to construct batch request: %v", err)
+	}
+	req.Header.Set("Accept", lfsMediaType)
+	req.Header.Set("Content-Type", lfsMediaType)
+	if basicAuth, ok := auth.(*transportHTTP.BasicAuth); ok && basicAuth.Username != "" {
+		req.SetBasicAuth(basicAuth.Username, basicAuth.Password)
+	}
+
+	resp, err := c.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, fmt.Errorf("unable to perform batch request: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden {
+		if _, ok := auth.(*transportHTTP.BasicAuth); auth != nil && !ok {
+			return nil, fmt.Errorf("unable to perform batch request: Git LFS over SSH authentication is unsupported, server returned %s", resp.Status)
+		}
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unable to perform batch request: unexpected status %s", resp.Status)
+	}
+
+	var batch lfsBatchResponse
+	err = json.NewDecoder(resp.Body).Decode(&batch)
+	if err != nil {
+		return nil, fmt.Errorf("unable to decode batch response: %v", err)
+	}
+	for _, object := range batch.Objects {
+		if object.OID != pointer.OID {
+			continue
+		}
+		if object.Error != nil {
+			return nil, fmt.Errorf("unable to fetch object %s: %s (%d)", pointer.OID, object.Error.Message, object.Error.Code)
+		}
+		if object.Actions == nil || object.Actions.Download == nil {
+			return nil, fmt.Errorf("no download action for object %s", pointer.OID)
+		}
+		return &object, nil
+	}
+	return nil, fmt.Errorf("object %s missing from batch response", pointer.OID)
+}
@@ -0,0 +1,153 @@
+/*
+Copyright 2018 Pusher Ltd.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package gitstore
+
+import (
+	"fmt"
+	"regexp"
+	"time"
+
+	"github.com/gobwas/glob"
+	git "gopkg.in/src-d/go-git.v4"
+	"gopkg.in/src-d/go-git.v4/plumbing/object"
+	"gopkg.in/src-d/go-git.v4/plumbing/storer"
+)
+
+// LogOptions configures which commits are returned by Repo.Log.
+type LogOptions struct {
+	Ref      string    // Ref is the reference to start listing commits from. Defaults to the checked out HEAD.
+	PathGlob string    // PathGlob limits the log to commits that changed a file matching the glob.
+	Author   string    // Author is a regular expression matched against the commit author's "Name <email>".
+	Since    time.Time // Since limits the log to commits committed at or after this time.
+	Until    time.Time // Until limits the log to commits committed at or before this time.
+	MaxCount int       // MaxCount limits the number of commits returned. Zero means no limit.
+}
+
+// Log returns the commit log for a reference, newest commit first, filtered according to the LogOptions provided.
+func (r *Repo) Log(opts LogOptions) ([]GitLog, error) {
+	var g glob.Glob
+	var err error
+	if opts.PathGlob != "" {
+		g, err = glob.Compile(opts.PathGlob)
+		if err != nil {
+			return nil, fmt.Errorf("unable to compile PathGlob matcher: %v", err)
+		}
+	}
+
+	var author *regexp.Regexp
+	if opts.Author != "" {
+		author, err = regexp.Compile(opts.Author)
+		if err != nil {
+			return nil, fmt.Errorf("unable to compile Author matcher: %v", err)
+		}
+	}
+
+	var commit *object.Commit
+	if opts.Ref != "" {
+		commit, err = r.getCommit(opts.Ref)
+	} else {
+		commit, err = r.getHeadCommit()
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to fetch start commit: %v", err)
+	}
+
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	commitIter, err := r.repository.Log(&git.LogOptions{
+		From:  commit.Hash,
+		Order: git.LogOrderCommitterTime,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("unable to load commit log: %v", err)
+	}
+
+	logs := []GitLog{}
+	err = commitIter.ForEach(func(c *object.Commit) error {
+		if opts.MaxCount > 0 && len(logs) >= opts.MaxCount {
+			return storer.ErrStop
+		}
+		// Committer times are not monotonic along the history, eg. after a
+		// merge of commits made with a skewed clock, so the walk continues
+		if !opts.Since.IsZero() && c.Committer.When.Before(opts.Since) {
+			return nil
+		}
+		if !opts.Until.IsZero() && c.Committer.When.After(opts.Until) {
+			return nil
+		}
+		if author != nil && !author.MatchString(fmt.Sprintf("%s <%s>", c.Author.Name, c.Author.Email)) {
+			return nil
+		}
+		if g != nil {
+			touched, err := commitTouchesPath(c, g)
+			if err != nil {
+				return err
+			}
+			if !touched {
+				return nil
+			}
+		}
+
+		logs = append(logs, newGitLog(c))
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("unable to iterate commit log: %v", err)
+	}
+	return logs, nil
+}
+
+// newGitLog constructs a GitLog from a commit
+func newGitLog(c *object.Commit) GitLog {
+	return GitLog{
+		Date:      c.Author.When,
+		Hash:      c.Hash,
+		Author:    c.Author.Email,
+		Text:      c.Message,
+		Committer: c.Committer,
+		Parents:   c.ParentHashes,
+	}
+}
+
+// commitTouchesPath checks whether the commit changed any file matching the
+// glob, compared to its first parent
+func commitTouchesPath(c *object.Commit, g glob.Glob) (bool, error) {
+	tree, err := c.Tree()
+	if err != nil {
+		return false, fmt.Errorf("unable to fetch commit tree: %v", err)
+	}
+
+	var parentTree *object.Tree
+	if c.NumParents() > 0 {
+		parent, err := c.Parent(0)
+		if err != nil {
+			return false, fmt.Errorf("unable to fetch parent commit: %v", err)
+		}
+		parentTree, err = parent.Tree()
+		if err != nil {
+			return false, fmt.Errorf("unable to fetch parent commit tree: %v", err)
+		}
+	}
+
+	changes, err := object.DiffTree(parentTree, tree)
+	if err != nil {
+		return false, fmt.Errorf("unable to diff trees: %v", err)
+	}
+	for _, change := range changes {
+		if g.Match(change.From.Name) || g.Match(change.To.Name) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
@@ -0,0 +1,134 @@
+/*
+Copyright 2018 Pusher Ltd.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package gitstore
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("GitStore", func() {
+
+	Context("When querying the commit log", func() {
+		var repo *Repo
+		utcPlus2 := time.FixedZone("+0200", int(2*time.Hour.Seconds()))
+
+		BeforeEach(func() {
+			rs := NewRepoStore("")
+			var err error
+			repo, err = rs.Get(&RepoRef{
+				URL: repositoryURL,
+			})
+			Expect(err).ToNot(HaveOccurred())
+			err = repo.Checkout("master")
+			Expect(err).ToNot(HaveOccurred())
+		})
+
+		It("Should list all commits reachable from HEAD, newest first", func() {
+			logs, err := repo.Log(LogOptions{})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(logs).To(HaveLen(9))
+			Expect(logs[0].Hash.String()).To(Equal("f835a00b5e29ae3440a08fd51aadf4a07d6abc25"))
+			Expect(logs[8].Hash.String()).To(Equal("b029517f6300c2da0f4b651b8642506cd6aaf45d"))
+		})
+
+		It("Should include committer and parent information", func() {
+			logs, err := repo.Log(LogOptions{Ref: "1669dce138d9b841a518c64b10914d88f5e488ea", MaxCount: 1})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(logs).To(HaveLen(1))
+			Expect(logs[0].Author).To(Equal("mcuadros@gmail.com"))
+			Expect(logs[0].Committer.Name).To(Equal("Máximo Cuadros Ortiz"))
+			Expect(logs[0].Committer.Email).To(Equal("mcuadros@gmail.com"))
+			Expect(logs[0].Text).To(HavePrefix("Merge branch 'master' of github.com:tyba/git-fixture"))
+			Expect(logs[0].Parents).To(HaveLen(2))
+		})
+
+		It("Should limit the number of commits returned", func() {
+			logs, err := repo.Log(LogOptions{MaxCount: 3})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(logs).To(HaveLen(3))
+		})
+
+		It("Should start from the given reference", func() {
+			logs, err := repo.Log(LogOptions{Ref: "b8e471f58bcbca63b07bda20e428190409c2db47"})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(logs).To(HaveLen(2))
+		})
+
+		It("Should filter commits by path glob", func() {
+			logs, err := repo.Log(LogOptions{PathGlob: "json/*"})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(logs).To(HaveLen(1))
+			Expect(logs[0].Hash.String()).To(Equal("af2d6a6954d532f8ffb47615169c8fdf9d383a1a"))
+		})
+
+		It("Should filter commits by author", func() {
+			logs, err := repo.Log(LogOptions{Author: "Daniel"})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(logs).To(HaveLen(1))
+			Expect(logs[0].Hash.String()).To(Equal("b8e471f58bcbca63b07bda20e428190409c2db47"))
+		})
+
+		It("Should filter commits by time", func() {
+			logs, err := repo.Log(LogOptions{Since: time.Date(2015, time.April, 1, 0, 0, 0, 0, utcPlus2)})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(logs).To(HaveLen(2))
+
+			logs, err = repo.Log(LogOptions{Until: time.Date(2015, time.March, 31, 13, 45, 0, 0, utcPlus2)})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(logs).To(HaveLen(2))
+		})
+
+		It("Should include newer commits behind commits with skewed dates", func() {
+			repositoryDir := setupRepository()
+			defer teardownRepository(repositoryDir)
+			// commitAt creates an empty commit with the given committer date
+			commitAt := func(date string) string {
+				cmd := exec.Command("git", "-C", repositoryDir, "-c", "user.name=Git Store", "-c", "user.email=git-store@example.com",
+					"commit", "--allow-empty", "-m", fmt.Sprintf("Committed %s", date))
+				cmd.Env = append(os.Environ(), fmt.Sprintf("GIT_COMMITTER_DATE=%s", date))
+				out, err := cmd.CombinedOutput()
+				Expect(err).ToNot(HaveOccurred(), string(out))
+				return runGit(repositoryDir, "rev-parse", "HEAD")
+			}
+			runGit(repositoryDir, "checkout", "-b", "skewed")
+			newer := commitAt("2020-01-01T00:00:00Z")
+			commitAt("2000-01-01T00:00:00Z")
+			runGit(repositoryDir, "checkout", "master")
+			runGit(repositoryDir, "merge", "--no-ff", "-m", "Merge skewed", "skewed")
+
+			repo, err := NewRepoStore("").Get(&RepoRef{URL: fmt.Sprintf("file://%s", repositoryDir)})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(repo.Checkout("master")).To(Succeed())
+			logs, err := repo.Log(LogOptions{Since: time.Date(2010, time.January, 1, 0, 0, 0, 0, time.UTC)})
+			Expect(err).ToNot(HaveOccurred())
+			hashes := []string{}
+			for _, log := range logs {
+				hashes = append(hashes, log.Hash.String())
+			}
+			Expect(hashes).To(ContainElement(newer))
+			Expect(logs).To(HaveLen(11))
+		})
+
+		It("Should return an error for an invalid author expression", func() {
+			_, err := repo.Log(LogOptions{Author: "("})
+			Expect(err).To(HaveOccurred())
+		})
+	})
+})
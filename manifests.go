@@ -0,0 +1,149 @@
+/*
+Copyright 2018 Pusher Ltd.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package gitstore
+
+import (
+	"bytes"
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/util/yaml"
+)
+
+// Manifest is a Kubernetes object decoded from a YAML or JSON file in the repository.
+type Manifest struct {
+	Object   *unstructured.Unstructured // Object is the decoded object.
+	Path     string                     // Path is the path of the file containing the object.
+	Document int                        // Document is the index of the YAML document within the file, starting at 0.
+	Line     int                        // Line is the line the document starts at within the file, starting at 1.
+}
+
+// manifestDocument is a single document of a manifest file
+type manifestDocument struct {
+	index int
+	line  int
+	data  []byte
+}
+
+// DecodeManifests decodes the YAML and JSON files at HEAD matching pathGlob into Kubernetes objects.
+// Only files with a .yaml, .yml or .json extension are decoded, other files matching pathGlob are skipped.
+// YAML files may contain multiple documents separated by "---", empty documents are skipped.
+// Manifests are sorted by path and document, and errors identify the path, document and line that failed to decode.
+func (r *Repo) DecodeManifests(pathGlob string) ([]Manifest, error) {
+	files, err := r.GetAllFiles(pathGlob, true)
+	if err != nil {
+		return nil, err
+	}
+
+	paths := []string{}
+	for p := range files {
+		switch strings.ToLower(path.Ext(p)) {
+		case ".yaml", ".yml", ".json":
+			paths = append(paths, p)
+		}
+	}
+	sort.Strings(paths)
+
+	manifests := []Manifest{}
+	for _, p := range paths {
+		var documents []manifestDocument
+		content := []byte(files[p].Contents())
+		if strings.EqualFold(path.Ext(p), ".json") {
+			documents = []manifestDocument{{index: 0, line: 1, data: content}}
+		} else {
+			documents = splitYAMLDocuments(content)
+		}
+
+		for _, document := range documents {
+			obj, err := decodeManifest(document.data)
+			if err != nil {
+				return nil, fmt.Errorf("unable to decode %s document %d at line %d: %v", p, document.index, document.line, err)
+			}
+			if obj == nil {
+				continue
+			}
+			manifests = append(manifests, Manifest{
+				Object:   obj,
+				Path:     p,
+				Document: document.index,
+				Line:     document.line,
+			})
+		}
+	}
+	return manifests, nil
+}
+
+// splitYAMLDocuments splits the content at document separators, recording
+// the line each document starts at
+func splitYAMLDocuments(content []byte) []manifestDocument {
+	documents := []manifestDocument{}
+	current := manifestDocument{index: 0, line: 1}
+	lines := bytes.SplitAfter(content, []byte("\n"))
+	for i, line := range lines {
+		if isYAMLSeparator(line) {
+			documents = append(documents, current)
+			current = manifestDocument{index: current.index + 1, line: i + 2}
+			continue
+		}
+		current.data = append(current.data, line...)
+	}
+	return append(documents, current)
+}
+
+// isYAMLSeparator checks whether the line is a document separator
+func isYAMLSeparator(line []byte) bool {
+	trimmed := strings.TrimRight(string(line), " \t\r\n")
+	if !strings.HasPrefix(trimmed, "---") {
+		return false
+	}
+	rest := strings.TrimSpace(strings.TrimPrefix(trimmed, "---"))
+	return rest == "" || strings.HasPrefix(rest, "#")
+}
+
+// decodeManifest decodes a single YAML or JSON document, returning nil if
+// the document is empty
+func decodeManifest(data []byte) (*unstructured.Unstructured, error) {
+	if isEmptyDocument(data) {
+		return nil, nil
+	}
+	jsonData, err := yaml.ToJSON(data)
+	if err != nil {
+		return nil, err
+	}
+	if string(bytes.TrimSpace(jsonData)) == "null" {
+		return nil, nil
+	}
+
+	obj := &unstructured.Unstructured{}
+	err = obj.UnmarshalJSON(jsonData)
+	if err != nil {
+		return nil, err
+	}
+	return obj, nil
+}
+
+// isEmptyDocument checks whether the document only contains whitespace and
+// comments
+func isEmptyDocument(data []byte) bool {
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line != "" && !strings.HasPrefix(line, "#") {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,126 @@
+/*
+Copyright 2018 Pusher Ltd.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package gitstore
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+const multiDocumentManifest = `# Application resources
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: app-config
+data:
+  key: value
+---
+# Intentionally empty
+---
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: app
+spec:
+  replicas: 2
+`
+
+const jsonManifest = `{
+  "apiVersion": "v1",
+  "kind": "Secret",
+  "metadata": {"name": "app-secret"}
+}
+`
+
+var _ = Describe("GitStore", func() {
+
+	Context("When decoding manifests", func() {
+		var repositoryDir string
+		var repo *Repo
+
+		// commitManifest commits a file to the fixture copy and checks it out
+		commitManifest := func(name, content string) {
+			target := filepath.Join(repositoryDir, name)
+			Expect(os.MkdirAll(filepath.Dir(target), 0755)).To(Succeed())
+			Expect(ioutil.WriteFile(target, []byte(content), 0644)).To(Succeed())
+			runGit(repositoryDir, "add", name)
+			runGit(repositoryDir, "commit", "-m", fmt.Sprintf("Add %s", name))
+			Expect(repo.Checkout("master")).To(Succeed())
+		}
+
+		BeforeEach(func() {
+			repositoryDir = setupRepository()
+			var err error
+			repo, err = NewRepoStore("").Get(&RepoRef{URL: fmt.Sprintf("file://%s", repositoryDir)})
+			Expect(err).ToNot(HaveOccurred())
+		})
+
+		AfterEach(func() {
+			teardownRepository(repositoryDir)
+		})
+
+		It("Should decode every document of YAML and JSON files", func() {
+			commitManifest("deploy/app.yaml", multiDocumentManifest)
+			commitManifest("deploy/secret.json", jsonManifest)
+
+			manifests, err := repo.DecodeManifests("deploy/*.{yaml,json}")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(manifests).To(HaveLen(3))
+
+			Expect(manifests[0].Path).To(Equal("deploy/app.yaml"))
+			Expect(manifests[0].Document).To(Equal(0))
+			Expect(manifests[0].Line).To(Equal(1))
+			Expect(manifests[0].Object.GetKind()).To(Equal("ConfigMap"))
+			Expect(manifests[0].Object.GetName()).To(Equal("app-config"))
+
+			Expect(manifests[1].Document).To(Equal(2))
+			Expect(manifests[1].Line).To(Equal(11))
+			Expect(manifests[1].Object.GetKind()).To(Equal("Deployment"))
+			Expect(manifests[1].Object.GetAPIVersion()).To(Equal("apps/v1"))
+
+			Expect(manifests[2].Path).To(Equal("deploy/secret.json"))
+			Expect(manifests[2].Line).To(Equal(1))
+			Expect(manifests[2].Object.GetKind()).To(Equal("Secret"))
+		})
+
+		It("Should skip files that are not YAML or JSON", func() {
+			commitManifest("deploy/app.YML", multiDocumentManifest)
+			commitManifest("deploy/README.md", "# Manifests\n")
+
+			manifests, err := repo.DecodeManifests("deploy/*")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(manifests).To(HaveLen(2))
+			Expect(manifests[0].Path).To(Equal("deploy/app.YML"))
+		})
+
+		It("Should identify the document that fails to decode", func() {
+			commitManifest("deploy/app.yaml", multiDocumentManifest+"---\napiVersion: v1\nmetadata:\n  name: no-kind\n")
+
+			_, err := repo.DecodeManifests("deploy/*.yaml")
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("deploy/app.yaml document 3 at line 18"))
+		})
+
+		It("Should reject JSON files that are not Kubernetes objects", func() {
+			_, err := repo.DecodeManifests("json/*.json")
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("json/long.json document 0 at line 1"))
+		})
+	})
+})
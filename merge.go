@@ -0,0 +1,300 @@
+/*
+Copyright 2018 Pusher Ltd.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package gitstore
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sort"
+
+	"gopkg.in/src-d/go-git.v4/plumbing"
+	"gopkg.in/src-d/go-git.v4/plumbing/filemode"
+	"gopkg.in/src-d/go-git.v4/plumbing/object"
+)
+
+// MergeConflict describes a file changed differently on both sides of a merge.
+type MergeConflict struct {
+	Path   string        // Path is the path of the conflicting file.
+	Base   plumbing.Hash // Base is the blob hash of the file in the merge base, zero if it did not exist.
+	Ours   plumbing.Hash // Ours is the blob hash of the file on the branch merged into, zero if it was deleted.
+	Theirs plumbing.Hash // Theirs is the blob hash of the file in the merged reference, zero if it was deleted.
+}
+
+// MergeResult describes the outcome of a merge.
+type MergeResult struct {
+	Commit      plumbing.Hash   // Commit is the commit the branch points to after the merge, zero if there were conflicts.
+	FastForward bool            // FastForward indicates that the branch was fast-forwarded rather than a merge commit created.
+	UpToDate    bool            // UpToDate indicates that the branch already contained the merged reference.
+	Conflicts   []MergeConflict // Conflicts lists the files that could not be merged, sorted by path.
+}
+
+// FastForward moves the remote branch forward to the commit toRef resolves to.
+func (r *Repo) FastForward(branch, toRef string) error {
+	return r.FastForwardContext(context.Background(), branch, toRef)
+}
+
+// FastForwardContext moves the remote branch forward to the commit toRef resolves to.
+// It returns an error if the branch is not an ancestor of the commit.
+func (r *Repo) FastForwardContext(ctx context.Context, branch, toRef string) error {
+	ours, err := r.remoteBranchHash(branch)
+	if err != nil {
+		return err
+	}
+	theirs, err := r.getCommit(toRef)
+	if err != nil {
+		return err
+	}
+	if ours == theirs.Hash {
+		return nil
+	}
+
+	ancestor, err := r.isAncestor(ours, theirs)
+	if err != nil {
+		return err
+	}
+	if !ancestor {
+		return fmt.Errorf("branch %s cannot be fast-forwarded to %s", branch, toRef)
+	}
+
+	err = r.pushCommit(ctx, theirs.Hash, branch, false)
+	if err != nil {
+		return fmt.Errorf("unable to push to branch %s: %v", branch, err)
+	}
+	return nil
+}
+
+// Merge merges the commit fromRef resolves to into the remote branch.
+func (r *Repo) Merge(branch, fromRef, message string, author object.Signature) (*MergeResult, error) {
+	return r.MergeContext(context.Background(), branch, fromRef, message, author)
+}
+
+// MergeContext merges the commit fromRef resolves to into the remote branch.
+//
+// Files are merged as a whole: a file changed on only one side since the merge base takes that change,
+// and a file changed differently on both sides is a conflict.
+// If there are conflicts, nothing is pushed and the result lists them alongside the error.
+// The branch is fast-forwarded if it has not diverged, otherwise a merge commit is created, authored and committed by author.
+func (r *Repo) MergeContext(ctx context.Context, branch, fromRef, message string, author object.Signature) (*MergeResult, error) {
+	ours, err := r.remoteBranchHash(branch)
+	if err != nil {
+		return nil, err
+	}
+	theirs, err := r.getCommit(fromRef)
+	if err != nil {
+		return nil, err
+	}
+
+	result, err := r.merge(ours, theirs.Hash, message, author)
+	if err != nil {
+		return nil, fmt.Errorf("unable to merge %s into %s: %v", fromRef, branch, err)
+	}
+	if len(result.Conflicts) > 0 {
+		return result, fmt.Errorf("unable to merge %s into %s: %d files have conflicts", fromRef, branch, len(result.Conflicts))
+	}
+	if result.UpToDate {
+		return result, nil
+	}
+
+	err = r.pushCommit(ctx, result.Commit, branch, false)
+	if err != nil {
+		return nil, fmt.Errorf("unable to push to branch %s: %v", branch, err)
+	}
+	return result, nil
+}
+
+// merge performs a three-way merge of the commits, writing a merge commit if
+// they have diverged and there are no conflicts
+func (r *Repo) merge(ours, theirs plumbing.Hash, message string, author object.Signature) (*MergeResult, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	oursCommit, err := r.repository.CommitObject(ours)
+	if err != nil {
+		return nil, fmt.Errorf("unable to retrieve commit %s: %v", ours, err)
+	}
+	theirsCommit, err := r.repository.CommitObject(theirs)
+	if err != nil {
+		return nil, fmt.Errorf("unable to retrieve commit %s: %v", theirs, err)
+	}
+
+	base, err := mergeBase(oursCommit, theirsCommit)
+	if err != nil {
+		return nil, err
+	}
+	switch base.Hash {
+	case theirs:
+		return &MergeResult{Commit: ours, UpToDate: true}, nil
+	case ours:
+		return &MergeResult{Commit: theirs, FastForward: true}, nil
+	}
+
+	baseFiles, err := flattenCommitTree(base)
+	if err != nil {
+		return nil, err
+	}
+	oursFiles, err := flattenCommitTree(oursCommit)
+	if err != nil {
+		return nil, err
+	}
+	theirsFiles, err := flattenCommitTree(theirsCommit)
+	if err != nil {
+		return nil, err
+	}
+
+	result := &MergeResult{}
+	changes := make(map[string]*object.TreeEntry)
+	for _, path := range mergePaths(baseFiles, oursFiles, theirsFiles) {
+		baseEntry, inBase := baseFiles[path]
+		oursEntry, inOurs := oursFiles[path]
+		theirsEntry, inTheirs := theirsFiles[path]
+		switch {
+		case sameEntry(oursEntry, inOurs, theirsEntry, inTheirs):
+			// Both sides made the same change, or neither changed the file
+		case sameEntry(baseEntry, inBase, theirsEntry, inTheirs):
+			// Only our side changed the file
+		case sameEntry(baseEntry, inBase, oursEntry, inOurs):
+			// Only their side changed the file
+			if inTheirs {
+				entry := theirsEntry
+				changes[path] = &entry
+			} else {
+				changes[path] = nil
+			}
+		default:
+			result.Conflicts = append(result.Conflicts, MergeConflict{
+				Path:   path,
+				Base:   baseEntry.Hash,
+				Ours:   oursEntry.Hash,
+				Theirs: theirsEntry.Hash,
+			})
+		}
+	}
+	if len(result.Conflicts) > 0 {
+		return result, nil
+	}
+
+	oursTree, err := oursCommit.Tree()
+	if err != nil {
+		return nil, fmt.Errorf("unable to fetch commit tree: %v", err)
+	}
+	tree, _, err := writeTree(r.repository.Storer, oursTree, changes)
+	if err != nil {
+		return nil, fmt.Errorf("unable to write tree: %v", err)
+	}
+	result.Commit, err = r.writeCommit(tree, []plumbing.Hash{ours, theirs}, message, author)
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// isAncestor checks whether the commit with the given hash is in the history
+// of the commit
+func (r *Repo) isAncestor(ancestor plumbing.Hash, commit *object.Commit) (bool, error) {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	found := false
+	err := object.NewCommitIterBSF(commit, nil, nil).ForEach(func(c *object.Commit) error {
+		if c.Hash == ancestor {
+			found = true
+			return io.EOF
+		}
+		return nil
+	})
+	if err != nil && err != io.EOF {
+		return false, fmt.Errorf("unable to walk history of %s: %v", commit.Hash, err)
+	}
+	return found, nil
+}
+
+// mergeBase returns the first commit in the history of theirs, walking
+// breadth first, that is also in the history of ours
+func mergeBase(ours, theirs *object.Commit) (*object.Commit, error) {
+	oursHistory := make(map[plumbing.Hash]bool)
+	err := object.NewCommitIterBSF(ours, nil, nil).ForEach(func(c *object.Commit) error {
+		oursHistory[c.Hash] = true
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("unable to walk history of %s: %v", ours.Hash, err)
+	}
+
+	var base *object.Commit
+	err = object.NewCommitIterBSF(theirs, nil, nil).ForEach(func(c *object.Commit) error {
+		if oursHistory[c.Hash] {
+			base = c
+			return io.EOF
+		}
+		return nil
+	})
+	if err != nil && err != io.EOF {
+		return nil, fmt.Errorf("unable to walk history of %s: %v", theirs.Hash, err)
+	}
+	if base == nil {
+		return nil, fmt.Errorf("commits %s and %s have no common history", ours.Hash, theirs.Hash)
+	}
+	return base, nil
+}
+
+// flattenCommitTree returns the entries of every file in the tree of the
+// commit, keyed by path
+func flattenCommitTree(commit *object.Commit) (map[string]object.TreeEntry, error) {
+	tree, err := commit.Tree()
+	if err != nil {
+		return nil, fmt.Errorf("unable to fetch commit tree: %v", err)
+	}
+
+	files := make(map[string]object.TreeEntry)
+	walker := object.NewTreeWalker(tree, true, nil)
+	defer walker.Close()
+	for {
+		path, entry, err := walker.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("unable to walk tree of %s: %v", commit.Hash, err)
+		}
+		if entry.Mode == filemode.Dir {
+			continue
+		}
+		files[path] = entry
+	}
+	return files, nil
+}
+
+// mergePaths returns the sorted paths present in any of the sets of files
+func mergePaths(files ...map[string]object.TreeEntry) []string {
+	seen := make(map[string]bool)
+	paths := []string{}
+	for _, set := range files {
+		for path := range set {
+			if !seen[path] {
+				seen[path] = true
+				paths = append(paths, path)
+			}
+		}
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+// sameEntry checks whether two, possibly missing, files have the same
+// content and mode
+func sameEntry(a object.TreeEntry, aExists bool, b object.TreeEntry, bExists bool) bool {
+	if aExists != bExists {
+		return false
+	}
+	return !aExists || (a.Hash == b.Hash && a.Mode == b.Mode)
+}
@@ -0,0 +1,150 @@
+/*
+Copyright 2018 Pusher Ltd.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package gitstore
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"gopkg.in/src-d/go-git.v4/plumbing"
+	"gopkg.in/src-d/go-git.v4/plumbing/object"
+)
+
+var _ = Describe("GitStore", func() {
+
+	Context("When merging branches", func() {
+		var sourceDir, remoteDir, otherDir string
+		var repo *Repo
+		var author object.Signature
+
+		// commitOnBranch commits a file to the branch from a separate clone
+		// and pushes it to the remote
+		commitOnBranch := func(branch, name, content string) string {
+			runGit(otherDir, "checkout", "--quiet", branch)
+			err := ioutil.WriteFile(filepath.Join(otherDir, name), []byte(content), 0644)
+			Expect(err).ToNot(HaveOccurred())
+			runGit(otherDir, "add", name)
+			runGit(otherDir, "commit", "-m", fmt.Sprintf("Update %s on %s", name, branch))
+			runGit(otherDir, "push", "--quiet", "origin", branch)
+			return runGit(otherDir, "rev-parse", "HEAD")
+		}
+
+		// getRepo clones the remote once the branches have been set up
+		getRepo := func() {
+			var err error
+			repo, err = NewRepoStore("").Get(&RepoRef{URL: fmt.Sprintf("file://%s", remoteDir)})
+			Expect(err).ToNot(HaveOccurred())
+		}
+
+		BeforeEach(func() {
+			sourceDir = setupRepository()
+			var err error
+			remoteDir, err = ioutil.TempDir("", "git-store-remote")
+			Expect(err).ToNot(HaveOccurred())
+			runGit(remoteDir, "clone", "--bare", "--quiet", sourceDir, ".")
+			otherDir, err = ioutil.TempDir("", "git-store-other")
+			Expect(err).ToNot(HaveOccurred())
+			runGit(otherDir, "clone", "--quiet", remoteDir, ".")
+			runGit(otherDir, "branch", "bot/update", "master")
+			runGit(otherDir, "push", "--quiet", "origin", "bot/update")
+			author = object.Signature{Name: "Git Store", Email: "git-store@example.com", When: time.Unix(1540000000, 0)}
+		})
+
+		AfterEach(func() {
+			teardownRepository(sourceDir)
+			os.RemoveAll(remoteDir)
+			os.RemoveAll(otherDir)
+		})
+
+		It("Should fast-forward a branch that has not diverged", func() {
+			runGit(otherDir, "push", "--quiet", "origin", "b029517f6300c2da0f4b651b8642506cd6aaf45d:refs/heads/bot/old")
+			getRepo()
+			Expect(repo.FastForward("bot/old", "master")).To(Succeed())
+			Expect(runGit(remoteDir, "rev-parse", "bot/old")).To(Equal("f835a00b5e29ae3440a08fd51aadf4a07d6abc25"))
+		})
+
+		It("Should not fast-forward a branch that has diverged", func() {
+			ours := commitOnBranch("bot/update", "bot.txt", "bot\n")
+			commitOnBranch("master", "main.txt", "main\n")
+			getRepo()
+			Expect(repo.FastForward("bot/update", "master")).ToNot(Succeed())
+			Expect(runGit(remoteDir, "rev-parse", "bot/update")).To(Equal(ours))
+		})
+
+		It("Should merge changes to different files", func() {
+			ours := commitOnBranch("bot/update", "bot.txt", "bot\n")
+			commitOnBranch("master", "main.txt", "main\n")
+			runGit(otherDir, "rm", "--quiet", "CHANGELOG")
+			runGit(otherDir, "commit", "-m", "Remove CHANGELOG")
+			runGit(otherDir, "push", "--quiet", "origin", "master")
+			theirs := runGit(otherDir, "rev-parse", "HEAD")
+			getRepo()
+
+			result, err := repo.Merge("bot/update", "master", "Merge master", author)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(result.FastForward).To(BeFalse())
+			Expect(result.Conflicts).To(BeEmpty())
+			Expect(runGit(remoteDir, "rev-parse", "bot/update")).To(Equal(result.Commit.String()))
+			Expect(runGit(remoteDir, "rev-parse", "bot/update^1")).To(Equal(ours))
+			Expect(runGit(remoteDir, "rev-parse", "bot/update^2")).To(Equal(theirs))
+			Expect(runGit(remoteDir, "show", "bot/update:bot.txt")).To(Equal("bot"))
+			Expect(runGit(remoteDir, "show", "bot/update:main.txt")).To(Equal("main"))
+			Expect(runGit(remoteDir, "ls-tree", "--name-only", "bot/update")).ToNot(ContainSubstring("CHANGELOG"))
+			runGit(remoteDir, "fsck", "--strict")
+		})
+
+		It("Should fast-forward when merging into a branch that has not diverged", func() {
+			theirs := commitOnBranch("master", "main.txt", "main\n")
+			getRepo()
+
+			result, err := repo.Merge("bot/update", "master", "Merge master", author)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(result.FastForward).To(BeTrue())
+			Expect(runGit(remoteDir, "rev-parse", "bot/update")).To(Equal(theirs))
+		})
+
+		It("Should do nothing when the branch is up to date", func() {
+			ours := commitOnBranch("bot/update", "bot.txt", "bot\n")
+			getRepo()
+
+			result, err := repo.Merge("bot/update", "master", "Merge master", author)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(result.UpToDate).To(BeTrue())
+			Expect(runGit(remoteDir, "rev-parse", "bot/update")).To(Equal(ours))
+		})
+
+		It("Should report conflicting changes without pushing", func() {
+			ours := commitOnBranch("bot/update", "LICENSE", "bot\n")
+			commitOnBranch("master", "LICENSE", "main\n")
+			commitOnBranch("master", "main.txt", "main\n")
+			getRepo()
+
+			result, err := repo.Merge("bot/update", "master", "Merge master", author)
+			Expect(err).To(HaveOccurred())
+			Expect(result.Commit.IsZero()).To(BeTrue())
+			Expect(result.Conflicts).To(Equal([]MergeConflict{{
+				Path:   "LICENSE",
+				Base:   plumbing.NewHash(runGit(remoteDir, "rev-parse", "f835a00b5e29ae3440a08fd51aadf4a07d6abc25:LICENSE")),
+				Ours:   plumbing.NewHash(runGit(remoteDir, "rev-parse", "bot/update:LICENSE")),
+				Theirs: plumbing.NewHash(runGit(remoteDir, "rev-parse", "master:LICENSE")),
+			}}))
+			Expect(runGit(remoteDir, "rev-parse", "bot/update")).To(Equal(ours))
+		})
+	})
+})
@@ -20,8 +20,11 @@ package gitstore
 
 import (
 	"fmt"
+	"net/url"
 	"regexp"
 	"strings"
+
+	git "gopkg.in/src-d/go-git.v4"
 )
 
 type urlType int
@@ -37,13 +40,61 @@ const (
 
 const gitRegex = "((git|ssh|file|rsync|http(s)?)|((\\w+[\\:\\w]+?@)?[\\w\\.]+))(:(//)?)(\\w+[\\:\\w]+?@)?([\\w\\.\\:/\\-~]+)(\\.git)?(/)?"
 
+// scpLikeURLRegex matches SSH URLs in the scp-like form user@host:path
+var scpLikeURLRegex = regexp.MustCompile(`^(?:[^@/]+@)?([^:/]+):(.+)$`)
+
 // RepoRef contains all information required to connect to a git repository
 type RepoRef struct {
-	URL        string // URL where the repository is located
-	User       string // User is the username used for user/pass authentication
-	Pass       string // Pass is the password used for user/pass authentication
-	PrivateKey []byte // PrivateKey is the ssh key material used for SSH key-based authentication
-	urlType    urlType
+	URL         string   // URL where the repository is located
+	User        string   // User is the username used for user/pass authentication
+	Pass        string   // Pass is the password used for user/pass authentication
+	PrivateKey  []byte   // PrivateKey is the ssh key material used for SSH key-based authentication
+	KnownHosts  []byte   // KnownHosts is a known_hosts file used to verify the SSH host key, the user's known_hosts are used if empty
+	CABundle    []byte   // CABundle is a PEM encoded bundle of additional certificate authorities trusted for HTTPS to the host of URL, by every repository in the process
+	Depth       int      // Depth limits clones and fetches to the given number of commits from each tip, 0 fetches the full history
+	Branch      string   // Branch restricts clones and fetches to the named branch, all branches are fetched if empty
+	Tags        TagMode  // Tags determines which tags are fetched, defaults to AllTags
+	SparsePaths []string // SparsePaths limits the files checked out to those matching any of the globs, all files are checked out if empty
+	Bare        bool     // Bare clones the repository without a worktree, checkouts only move HEAD
+	Submodules  bool     // Submodules recursively clones and checks out submodules, including their files in GetAllFiles
+	LFS         bool     // LFS enables fetching the content of Git LFS pointer files
+	LFSURL      string   // LFSURL is the URL of the Git LFS server, derived from URL if empty
+	IgnoreFiles bool     // IgnoreFiles excludes files matched by .gitstoreignore files or marked export-ignore in .gitattributes from GetAllFiles
+
+	// SigningKey signs the commits and tags created through the Repo.
+	// If nil, they are created unsigned, unless the repository is already cached with a SigningKey, which then signs them.
+	// A repository cached with a SigningKey cannot be used with a SigningKey for a different key.
+	SigningKey SigningKey
+
+	// SubmoduleCredentials provides the credentials for each submodule URL.
+	// If nil, submodules on the same host are cloned with the credentials of this RepoRef,
+	// and submodules on other hosts are cloned without credentials.
+	SubmoduleCredentials CredentialsFunc
+
+	urlType urlType
+}
+
+// TagMode determines which tags are fetched from the remote repository.
+type TagMode int
+
+const (
+	// AllTags fetches every tag from the remote repository.
+	AllTags TagMode = iota
+	// NoTags fetches no tags.
+	NoTags
+	// TagFollowing fetches only the tags pointing at commits that are fetched.
+	TagFollowing
+)
+
+// gitTagMode converts the TagMode to its Go Git equivalent
+func (m TagMode) gitTagMode() git.TagMode {
+	switch m {
+	case NoTags:
+		return git.NoTags
+	case TagFollowing:
+		return git.TagFollowing
+	}
+	return git.AllTags
 }
 
 // Validate validates the repository url format.
@@ -74,6 +125,10 @@ func (r *RepoRef) Validate() error {
 	if err != nil {
 		return fmt.Errorf("invalid auth credentials: %v", err)
 	}
+	err = validateOptions(r)
+	if err != nil {
+		return fmt.Errorf("invalid options: %v", err)
+	}
 	return nil
 }
 
@@ -172,3 +227,103 @@ func validateAuthCredentials(ref *RepoRef) error {
 	}
 	return nil
 }
+
+// validateOptions checks that the clone, checkout and transport options of
+// the RepoRef are consistent with each other and its URL
+func validateOptions(ref *RepoRef) error {
+	if len(ref.CABundle) > 0 && !strings.HasPrefix(ref.URL, "https://") {
+		return fmt.Errorf("CABundle is only supported for https URLs")
+	}
+	if ref.Depth < 0 {
+		return fmt.Errorf("Depth must not be negative")
+	}
+	if ref.Tags < AllTags || ref.Tags > TagFollowing {
+		return fmt.Errorf("unknown tag mode %d", ref.Tags)
+	}
+	if _, err := compileSparsePaths(ref.SparsePaths); err != nil {
+		return err
+	}
+	if ref.LFS && ref.LFSURL == "" {
+		if _, err := lfsEndpoint(ref.URL); err != nil {
+			return err
+		}
+	}
+	if ref.Bare && len(ref.SparsePaths) > 0 {
+		return fmt.Errorf("SparsePaths cannot be used with Bare repositories")
+	}
+	if len(ref.KnownHosts) > 0 && ref.urlType != sshURL {
+		return fmt.Errorf("KnownHosts is only supported for ssh URLs")
+	}
+	return nil
+}
+
+// differingOption returns the name of the first option determining how the
+// repository is cloned that differs between the RepoRefs, or an empty string
+// if they can share a Repo
+func (r *RepoRef) differingOption(other *RepoRef) string {
+	switch {
+	case r.Depth != other.Depth:
+		return "Depth"
+	case r.Branch != other.Branch:
+		return "Branch"
+	case r.Tags != other.Tags:
+		return "Tags"
+	case !equalStrings(r.SparsePaths, other.SparsePaths):
+		return "SparsePaths"
+	case r.Bare != other.Bare:
+		return "Bare"
+	case r.Submodules != other.Submodules:
+		return "Submodules"
+	case r.LFS != other.LFS:
+		return "LFS"
+	case r.LFSURL != other.LFSURL:
+		return "LFSURL"
+	case r.IgnoreFiles != other.IgnoreFiles:
+		return "IgnoreFiles"
+	}
+	return ""
+}
+
+// equalStrings checks whether the slices contain the same strings in the same
+// order
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// canonicalURL reduces a repository URL to its lower-cased host and path so
+// that the different URLs a repository can be cloned from compare equal,
+// eg. git@github.com:org/repo.git and https://github.com/org/repo
+func canonicalURL(rawURL string) string {
+	host, path := splitRepositoryURL(rawURL)
+	path = strings.TrimSuffix(strings.Trim(path, "/"), ".git")
+	return strings.ToLower(fmt.Sprintf("%s/%s", host, path))
+}
+
+// sameHost checks whether the repository URLs refer to the same host,
+// regardless of the protocol they use
+func sameHost(a, b string) bool {
+	hostA, _ := splitRepositoryURL(a)
+	hostB, _ := splitRepositoryURL(b)
+	return strings.EqualFold(hostA, hostB)
+}
+
+// splitRepositoryURL splits a URL or scp-like SSH URL into its host and path
+func splitRepositoryURL(rawURL string) (string, string) {
+	u, err := url.Parse(rawURL)
+	switch {
+	case err == nil && (u.Host != "" || u.Scheme == "file"):
+		return u.Hostname(), u.Path
+	case scpLikeURLRegex.MatchString(rawURL):
+		matches := scpLikeURLRegex.FindStringSubmatch(rawURL)
+		return matches[1], matches[2]
+	}
+	return "", rawURL
+}
@@ -16,6 +16,7 @@ package gitstore
 import (
 	"context"
 	"fmt"
+	"path"
 	"strings"
 	"sync"
 	"time"
@@ -32,28 +33,51 @@ import (
 type Repo struct {
 	auth       transport.AuthMethod
 	repository *git.Repository
+	options    repoOptions
+	submodules map[string]*Repo // submodules contains the repositories of the submodules checked out, keyed by path.
+	signingKey SigningKey       // signingKey signs created commits and tags, nil if they are unsigned.
 	mutex      sync.RWMutex
+
+	ignoreRules  *ignoreRules  // ignoreRules are the ignore rules of ignoreCommit, nil if not yet loaded.
+	ignoreCommit plumbing.Hash // ignoreCommit is the commit ignoreRules were loaded from.
+	ignoreMutex  sync.Mutex
+}
+
+// repoOptions contains the settings of the RepoRef that apply once a
+// repository has been cloned
+type repoOptions struct {
+	clone       *git.CloneOptions // clone are the options the repository was cloned with.
+	repoDir     string            // repoDir is the path the repository was cloned into, empty for in memory repositories.
+	sparsePaths []glob.Glob       // sparsePaths limits the files checked out, all files are checked out if empty.
+	submodules  bool              // submodules indicates whether submodules are cloned and checked out.
+	credentials CredentialsFunc   // credentials provides the credentials for submodules.
+	lfs         *lfsClient        // lfs fetches Git LFS objects, nil if LFS is not enabled.
+	ignoreFiles bool              // ignoreFiles indicates whether ignore and attribute files exclude files from GetAllFiles.
 }
 
 // File represents a file within a git repository.
 type File struct {
 	file       *object.File
 	headCommit *object.Commit
+	repo       *Repo
 }
 
 // GitLog contains information about a commit from the git repository log.
 type GitLog struct {
-	Date   time.Time     // Date is the datetime of the commit this log corresponds to.
-	Hash   plumbing.Hash // Hash contains the hash of the commit.
-	Author string        // Author is the author as stored in the commit.
-	Text   string        // Text is the commit message.
+	Date      time.Time        // Date is the datetime of the commit this log corresponds to.
+	Hash      plumbing.Hash    // Hash contains the hash of the commit.
+	Author    string           // Author is the author as stored in the commit.
+	Text      string           // Text is the commit message.
+	Committer object.Signature // Committer contains the name, email and time of the committer.
+	Parents   []plumbing.Hash  // Parents contains the hashes of the parent commits.
 }
 
 // newRepo constructs a new Repo with all required fields set
-func newRepo(repo *git.Repository, auth transport.AuthMethod) *Repo {
+func newRepo(repo *git.Repository, auth transport.AuthMethod, options repoOptions) *Repo {
 	return &Repo{
 		repository: repo,
 		auth:       auth,
+		options:    options,
 		mutex:      sync.RWMutex{},
 	}
 }
@@ -62,8 +86,8 @@ func newRepo(repo *git.Repository, auth transport.AuthMethod) *Repo {
 // after the repository has been cloned.
 // Without cleaning, a repo will always resolve the local branch rather than the
 // remote branch.
-func cleanNewRepo(repo *git.Repository) error {
-	err := checkoutHeadHash(repo)
+func cleanNewRepo(repo *git.Repository, sparsePaths []glob.Glob) error {
+	err := checkoutHeadHash(repo, sparsePaths)
 	if err != nil {
 		return fmt.Errorf("error checking out HEAD: %v", err)
 	}
@@ -82,24 +106,38 @@ func cleanNewRepo(repo *git.Repository) error {
 
 // checkoutHeadHash detaches the worktree at the HEAD commit
 // (ie no longer on a branch).
-func checkoutHeadHash(repo *git.Repository) error {
+func checkoutHeadHash(repo *git.Repository, sparsePaths []glob.Glob) error {
 	head, err := repo.Head()
 	if err != nil {
 		return fmt.Errorf("unable to resolve HEAD commit: %v", err)
 	}
-	worktree, err := repo.Worktree()
+	err = checkoutCommit(repo, head.Hash(), sparsePaths)
 	if err != nil {
-		return fmt.Errorf("unable to load worktree: %v", err)
+		return fmt.Errorf("unable to checkout HEAD hash: %v", err)
+	}
+	return nil
+}
+
+// checkoutCommit detaches the worktree, or HEAD of a bare repository, at the
+// given commit hash
+func checkoutCommit(repo *git.Repository, hash plumbing.Hash, sparsePaths []glob.Glob) error {
+	if isBare(repo) {
+		return detachHead(repo, hash)
+	}
+	if len(sparsePaths) > 0 {
+		return sparseCheckout(repo, hash, sparsePaths)
 	}
 
-	err = worktree.Checkout(&git.CheckoutOptions{
-		Hash:  head.Hash(),
-		Force: true,
-	})
+	// Fetch the worktree
+	workTree, err := repo.Worktree()
 	if err != nil {
-		return fmt.Errorf("unable to checkout HEAD hash: %v", err)
+		return fmt.Errorf("unable to fetch repository worktree: %v", err)
 	}
-	return nil
+	// Perform checkout operation on worktree
+	return workTree.Checkout(&git.CheckoutOptions{
+		Hash:  hash,
+		Force: true,
+	})
 }
 
 // cleanLocalBranches removes references to local branches from the repository
@@ -154,6 +192,13 @@ func (r *Repo) setAuth(auth transport.AuthMethod) {
 	r.auth = auth
 }
 
+// setSigningKey sets the key used to sign created commits and tags
+func (r *Repo) setSigningKey(key SigningKey) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.signingKey = key
+}
+
 // Checkout performs a Git checkout of the repository at the provided reference.
 //
 // Note: It is assumed that the repository has already been cloned prior to Checkout() being called.
@@ -162,38 +207,72 @@ func (r *Repo) Checkout(ref string) error {
 }
 
 // CheckoutContext performs a Git checkout of the repository at the provided reference.
+// If the RepoRef has SparsePaths, only the files matching them are written to the worktree.
+// If the RepoRef is Bare, only HEAD is moved.
+// If the RepoRef has Submodules, they are checked out at the commits recorded by the reference.
 //
 // Note: It is assumed that the repository has already been cloned prior to Checkout() being called.
 func (r *Repo) CheckoutContext(ctx context.Context, ref string) error {
-	err := r.FetchContext(ctx)
+	hash, err := r.resolveCheckout(ctx, ref)
 	if err != nil {
-		return fmt.Errorf("unable to fetch repository: %v", err)
+		return err
 	}
 
-	// Fetch the worktree
-	workTree, err := r.repository.Worktree()
+	err = r.checkoutHash(ctx, hash)
 	if err != nil {
-		return fmt.Errorf("unable to fetch repository worktree: %v", err)
+		return fmt.Errorf("unable to checkout reference %s: %v", ref, err)
+	}
+	return nil
+}
+
+// resolveCheckout fetches the repository and resolves the reference to the
+// commit to check out, deepening shallow repositories if required
+func (r *Repo) resolveCheckout(ctx context.Context, ref string) (plumbing.Hash, error) {
+	err := r.FetchContext(ctx)
+	if err != nil {
+		return plumbing.ZeroHash, fmt.Errorf("unable to fetch repository: %v", err)
 	}
 
 	hash, err := r.parseReference(ref)
+	if err != nil && isHash(ref) && r.isShallow() {
+		// The commit may be older than the history fetched so far
+		err = r.deepen(ctx, plumbing.NewHash(ref))
+		if err != nil {
+			return plumbing.ZeroHash, fmt.Errorf("unable to deepen repository: %v", err)
+		}
+		hash, err = r.parseReference(ref)
+	}
 	if err != nil {
-		return fmt.Errorf("unable to parse ref %s: %v", ref, err)
+		return plumbing.ZeroHash, fmt.Errorf("unable to parse ref %s: %v", ref, err)
 	}
+	return *hash, nil
+}
 
-	r.mutex.Lock()
-	defer r.mutex.Unlock()
-	// Perform checkout operation on worktree
-	err = workTree.Checkout(&git.CheckoutOptions{
-		Hash:  *hash,
-		Force: true,
-	})
+// checkoutHash detaches the worktree at the given commit hash and updates
+// submodules if enabled
+func (r *Repo) checkoutHash(ctx context.Context, hash plumbing.Hash) error {
+	err := r.checkoutWorktree(hash)
 	if err != nil {
-		return fmt.Errorf("unable to checkout reference %s: %v", ref, err)
+		return err
+	}
+	if !r.options.submodules {
+		return nil
+	}
+
+	err = r.updateSubmodules(ctx)
+	if err != nil {
+		return fmt.Errorf("unable to update submodules: %v", err)
 	}
 	return nil
 }
 
+// checkoutWorktree detaches the worktree at the given commit hash
+func (r *Repo) checkoutWorktree(hash plumbing.Hash) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return checkoutCommit(r.repository, hash, r.options.sparsePaths)
+}
+
 // parseReference attempts to convert the git reference into a hash
 func (r *Repo) parseReference(ref string) (*plumbing.Hash, error) {
 	r.mutex.RLock()
@@ -213,6 +292,22 @@ func (r *Repo) parseReference(ref string) (*plumbing.Hash, error) {
 	return nil, err
 }
 
+// getCommit resolves the git reference and returns the commit it points to
+func (r *Repo) getCommit(ref string) (*object.Commit, error) {
+	hash, err := r.parseReference(ref)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse ref %s: %v", ref, err)
+	}
+
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	commit, err := r.repository.CommitObject(*hash)
+	if err != nil {
+		return nil, fmt.Errorf("unable to retrieve commit: %v", err)
+	}
+	return commit, nil
+}
+
 // Fetch performs a Git fetch of the repository.
 //
 // Note: While Fetch itself is thread-safe in that it ensures a previous Fetch() is completed before starting a new one,
@@ -222,6 +317,7 @@ func (r *Repo) Fetch() error {
 }
 
 // FetchContext performs a Git fetch of the repository.
+// The depth, branch and tags of the RepoRef the repository was cloned with are respected.
 //
 // Note: While Fetch itself is thread-safe in that it ensures a previous Fetch() is completed before starting a new one,
 // the Repo is not. If Fetch is called from two go routines, subsequent reads may be non-deterministic.
@@ -231,8 +327,13 @@ func (r *Repo) FetchContext(ctx context.Context) error {
 	err := r.repository.FetchContext(ctx, &git.FetchOptions{
 		Auth:  r.auth,
 		Force: true,
-		Tags:  git.AllTags,
+		Depth: r.options.clone.Depth,
+		Tags:  r.options.clone.Tags,
 	})
+	if err == plumbing.ErrObjectNotFound && r.options.clone.Depth > 0 {
+		// Go Git is unable to fetch new commits into some shallow clones
+		err = r.reclone(ctx, r.options.clone.Depth, plumbing.ZeroHash)
+	}
 	r.mutex.Unlock()
 	// Ignore "already-up-to-date" error
 	if err != nil && err != git.NoErrAlreadyUpToDate {
@@ -256,17 +357,34 @@ func (r *Repo) GetFile(path string) (*File, error) {
 	return &File{
 		file:       file,
 		headCommit: commit,
+		repo:       r,
 	}, nil
 }
 
 // GetAllFiles returns a map of Files.
-// Each file is keyed in the map by it's path within the repository
+// Each file is keyed in the map by it's path within the repository.
+// If the RepoRef has SparsePaths, only the files matching them are returned.
+// If the RepoRef has Submodules, the files of each submodule are included under its path.
+// If the RepoRef has IgnoreFiles, files matched by any .gitstoreignore file, in gitignore syntax, or marked export-ignore
+// by any .gitattributes file at HEAD are excluded.
 func (r *Repo) GetAllFiles(subPath string, ignoreSymlinks bool) (map[string]*File, error) {
 	allFiles, err := r.getAllFiles()
 	if err != nil {
 		return nil, fmt.Errorf("unable to read files from repository: %v", err)
 	}
 
+	var ignore *ignoreRules
+	if r.options.ignoreFiles {
+		commit, err := r.getHeadCommit()
+		if err != nil {
+			return nil, fmt.Errorf("unable to fetch HEAD commit: %v", err)
+		}
+		ignore, err = r.ignoreRulesAt(commit)
+		if err != nil {
+			return nil, fmt.Errorf("unable to load ignore rules: %v", err)
+		}
+	}
+
 	var g glob.Glob
 	if subPath != "" {
 		g, err = glob.Compile(subPath)
@@ -282,6 +400,11 @@ func (r *Repo) GetAllFiles(subPath string, ignoreSymlinks bool) (map[string]*Fil
 			continue
 		}
 
+		// If the file is ignored, skip it
+		if ignore != nil && ignore.excludes(path) {
+			continue
+		}
+
 		// If the file is a symlink, skip it
 		if ignoreSymlinks && file.file.Mode == filemode.Symlink {
 			continue
@@ -305,13 +428,33 @@ func (r *Repo) getAllFiles() (map[string]*File, error) {
 
 	files := make(map[string]*File)
 	fileiter.ForEach(func(file *object.File) error {
+		if !matchesSparsePaths(r.options.sparsePaths, file.Name) {
+			return nil
+		}
 		files[file.Name] = &File{
 			file:       file,
 			headCommit: commit,
+			repo:       r,
 		}
 		return nil
 	})
 
+	r.mutex.RLock()
+	submodules := r.submodules
+	r.mutex.RUnlock()
+	for subPath, sub := range submodules {
+		subFiles, err := sub.getAllFiles()
+		if err != nil {
+			return nil, fmt.Errorf("unable to read files from submodule %s: %v", subPath, err)
+		}
+		for name, file := range subFiles {
+			name = path.Join(subPath, name)
+			if matchesSparsePaths(r.options.sparsePaths, name) {
+				files[name] = file
+			}
+		}
+	}
+
 	return files, nil
 }
 
@@ -369,6 +512,9 @@ func (r *Repo) isFileMode(path string, mode filemode.FileMode) (bool, error) {
 
 // Contents returns the content of the File as a string.
 //
+// If the RepoRef has LFS enabled, Git LFS pointers are replaced with the content of the object they point to.
+// If the object cannot be fetched, the pointer is returned; use LFSContents to retrieve the error.
+//
 // Note: Contents() does not verify file type and will return binary files as a (probably useless) string representation.
 // It reads the contents in memory, so may suffer from problems if the file size is too large.
 func (f *File) Contents() string {
@@ -379,23 +525,17 @@ func (f *File) Contents() string {
 	if err != nil {
 		return ""
 	}
-	return content
-}
-
-func (f *File) getBlame() (*git.BlameResult, error) {
-	blame, err := git.Blame(f.headCommit, f.file.Name)
-	if err != nil {
-		fmt.Printf("WARN: failed to fetch git blame: %v", err)
-		return &git.BlameResult{Lines: []*git.Line{}}, nil
-	}
-	return blame, nil
+	return f.resolveLFS(content)
 }
 
 // FileLog returns the file log for the current file.
+//
+// Deprecated: FileLog is derived from blame information, which is expensive and does not account for deleted lines
+// or renamed files. Use LastCommit or History instead.
 func (f *File) FileLog() (GitLog, error) {
 	blame, err := f.getBlame()
 	if err != nil {
-		return GitLog{}, fmt.Errorf("unable to get blame for %s: %v", f.file.Name, err)
+		return GitLog{}, err
 	}
 
 	var fileLog GitLog
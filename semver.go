@@ -0,0 +1,132 @@
+/*
+Copyright 2018 Pusher Ltd.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package gitstore
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/Masterminds/semver"
+)
+
+// andSeparatorRegex matches whitespace separating two comparisons in a
+// constraint such as ">=2.0.0 <3.0.0"
+var andSeparatorRegex = regexp.MustCompile(`([^\s,|])\s+([<>=!~^])`)
+
+// SemverOptions configures how tags are matched against a semantic version constraint.
+type SemverOptions struct {
+	Prefix            string // Prefix is required on tag names and stripped before parsing, eg. "v" or "release-".
+	IncludePrerelease bool   // IncludePrerelease allows pre-release tags to match constraints that don't mention a pre-release.
+}
+
+// ResolveSemver returns the tag with the highest semantic version matching the constraint.
+// Constraints may be exact versions or ranges such as "~1.4", "^2" or ">=2.0.0 <3.0.0".
+// Tags which are not valid semantic versions are ignored.
+//
+// If opts is nil, tags are matched without a prefix and pre-releases are excluded.
+func (r *Repo) ResolveSemver(constraint string, opts *SemverOptions) (Tag, error) {
+	if opts == nil {
+		opts = &SemverOptions{}
+	}
+
+	constraints, err := semver.NewConstraint(normalizeConstraint(constraint))
+	if err != nil {
+		return Tag{}, fmt.Errorf("unable to parse constraint %q: %v", constraint, err)
+	}
+
+	tags, err := r.Tags()
+	if err != nil {
+		return Tag{}, err
+	}
+
+	var best *semver.Version
+	var bestTag Tag
+	for _, tag := range tags {
+		if !strings.HasPrefix(tag.Name, opts.Prefix) {
+			continue
+		}
+		version, err := semver.NewVersion(strings.TrimPrefix(tag.Name, opts.Prefix))
+		if err != nil {
+			// Not a semantic version tag
+			continue
+		}
+		if !matchesConstraint(constraints, version, opts.IncludePrerelease) {
+			continue
+		}
+		if best == nil || version.GreaterThan(best) {
+			best = version
+			bestTag = tag
+		}
+	}
+
+	if best == nil {
+		return Tag{}, fmt.Errorf("no tag matches constraint %q", constraint)
+	}
+	return bestTag, nil
+}
+
+// CheckoutSemver performs a Git checkout of the tag with the highest semantic version matching the constraint.
+// It returns the tag that was checked out.
+//
+// Note: It is assumed that the repository has already been cloned prior to CheckoutSemver() being called.
+func (r *Repo) CheckoutSemver(constraint string, opts *SemverOptions) (Tag, error) {
+	return r.CheckoutSemverContext(context.Background(), constraint, opts)
+}
+
+// CheckoutSemverContext performs a Git checkout of the tag with the highest semantic version matching the constraint.
+// It returns the tag that was checked out.
+//
+// Note: It is assumed that the repository has already been cloned prior to CheckoutSemver() being called.
+func (r *Repo) CheckoutSemverContext(ctx context.Context, constraint string, opts *SemverOptions) (Tag, error) {
+	err := r.FetchContext(ctx)
+	if err != nil {
+		return Tag{}, fmt.Errorf("unable to fetch repository: %v", err)
+	}
+
+	tag, err := r.ResolveSemver(constraint, opts)
+	if err != nil {
+		return Tag{}, fmt.Errorf("unable to resolve constraint: %v", err)
+	}
+
+	err = r.checkoutHash(ctx, tag.Hash)
+	if err != nil {
+		return Tag{}, fmt.Errorf("unable to checkout tag %s: %v", tag.Name, err)
+	}
+	return tag, nil
+}
+
+// normalizeConstraint converts whitespace separated comparisons into the
+// comma separated form understood by the semver library
+func normalizeConstraint(constraint string) string {
+	return andSeparatorRegex.ReplaceAllString(strings.TrimSpace(constraint), "$1,$2")
+}
+
+// matchesConstraint checks the version against the constraints.
+// When includePrerelease is set, pre-releases are checked as if they were the
+// release they precede.
+func matchesConstraint(constraints *semver.Constraints, version *semver.Version, includePrerelease bool) bool {
+	if constraints.Check(version) {
+		return true
+	}
+	if !includePrerelease || version.Prerelease() == "" {
+		return false
+	}
+	release, err := version.SetPrerelease("")
+	if err != nil {
+		return false
+	}
+	return constraints.Check(&release)
+}
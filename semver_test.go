@@ -0,0 +1,92 @@
+/*
+Copyright 2018 Pusher Ltd.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package gitstore
+
+import (
+	"fmt"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("GitStore", func() {
+
+	Context("When resolving semantic version constraints", func() {
+		var repositoryDir string
+		var repo *Repo
+
+		BeforeEach(func() {
+			repositoryDir = setupRepository()
+			runGit(repositoryDir, "tag", "v1.3.0", "b029517f6300c2da0f4b651b8642506cd6aaf45d")
+			runGit(repositoryDir, "tag", "v1.4.0", "b8e471f58bcbca63b07bda20e428190409c2db47")
+			runGit(repositoryDir, "tag", "-a", "v1.4.2", "-m", "Release v1.4.2", "918c48b83bd081e863dbe1b80f8998f058cd8294")
+			runGit(repositoryDir, "tag", "v1.5.0-rc.1", "6ecf0ef2c2dffb796033e5a02219af86ec6584e5")
+			runGit(repositoryDir, "tag", "v2.0.0", "f835a00b5e29ae3440a08fd51aadf4a07d6abc25")
+			runGit(repositoryDir, "tag", "release-3.0.0", "af2d6a6954d532f8ffb47615169c8fdf9d383a1a")
+			runGit(repositoryDir, "tag", "latest", "f835a00b5e29ae3440a08fd51aadf4a07d6abc25")
+			// Tags of trees are skipped rather than failing resolution
+			runGit(repositoryDir, "tag", "-a", "v9.0.0", "-m", "Tree", "master^{tree}")
+
+			rs := NewRepoStore("")
+			var err error
+			repo, err = rs.Get(&RepoRef{
+				URL: fmt.Sprintf("file://%s", repositoryDir),
+			})
+			Expect(err).ToNot(HaveOccurred())
+			err = repo.Fetch()
+			Expect(err).ToNot(HaveOccurred())
+		})
+
+		AfterEach(func() {
+			teardownRepository(repositoryDir)
+		})
+
+		var resolves = func(constraint string, opts *SemverOptions, expectedTag string, expectedHash string) {
+			It(fmt.Sprintf("Resolves %q to %s", constraint, expectedTag), func() {
+				tag, err := repo.ResolveSemver(constraint, opts)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(tag.Name).To(Equal(expectedTag))
+				Expect(tag.Hash.String()).To(Equal(expectedHash))
+			})
+		}
+
+		resolves("~1.4", nil, "v1.4.2", "918c48b83bd081e863dbe1b80f8998f058cd8294")
+		resolves(">=1.0.0 <2.0.0", nil, "v1.4.2", "918c48b83bd081e863dbe1b80f8998f058cd8294")
+		resolves("1.4.0", nil, "v1.4.0", "b8e471f58bcbca63b07bda20e428190409c2db47")
+		resolves("*", nil, "v2.0.0", "f835a00b5e29ae3440a08fd51aadf4a07d6abc25")
+		resolves("1.5.0-rc.1", nil, "v1.5.0-rc.1", "6ecf0ef2c2dffb796033e5a02219af86ec6584e5")
+		resolves("~1.5", &SemverOptions{IncludePrerelease: true}, "v1.5.0-rc.1", "6ecf0ef2c2dffb796033e5a02219af86ec6584e5")
+		resolves(">=3", &SemverOptions{Prefix: "release-"}, "release-3.0.0", "af2d6a6954d532f8ffb47615169c8fdf9d383a1a")
+
+		It("Should not match pre-releases by default", func() {
+			_, err := repo.ResolveSemver("~1.5", nil)
+			Expect(err).To(HaveOccurred())
+		})
+
+		It("Should return an error for an invalid constraint", func() {
+			_, err := repo.ResolveSemver("not a constraint", nil)
+			Expect(err).To(HaveOccurred())
+		})
+
+		It("Should checkout the resolved tag", func() {
+			tag, err := repo.CheckoutSemver("^1", nil)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(tag.Name).To(Equal("v1.4.2"))
+
+			commit, err := repo.getHeadCommit()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(commit.Hash.String()).To(Equal("918c48b83bd081e863dbe1b80f8998f058cd8294"))
+		})
+	})
+})
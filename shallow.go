@@ -0,0 +1,190 @@
+/*
+Copyright 2018 Pusher Ltd.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package gitstore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/golang/glog"
+	"gopkg.in/src-d/go-git.v4"
+	"gopkg.in/src-d/go-git.v4/plumbing"
+)
+
+// isHash checks whether the reference is a full commit hash
+func isHash(ref string) bool {
+	return plumbing.NewHash(ref).String() == ref
+}
+
+// isShallow checks whether the repository was cloned with limited history
+func (r *Repo) isShallow() bool {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	return r.options.clone.Depth > 0
+}
+
+// deepen replaces a shallow clone of the repository with a deeper clone that
+// contains the commit, doubling the depth until it is included.
+// The configured depth is still used for later fetches, and the existing
+// clone is kept if the commit is not found in the full history.
+func (r *Repo) deepen(ctx context.Context, commit plumbing.Hash) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.reclone(ctx, r.options.clone.Depth*2, commit)
+}
+
+// maxRecloneDeepens is the number of times the depth of a new clone is doubled
+// to include the required commits before the full history is cloned
+const maxRecloneDeepens = 3
+
+// reclone replaces the repository with a fresh clone limited to depth
+// commits, keeping its branch and tag settings and the commit checked out.
+// If the checked out commit or the target commit, when not zero, is older
+// than the history of the new clone, the clone is deepened until it is
+// included.
+//
+// Go Git can neither deepen an existing shallow clone, as it only requests
+// objects it does not already have, nor reliably fetch into one, as it walks
+// local history beyond the shallow commits, so the repository is cloned again.
+// The old clone is only removed once the new clone is in place.
+//
+// Note: The caller must hold the write lock.
+func (r *Repo) reclone(ctx context.Context, depth int, target plumbing.Hash) error {
+	options := *r.options.clone
+	options.Auth = r.auth
+	options.Depth = depth
+
+	var previous plumbing.Hash
+	if head, err := r.repository.Head(); err == nil {
+		previous = head.Hash()
+	}
+
+	cloneDir := r.options.repoDir
+	if cloneDir != "" {
+		cloneDir = fmt.Sprintf("%s.reclone", r.options.repoDir)
+	}
+
+	repository, err := r.cloneAt(ctx, cloneDir, &options, previous, target)
+	for deepens := 0; err == errCommitNotCloned; deepens++ {
+		options.Depth *= 2
+		if deepens == maxRecloneDeepens {
+			options.Depth = 0
+		}
+		repository, err = r.cloneAt(ctx, cloneDir, &options, previous, target)
+	}
+	if err != nil {
+		os.RemoveAll(cloneDir)
+		return err
+	}
+
+	if r.options.repoDir != "" {
+		repository, err = swapClone(cloneDir, r.options.repoDir)
+		if err != nil {
+			return err
+		}
+	}
+
+	// The configured depth still applies to later fetches
+	r.repository = repository
+	return nil
+}
+
+// errCommitNotCloned indicates a new clone does not contain the commit that
+// was checked out in the clone it replaces, or the commit it is cloned for
+var errCommitNotCloned = errors.New("required commit not present in new clone")
+
+// cloneAt clones the repository into dir, replacing anything already there,
+// and checks out the previous commit if it is not zero.
+// If a clone of the full history does not contain the previous commit, as
+// the remote history was rewritten, HEAD of the remote is checked out instead.
+// If it does not contain the target commit, when not zero, an error is
+// returned.
+func (r *Repo) cloneAt(ctx context.Context, dir string, options *git.CloneOptions, previous, target plumbing.Hash) (*git.Repository, error) {
+	if dir != "" {
+		err := os.RemoveAll(dir)
+		if err != nil {
+			return nil, fmt.Errorf("unable to remove stale clone: %v", err)
+		}
+	}
+
+	repository, err := cloneRepository(ctx, dir, isBare(r.repository), options)
+	if err != nil {
+		return nil, fmt.Errorf("unable to clone repository: %v", err)
+	}
+	err = cleanNewRepo(repository, r.options.sparsePaths)
+	if err != nil {
+		return nil, fmt.Errorf("unable to clean new repo: %v", err)
+	}
+	if !target.IsZero() {
+		if _, err = repository.CommitObject(target); err != nil {
+			if options.Depth > 0 {
+				return nil, errCommitNotCloned
+			}
+			return nil, fmt.Errorf("commit %s not found in %s", target, options.URL)
+		}
+	}
+	if previous.IsZero() {
+		return repository, nil
+	}
+
+	if _, err = repository.CommitObject(previous); err != nil {
+		if options.Depth > 0 {
+			return nil, errCommitNotCloned
+		}
+		glog.Warningf("Commit %s is no longer present in %s, checking out HEAD", previous, options.URL)
+		return repository, nil
+	}
+	err = checkoutCommit(repository, previous, r.options.sparsePaths)
+	if err != nil {
+		return nil, fmt.Errorf("unable to checkout %s: %v", previous, err)
+	}
+	return repository, nil
+}
+
+// swapClone moves the clone in cloneDir into place of the clone in repoDir
+// and opens it, restoring the old clone if any step fails
+func swapClone(cloneDir, repoDir string) (*git.Repository, error) {
+	oldDir := fmt.Sprintf("%s.old", repoDir)
+	err := os.RemoveAll(oldDir)
+	if err != nil {
+		os.RemoveAll(cloneDir)
+		return nil, fmt.Errorf("unable to remove stale clone: %v", err)
+	}
+	err = os.Rename(repoDir, oldDir)
+	if err != nil {
+		os.RemoveAll(cloneDir)
+		return nil, fmt.Errorf("unable to move old clone aside: %v", err)
+	}
+
+	restore := func() {
+		os.RemoveAll(repoDir)
+		os.Rename(oldDir, repoDir)
+		os.RemoveAll(cloneDir)
+	}
+	err = os.Rename(cloneDir, repoDir)
+	if err != nil {
+		restore()
+		return nil, fmt.Errorf("unable to move clone into place: %v", err)
+	}
+	repository, err := git.PlainOpen(repoDir)
+	if err != nil {
+		restore()
+		return nil, fmt.Errorf("unable to open repository: %v", err)
+	}
+
+	os.RemoveAll(oldDir)
+	return repository, nil
+}
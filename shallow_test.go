@@ -0,0 +1,205 @@
+/*
+Copyright 2018 Pusher Ltd.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package gitstore
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"gopkg.in/src-d/go-git.v4/plumbing"
+)
+
+var _ = Describe("GitStore", func() {
+
+	Context("When cloning with limited history", func() {
+		var repositoryDir string
+		var repoRef *RepoRef
+
+		BeforeEach(func() {
+			repositoryDir = setupRepository()
+			runGit(repositoryDir, "tag", "v1.0.0", "b029517f6300c2da0f4b651b8642506cd6aaf45d")
+			repoRef = &RepoRef{
+				URL: fmt.Sprintf("file://%s", repositoryDir),
+			}
+		})
+
+		AfterEach(func() {
+			teardownRepository(repositoryDir)
+		})
+
+		Context("with a depth", func() {
+			var repo *Repo
+
+			BeforeEach(func() {
+				repoRef.Depth = 1
+				repoRef.Tags = NoTags
+				var err error
+				repo, err = NewRepoStore("").Get(repoRef)
+				Expect(err).ToNot(HaveOccurred())
+			})
+
+			It("Should only fetch the tip commit", func() {
+				Expect(repo.Checkout("master")).To(Succeed())
+				_, err := repo.repository.CommitObject(plumbing.NewHash("b029517f6300c2da0f4b651b8642506cd6aaf45d"))
+				Expect(err).To(HaveOccurred())
+			})
+
+			It("Should respect the depth when fetching", func() {
+				runGit(repositoryDir, "commit", "--allow-empty", "-m", "Empty commit")
+				Expect(repo.Checkout("master")).To(Succeed())
+
+				head := runGit(repositoryDir, "rev-parse", "HEAD")
+				commit, err := repo.getCommit("master")
+				Expect(err).ToNot(HaveOccurred())
+				Expect(commit.Hash.String()).To(Equal(head))
+				_, err = repo.repository.CommitObject(plumbing.NewHash("6ecf0ef2c2dffb796033e5a02219af86ec6584e5"))
+				Expect(err).To(HaveOccurred())
+			})
+
+			It("Should keep the checked out commit when fetching", func() {
+				runGit(repositoryDir, "commit", "--allow-empty", "-m", "Empty commit")
+				runGit(repositoryDir, "commit", "--allow-empty", "-m", "Empty commit")
+				Expect(repo.Fetch()).To(Succeed())
+				Expect(repo.isShallow()).To(BeTrue())
+
+				commit, err := repo.getHeadCommit()
+				Expect(err).ToNot(HaveOccurred())
+				Expect(commit.Hash.String()).To(Equal("f835a00b5e29ae3440a08fd51aadf4a07d6abc25"))
+			})
+
+			It("Should deepen the clone to checkout an older commit", func() {
+				Expect(repo.Checkout("b029517f6300c2da0f4b651b8642506cd6aaf45d")).To(Succeed())
+
+				commit, err := repo.getHeadCommit()
+				Expect(err).ToNot(HaveOccurred())
+				Expect(commit.Hash.String()).To(Equal("b029517f6300c2da0f4b651b8642506cd6aaf45d"))
+				// Later fetches keep the configured depth
+				Expect(repo.isShallow()).To(BeTrue())
+				Expect(repo.options.clone.Depth).To(Equal(1))
+			})
+
+			It("Should report a missing commit without unshallowing the clone", func() {
+				Expect(repo.Checkout("master")).To(Succeed())
+				err := repo.Checkout("0123456789abcdef0123456789abcdef01234567")
+				Expect(err).To(MatchError(ContainSubstring("not found")))
+				Expect(repo.options.clone.Depth).To(Equal(1))
+
+				commit, err := repo.getHeadCommit()
+				Expect(err).ToNot(HaveOccurred())
+				Expect(commit.Hash.String()).To(Equal("f835a00b5e29ae3440a08fd51aadf4a07d6abc25"))
+				_, err = repo.repository.CommitObject(plumbing.NewHash("b029517f6300c2da0f4b651b8642506cd6aaf45d"))
+				Expect(err).To(HaveOccurred())
+			})
+
+			It("Should not fetch tags", func() {
+				tags, err := repo.Tags()
+				Expect(err).ToNot(HaveOccurred())
+				Expect(tags).To(BeEmpty())
+			})
+		})
+
+		Context("with a depth into a directory", func() {
+			var tmpDir string
+
+			BeforeEach(func() {
+				var err error
+				tmpDir, err = ioutil.TempDir("", "git-store")
+				Expect(err).ToNot(HaveOccurred())
+			})
+
+			AfterEach(func() {
+				os.RemoveAll(tmpDir)
+			})
+
+			It("Should deepen the clone to checkout an older commit", func() {
+				repoRef.Depth = 1
+				repo, err := NewRepoStore(tmpDir).Get(repoRef)
+				Expect(err).ToNot(HaveOccurred())
+
+				Expect(repo.Checkout("b029517f6300c2da0f4b651b8642506cd6aaf45d")).To(Succeed())
+				file, err := repo.GetFile("LICENSE")
+				Expect(err).ToNot(HaveOccurred())
+				Expect(file.Contents()).ToNot(BeEmpty())
+			})
+
+			It("Should keep the checked out commit when recloning", func() {
+				repoRef.Depth = 1
+				repo, err := NewRepoStore(tmpDir).Get(repoRef)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(repo.Checkout("master")).To(Succeed())
+				head := runGit(repositoryDir, "commit", "--allow-empty", "-m", "Empty commit")
+				Expect(head).ToNot(BeEmpty())
+
+				repo.mutex.Lock()
+				err = repo.reclone(context.Background(), 1, plumbing.ZeroHash)
+				repo.mutex.Unlock()
+				Expect(err).ToNot(HaveOccurred())
+
+				commit, err := repo.getHeadCommit()
+				Expect(err).ToNot(HaveOccurred())
+				Expect(commit.Hash.String()).To(Equal("f835a00b5e29ae3440a08fd51aadf4a07d6abc25"))
+				_, err = repo.parseReference("master")
+				Expect(err).ToNot(HaveOccurred())
+			})
+
+			It("Should keep the old clone if recloning fails", func() {
+				repoRef.Depth = 1
+				repo, err := NewRepoStore(tmpDir).Get(repoRef)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(repo.Checkout("master")).To(Succeed())
+
+				repo.mutex.Lock()
+				repo.options.clone.URL = fmt.Sprintf("file://%s/missing", tmpDir)
+				err = repo.reclone(context.Background(), 1, plumbing.ZeroHash)
+				repo.mutex.Unlock()
+				Expect(err).To(HaveOccurred())
+
+				file, err := repo.GetFile("LICENSE")
+				Expect(err).ToNot(HaveOccurred())
+				Expect(file.Contents()).ToNot(BeEmpty())
+				_, err = os.Stat(filepath.Join(tmpDir, repoRef.URL+".reclone"))
+				Expect(os.IsNotExist(err)).To(BeTrue())
+			})
+		})
+
+		Context("with a single branch", func() {
+			It("Should only fetch the branch", func() {
+				runGit(repositoryDir, "branch", "staging", "b029517f6300c2da0f4b651b8642506cd6aaf45d")
+				repoRef.Branch = "master"
+				repo, err := NewRepoStore("").Get(repoRef)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(repo.Fetch()).To(Succeed())
+
+				branches, err := repo.Branches()
+				Expect(err).ToNot(HaveOccurred())
+				Expect(branches).To(HaveLen(1))
+				Expect(branches[0].Name).To(Equal("master"))
+
+				tags, err := repo.Tags()
+				Expect(err).ToNot(HaveOccurred())
+				Expect(tags).To(HaveLen(1))
+			})
+		})
+
+		It("Should reject a negative depth", func() {
+			repoRef.Depth = -1
+			Expect(repoRef.Validate()).ToNot(Succeed())
+		})
+	})
+})
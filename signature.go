@@ -0,0 +1,580 @@
+/*
+Copyright 2018 Pusher Ltd.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package gitstore
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"fmt"
+	"hash"
+	"io/ioutil"
+	"sort"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/armor"
+	"golang.org/x/crypto/openpgp/packet"
+	"golang.org/x/crypto/ssh"
+	"gopkg.in/src-d/go-git.v4/plumbing"
+)
+
+const (
+	pgpSignatureHeader = "-----BEGIN PGP SIGNATURE-----"
+	sshSignatureHeader = "-----BEGIN SSH SIGNATURE-----"
+	sshSignatureFooter = "-----END SSH SIGNATURE-----"
+	sshSignatureMagic  = "SSHSIG"
+	// sshSignatureNamespace is the namespace git signs commits and tags in
+	sshSignatureNamespace = "git"
+)
+
+// SignatureType is the type of key a commit or tag was signed with.
+type SignatureType string
+
+const (
+	// OpenPGPSignature is a signature made with an OpenPGP key, eg. by GnuPG.
+	OpenPGPSignature SignatureType = "openpgp"
+	// SSHSignature is a signature made with an SSH key by ssh-keygen.
+	SSHSignature SignatureType = "ssh"
+)
+
+// Keyring contains the keys trusted to sign commits and tags.
+type Keyring struct {
+	OpenPGP        string // OpenPGP contains ASCII armored OpenPGP public keys.
+	AllowedSigners string // AllowedSigners contains SSH public keys in the ssh-keygen allowed signers format.
+}
+
+// Signer describes the trusted key that made a valid signature.
+type Signer struct {
+	Type        SignatureType // Type is the type of the signing key.
+	Identity    string        // Identity is the primary OpenPGP identity or the SSH principals of the key.
+	Fingerprint string        // Fingerprint is the fingerprint of the signing key.
+}
+
+// VerifyCommit checks that the commit ref resolves to is signed by a key in the keyring and returns the signer.
+func (r *Repo) VerifyCommit(ref string, keyring *Keyring) (*Signer, error) {
+	hash, err := r.parseReference(ref)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse ref %s: %v", ref, err)
+	}
+
+	signer, err := r.verifyObject(plumbing.CommitObject, *hash, keyring)
+	if err != nil {
+		return nil, fmt.Errorf("unable to verify commit %s: %v", hash, err)
+	}
+	return signer, nil
+}
+
+// VerifyTag checks that the annotated tag is signed by a key in the keyring and returns the signer.
+func (r *Repo) VerifyTag(name string, keyring *Keyring) (*Signer, error) {
+	hash, err := r.tagObjectHash(name)
+	if err != nil {
+		return nil, err
+	}
+
+	signer, err := r.verifyObject(plumbing.TagObject, hash, keyring)
+	if err != nil {
+		return nil, fmt.Errorf("unable to verify tag %s: %v", name, err)
+	}
+	return signer, nil
+}
+
+// CheckoutVerified performs a Git checkout of the repository at the provided reference if it is signed by a key in the keyring.
+func (r *Repo) CheckoutVerified(ref string, keyring *Keyring) (*Signer, error) {
+	return r.CheckoutVerifiedContext(context.Background(), ref, keyring)
+}
+
+// CheckoutVerifiedContext performs a Git checkout of the repository at the provided reference if it is signed by a key in the keyring.
+// If the reference is an annotated tag, the signature of the tag is verified, otherwise the signature of the commit is verified.
+// HEAD is left unchanged if the signature does not verify.
+func (r *Repo) CheckoutVerifiedContext(ctx context.Context, ref string, keyring *Keyring) (*Signer, error) {
+	hash, err := r.resolveCheckout(ctx, ref)
+	if err != nil {
+		return nil, err
+	}
+
+	var signer *Signer
+	if tagHash, err := r.tagObjectHash(ref); err == nil {
+		signer, err = r.verifyObject(plumbing.TagObject, tagHash, keyring)
+		if err != nil {
+			return nil, fmt.Errorf("unable to verify tag %s: %v", ref, err)
+		}
+	} else {
+		signer, err = r.verifyObject(plumbing.CommitObject, hash, keyring)
+		if err != nil {
+			return nil, fmt.Errorf("unable to verify commit %s: %v", hash, err)
+		}
+	}
+
+	err = r.checkoutHash(ctx, hash)
+	if err != nil {
+		return nil, fmt.Errorf("unable to checkout reference %s: %v", ref, err)
+	}
+	return signer, nil
+}
+
+// tagObjectHash returns the hash of the annotated tag object with the given
+// name
+func (r *Repo) tagObjectHash(name string) (plumbing.Hash, error) {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	tagName := plumbing.NewTagReferenceName(strings.TrimPrefix(name, "refs/tags/"))
+	ref, err := r.repository.Reference(tagName, true)
+	if err != nil {
+		return plumbing.ZeroHash, fmt.Errorf("unable to find tag %s: %v", name, err)
+	}
+	if _, err := r.repository.TagObject(ref.Hash()); err != nil {
+		return plumbing.ZeroHash, fmt.Errorf("tag %s is not an annotated tag: %v", name, err)
+	}
+	return ref.Hash(), nil
+}
+
+// verifyObject checks the signature of the raw commit or tag object against
+// the keyring
+func (r *Repo) verifyObject(objectType plumbing.ObjectType, hash plumbing.Hash, keyring *Keyring) (*Signer, error) {
+	if keyring == nil {
+		return nil, fmt.Errorf("no keyring provided")
+	}
+
+	raw, err := r.rawObject(objectType, hash)
+	if err != nil {
+		return nil, err
+	}
+
+	var payload []byte
+	var signature string
+	if objectType == plumbing.TagObject {
+		payload, signature = splitTagSignature(raw)
+	} else {
+		payload, signature = splitCommitSignature(raw)
+	}
+	return verifySignature(payload, signature, keyring)
+}
+
+// rawObject returns the content of the object as stored, since decoding and
+// re-encoding objects does not preserve every header
+func (r *Repo) rawObject(objectType plumbing.ObjectType, hash plumbing.Hash) ([]byte, error) {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	obj, err := r.repository.Storer.EncodedObject(objectType, hash)
+	if err != nil {
+		return nil, fmt.Errorf("unable to load object %s: %v", hash, err)
+	}
+	reader, err := obj.Reader()
+	if err != nil {
+		return nil, fmt.Errorf("unable to read object %s: %v", hash, err)
+	}
+	defer reader.Close()
+	return ioutil.ReadAll(reader)
+}
+
+// splitCommitSignature separates the gpgsig header from the rest of a raw
+// commit, which is the signed payload
+func splitCommitSignature(raw []byte) ([]byte, string) {
+	var payload bytes.Buffer
+	var signature strings.Builder
+	inHeaders, inSignature := true, false
+	reader := bufio.NewReader(bytes.NewReader(raw))
+	for {
+		line, err := reader.ReadString('\n')
+		if line != "" {
+			switch {
+			case !inHeaders:
+				payload.WriteString(line)
+			case inSignature && strings.HasPrefix(line, " "):
+				// Continuation lines of a header are indented by a space
+				signature.WriteString(line[1:])
+			case strings.HasPrefix(line, "gpgsig "):
+				signature.WriteString(strings.TrimPrefix(line, "gpgsig "))
+				inSignature = true
+			default:
+				inSignature = false
+				inHeaders = line != "\n"
+				payload.WriteString(line)
+			}
+		}
+		if err != nil {
+			break
+		}
+	}
+	return payload.Bytes(), signature.String()
+}
+
+// splitTagSignature separates the signature appended to the message of a raw
+// tag from the rest of the tag, which is the signed payload
+func splitTagSignature(raw []byte) ([]byte, string) {
+	index := -1
+	for _, header := range []string{pgpSignatureHeader, sshSignatureHeader} {
+		if i := bytes.LastIndex(raw, []byte("\n"+header)); i > index {
+			index = i
+		}
+	}
+	if index < 0 {
+		return raw, ""
+	}
+	return raw[:index+1], string(raw[index+1:])
+}
+
+// verifySignature checks the signature of the payload against the keys of the
+// matching type in the keyring
+func verifySignature(payload []byte, signature string, keyring *Keyring) (*Signer, error) {
+	switch {
+	case signature == "":
+		return nil, fmt.Errorf("object is not signed")
+	case strings.HasPrefix(signature, pgpSignatureHeader):
+		return verifyOpenPGPSignature(payload, signature, keyring.OpenPGP)
+	case strings.HasPrefix(signature, sshSignatureHeader):
+		return verifySSHSignature(payload, signature, keyring.AllowedSigners)
+	default:
+		return nil, fmt.Errorf("unsupported signature format")
+	}
+}
+
+// verifyOpenPGPSignature checks a detached armored OpenPGP signature
+func verifyOpenPGPSignature(payload []byte, signature string, armoredKeyRing string) (*Signer, error) {
+	if armoredKeyRing == "" {
+		return nil, fmt.Errorf("no OpenPGP keys trusted")
+	}
+	entities, err := openpgp.ReadArmoredKeyRing(strings.NewReader(armoredKeyRing))
+	if err != nil {
+		return nil, fmt.Errorf("unable to read OpenPGP keys: %v", err)
+	}
+
+	block, err := armor.Decode(strings.NewReader(signature))
+	if err != nil {
+		return nil, fmt.Errorf("unable to decode OpenPGP signature: %v", err)
+	}
+	p, err := packet.Read(block.Body)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse OpenPGP signature: %v", err)
+	}
+	sig, ok := p.(*packet.Signature)
+	if !ok || sig.IssuerKeyId == nil {
+		return nil, fmt.Errorf("unsupported OpenPGP signature")
+	}
+	if sig.SigType != packet.SigTypeBinary {
+		return nil, fmt.Errorf("unsupported OpenPGP signature type %d", sig.SigType)
+	}
+
+	var entity *openpgp.Entity
+	for _, key := range entities.KeysById(*sig.IssuerKeyId) {
+		h := sig.Hash.New()
+		h.Write(payload)
+		if key.PublicKey.VerifySignature(h, sig) != nil {
+			continue
+		}
+		err = validateOpenPGPKey(key, sig, time.Now())
+		if err != nil {
+			return nil, fmt.Errorf("invalid OpenPGP signature: %v", err)
+		}
+		entity = key.Entity
+		break
+	}
+	if entity == nil {
+		return nil, fmt.Errorf("invalid OpenPGP signature: not signed by a trusted key")
+	}
+	return &Signer{
+		Type:        OpenPGPSignature,
+		Identity:    primaryIdentity(entity),
+		Fingerprint: fmt.Sprintf("%X", entity.PrimaryKey.Fingerprint),
+	}, nil
+}
+
+// validateOpenPGPKey checks that the key was valid for signing when the
+// signature was made, and that the signature has not expired since
+func validateOpenPGPKey(key openpgp.Key, sig *packet.Signature, now time.Time) error {
+	if len(key.Entity.Revocations) > 0 {
+		return fmt.Errorf("key %X is revoked", key.Entity.PrimaryKey.Fingerprint)
+	}
+	if key.SelfSignature == nil {
+		return fmt.Errorf("key %X has no self-signature", key.PublicKey.Fingerprint)
+	}
+	if key.SelfSignature.RevocationReason != nil || key.SelfSignature.SigType == packet.SigTypeSubkeyRevocation {
+		return fmt.Errorf("key %X is revoked", key.PublicKey.Fingerprint)
+	}
+	if key.SelfSignature.FlagsValid && !key.SelfSignature.FlagSign {
+		return fmt.Errorf("key %X is not a signing key", key.PublicKey.Fingerprint)
+	}
+
+	if sig.CreationTime.Before(key.PublicKey.CreationTime) {
+		return fmt.Errorf("signature predates key %X", key.PublicKey.Fingerprint)
+	}
+	if expired(key.PublicKey.CreationTime, key.SelfSignature.KeyLifetimeSecs, sig.CreationTime) {
+		return fmt.Errorf("key %X had expired when the signature was made", key.PublicKey.Fingerprint)
+	}
+	if key.PublicKey != key.Entity.PrimaryKey {
+		// The primary key must also have been valid
+		identity := key.Entity.Identities[primaryIdentity(key.Entity)]
+		if identity != nil && identity.SelfSignature != nil &&
+			expired(key.Entity.PrimaryKey.CreationTime, identity.SelfSignature.KeyLifetimeSecs, sig.CreationTime) {
+			return fmt.Errorf("key %X had expired when the signature was made", key.Entity.PrimaryKey.Fingerprint)
+		}
+	}
+	if expired(sig.CreationTime, sig.SigLifetimeSecs, now) {
+		return fmt.Errorf("signature has expired")
+	}
+	return nil
+}
+
+// expired checks whether a lifetime in seconds starting at created has ended
+// by the given time; a missing or zero lifetime never ends
+func expired(created time.Time, lifetimeSecs *uint32, at time.Time) bool {
+	if lifetimeSecs == nil || *lifetimeSecs == 0 {
+		return false
+	}
+	return at.After(created.Add(time.Duration(*lifetimeSecs) * time.Second))
+}
+
+// primaryIdentity returns the identity marked as primary, or the first
+// identity by name
+func primaryIdentity(entity *openpgp.Entity) string {
+	names := []string{}
+	for name, identity := range entity.Identities {
+		if identity.SelfSignature != nil && identity.SelfSignature.IsPrimaryId != nil && *identity.SelfSignature.IsPrimaryId {
+			return name
+		}
+		names = append(names, name)
+	}
+	if len(names) == 0 {
+		return ""
+	}
+	sort.Strings(names)
+	return names[0]
+}
+
+// sshSignature is the wire format of an ssh-keygen signature, following the
+// magic preamble
+type sshSignature struct {
+	Version       uint32
+	PublicKey     []byte
+	Namespace     string
+	Reserved      string
+	HashAlgorithm string
+	Signature     []byte
+}
+
+// sshSignedData is the wire format of the data signed by ssh-keygen,
+// following the magic preamble
+type sshSignedData struct {
+	Namespace     string
+	Reserved      string
+	HashAlgorithm string
+	Hash          []byte
+}
+
+// allowedSigner is an entry of an allowed signers file
+type allowedSigner struct {
+	principals  string
+	key         ssh.PublicKey
+	namespaces  []string
+	validAfter  time.Time
+	validBefore time.Time
+}
+
+// verifySSHSignature checks an armored ssh-keygen signature made in the git
+// namespace by one of the allowed signers
+func verifySSHSignature(payload []byte, signature string, allowedSigners string) (*Signer, error) {
+	signers, err := parseAllowedSigners(allowedSigners)
+	if err != nil {
+		return nil, err
+	}
+	if len(signers) == 0 {
+		return nil, fmt.Errorf("no SSH keys trusted")
+	}
+
+	sig, err := parseSSHSignature(signature)
+	if err != nil {
+		return nil, err
+	}
+	if sig.Namespace != sshSignatureNamespace {
+		return nil, fmt.Errorf("invalid SSH signature namespace %q", sig.Namespace)
+	}
+	key, err := ssh.ParsePublicKey(sig.PublicKey)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse SSH signature key: %v", err)
+	}
+
+	var signer *allowedSigner
+	for i := range signers {
+		if bytes.Equal(signers[i].key.Marshal(), key.Marshal()) && signers[i].allowsNamespace(sig.Namespace) {
+			signer = &signers[i]
+			break
+		}
+	}
+	if signer == nil {
+		return nil, fmt.Errorf("SSH key %s is not an allowed signer", ssh.FingerprintSHA256(key))
+	}
+	// SSH signatures carry no timestamp, so the validity is checked at the
+	// time of verification as ssh-keygen does
+	if !signer.validAt(time.Now()) {
+		return nil, fmt.Errorf("SSH key %s is not valid at this time", ssh.FingerprintSHA256(key))
+	}
+
+	var h hash.Hash
+	switch sig.HashAlgorithm {
+	case "sha256":
+		h = sha256.New()
+	case "sha512":
+		h = sha512.New()
+	default:
+		return nil, fmt.Errorf("unsupported SSH signature hash algorithm %q", sig.HashAlgorithm)
+	}
+	h.Write(payload)
+	signedData := append([]byte(sshSignatureMagic), ssh.Marshal(sshSignedData{
+		Namespace:     sig.Namespace,
+		Reserved:      sig.Reserved,
+		HashAlgorithm: sig.HashAlgorithm,
+		Hash:          h.Sum(nil),
+	})...)
+
+	sshSig := &ssh.Signature{}
+	err = ssh.Unmarshal(sig.Signature, sshSig)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse SSH signature: %v", err)
+	}
+	// SHA-1 RSA signatures are not accepted by ssh-keygen for SSHSIG
+	if sshSig.Format == ssh.SigAlgoRSA {
+		return nil, fmt.Errorf("unsupported SSH signature format %q", sshSig.Format)
+	}
+	err = key.Verify(signedData, sshSig)
+	if err != nil {
+		return nil, fmt.Errorf("invalid SSH signature: %v", err)
+	}
+	return &Signer{
+		Type:        SSHSignature,
+		Identity:    signer.principals,
+		Fingerprint: ssh.FingerprintSHA256(key),
+	}, nil
+}
+
+// parseSSHSignature decodes an armored ssh-keygen signature
+func parseSSHSignature(signature string) (*sshSignature, error) {
+	body := strings.TrimSpace(signature)
+	if !strings.HasPrefix(body, sshSignatureHeader) || !strings.HasSuffix(body, sshSignatureFooter) {
+		return nil, fmt.Errorf("invalid SSH signature armor")
+	}
+	body = strings.TrimSuffix(strings.TrimPrefix(body, sshSignatureHeader), sshSignatureFooter)
+	blob, err := base64.StdEncoding.DecodeString(strings.Join(strings.Fields(body), ""))
+	if err != nil {
+		return nil, fmt.Errorf("unable to decode SSH signature: %v", err)
+	}
+	if !bytes.HasPrefix(blob, []byte(sshSignatureMagic)) {
+		return nil, fmt.Errorf("invalid SSH signature preamble")
+	}
+
+	sig := &sshSignature{}
+	err = ssh.Unmarshal(blob[len(sshSignatureMagic):], sig)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse SSH signature: %v", err)
+	}
+	if sig.Version != 1 {
+		return nil, fmt.Errorf("unsupported SSH signature version %d", sig.Version)
+	}
+	return sig, nil
+}
+
+// parseAllowedSigners parses the lines of an allowed signers file, of the
+// form "principals [options] keytype key [comment]".
+// The namespaces, valid-after and valid-before options are honoured.
+// Certificate authorities are not supported and are skipped.
+func parseAllowedSigners(content string) ([]allowedSigner, error) {
+	signers := []allowedSigner{}
+	for i, line := range strings.Split(content, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			return nil, fmt.Errorf("invalid allowed signer on line %d", i+1)
+		}
+
+		key, _, options, _, err := ssh.ParseAuthorizedKey([]byte(strings.TrimSpace(strings.TrimPrefix(line, fields[0]))))
+		if err != nil {
+			return nil, fmt.Errorf("unable to parse allowed signer on line %d: %v", i+1, err)
+		}
+		signer := allowedSigner{principals: fields[0], key: key}
+		certificateAuthority := false
+		for _, option := range options {
+			switch {
+			case strings.EqualFold(option, "cert-authority"):
+				certificateAuthority = true
+			case strings.HasPrefix(strings.ToLower(option), "namespaces="):
+				value := strings.Trim(option[len("namespaces="):], `"`)
+				signer.namespaces = strings.Split(value, ",")
+			case strings.HasPrefix(strings.ToLower(option), "valid-after="):
+				signer.validAfter, err = parseSignerTime(option[len("valid-after="):])
+			case strings.HasPrefix(strings.ToLower(option), "valid-before="):
+				signer.validBefore, err = parseSignerTime(option[len("valid-before="):])
+			}
+			if err != nil {
+				return nil, fmt.Errorf("invalid allowed signer on line %d: %v", i+1, err)
+			}
+		}
+		if certificateAuthority {
+			continue
+		}
+		signers = append(signers, signer)
+	}
+	return signers, nil
+}
+
+// parseSignerTime parses the time of a valid-after or valid-before option, of
+// the form YYYYMMDD[HHMM[SS]] in local time, or in UTC with a Z suffix
+func parseSignerTime(value string) (time.Time, error) {
+	value = strings.Trim(value, `"`)
+	location := time.Local
+	if strings.HasSuffix(value, "Z") || strings.HasSuffix(value, "z") {
+		value = value[:len(value)-1]
+		location = time.UTC
+	}
+	layouts := map[int]string{8: "20060102", 12: "200601021504", 14: "20060102150405"}
+	layout, ok := layouts[len(value)]
+	if !ok {
+		return time.Time{}, fmt.Errorf("invalid time %q", value)
+	}
+	t, err := time.ParseInLocation(layout, value, location)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid time %q: %v", value, err)
+	}
+	return t, nil
+}
+
+// validAt checks whether the signer is valid at the given time
+func (s allowedSigner) validAt(t time.Time) bool {
+	if !s.validAfter.IsZero() && t.Before(s.validAfter) {
+		return false
+	}
+	if !s.validBefore.IsZero() && !t.Before(s.validBefore) {
+		return false
+	}
+	return true
+}
+
+// allowsNamespace checks whether the signer may sign in the namespace
+func (s allowedSigner) allowsNamespace(namespace string) bool {
+	if len(s.namespaces) == 0 {
+		return true
+	}
+	for _, ns := range s.namespaces {
+		if strings.TrimSpace(ns) == namespace {
+			return true
+		}
+	}
+	return false
+}
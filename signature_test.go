@@ -0,0 +1,275 @@
+/*
+Copyright 2018 Pusher Ltd.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package gitstore
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha512"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/armor"
+	"golang.org/x/crypto/openpgp/packet"
+	"golang.org/x/crypto/ssh"
+	git "gopkg.in/src-d/go-git.v4"
+	"gopkg.in/src-d/go-git.v4/plumbing/object"
+)
+
+var _ = Describe("GitStore", func() {
+
+	Context("When verifying signatures", func() {
+		var repositoryDir, keyDir string
+		var repo *Repo
+		var sshPublicKey string
+		var keyring *Keyring
+
+		// generateSSHKey creates an ed25519 key pair and returns the path to
+		// the private key
+		generateSSHKey := func(name string) string {
+			keyPath := filepath.Join(keyDir, name)
+			out, err := exec.Command("ssh-keygen", "-q", "-t", "ed25519", "-N", "", "-C", name, "-f", keyPath).CombinedOutput()
+			Expect(err).ToNot(HaveOccurred(), string(out))
+			return keyPath
+		}
+
+		readPublicKey := func(keyPath string) string {
+			publicKey, err := ioutil.ReadFile(fmt.Sprintf("%s.pub", keyPath))
+			Expect(err).ToNot(HaveOccurred())
+			return strings.TrimSpace(string(publicKey))
+		}
+
+		// runSSHSignedGit runs a git command configured to sign with the SSH key
+		runSSHSignedGit := func(keyPath string, args ...string) string {
+			return runGit(repositoryDir, append([]string{"-c", "gpg.format=ssh", "-c", fmt.Sprintf("user.signingkey=%s", keyPath)}, args...)...)
+		}
+
+		// commitOpenPGPSigned creates a commit signed by the entity
+		commitOpenPGPSigned := func(entity *openpgp.Entity) string {
+			repository, err := git.PlainOpen(repositoryDir)
+			Expect(err).ToNot(HaveOccurred())
+			worktree, err := repository.Worktree()
+			Expect(err).ToNot(HaveOccurred())
+			err = ioutil.WriteFile(filepath.Join(repositoryDir, "signed.txt"), []byte("signed\n"), 0644)
+			Expect(err).ToNot(HaveOccurred())
+			_, err = worktree.Add("signed.txt")
+			Expect(err).ToNot(HaveOccurred())
+			hash, err := worktree.Commit("Signed with OpenPGP", &git.CommitOptions{
+				Author:  &object.Signature{Name: "Git Store", Email: "git-store@example.com", When: time.Now()},
+				SignKey: entity,
+			})
+			Expect(err).ToNot(HaveOccurred())
+			return hash.String()
+		}
+
+		BeforeEach(func() {
+			repositoryDir = setupRepository()
+			var err error
+			keyDir, err = ioutil.TempDir("", "git-store-keys")
+			Expect(err).ToNot(HaveOccurred())
+
+			keyPath := generateSSHKey("signer")
+			sshPublicKey = readPublicKey(keyPath)
+			runSSHSignedGit(keyPath, "commit", "-S", "--allow-empty", "-m", "Signed with SSH")
+			runSSHSignedGit(keyPath, "tag", "-s", "v2.0.0", "-m", "Release v2.0.0", "b029517f6300c2da0f4b651b8642506cd6aaf45d")
+			runGit(repositoryDir, "tag", "-a", "v2.0.1", "-m", "Unsigned release")
+			keyring = &Keyring{AllowedSigners: fmt.Sprintf("git-store@example.com %s\n", sshPublicKey)}
+
+			repo, err = NewRepoStore("").Get(&RepoRef{URL: fmt.Sprintf("file://%s", repositoryDir)})
+			Expect(err).ToNot(HaveOccurred())
+		})
+
+		AfterEach(func() {
+			teardownRepository(repositoryDir)
+			os.RemoveAll(keyDir)
+		})
+
+		It("Should verify a commit signed with an allowed SSH key", func() {
+			signer, err := repo.VerifyCommit("master", keyring)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(signer.Type).To(Equal(SSHSignature))
+			Expect(signer.Identity).To(Equal("git-store@example.com"))
+			Expect(signer.Fingerprint).To(HavePrefix("SHA256:"))
+		})
+
+		It("Should verify a tag signed with an allowed SSH key", func() {
+			signer, err := repo.VerifyTag("v2.0.0", keyring)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(signer.Identity).To(Equal("git-store@example.com"))
+		})
+
+		It("Should accept allowed signers with options and comments", func() {
+			keyring.AllowedSigners = fmt.Sprintf("# Release signers\n*@example.com namespaces=\"git,file\" %s\n", sshPublicKey)
+			signer, err := repo.VerifyCommit("master", keyring)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(signer.Identity).To(Equal("*@example.com"))
+		})
+
+		It("Should reject signers restricted to other namespaces", func() {
+			keyring.AllowedSigners = fmt.Sprintf("git-store@example.com namespaces=\"file\" %s\n", sshPublicKey)
+			_, err := repo.VerifyCommit("master", keyring)
+			Expect(err).To(HaveOccurred())
+		})
+
+		It("Should reject signers outside their validity period", func() {
+			keyring.AllowedSigners = fmt.Sprintf("git-store@example.com valid-before=\"20180101Z\" %s\n", sshPublicKey)
+			_, err := repo.VerifyCommit("master", keyring)
+			Expect(err).To(HaveOccurred())
+
+			keyring.AllowedSigners = fmt.Sprintf("git-store@example.com valid-after=\"20990101\" %s\n", sshPublicKey)
+			_, err = repo.VerifyCommit("master", keyring)
+			Expect(err).To(HaveOccurred())
+
+			keyring.AllowedSigners = fmt.Sprintf("git-store@example.com valid-after=\"20180101\",valid-before=\"209901011200Z\" %s\n", sshPublicKey)
+			_, err = repo.VerifyCommit("master", keyring)
+			Expect(err).ToNot(HaveOccurred())
+		})
+
+		It("Should reject SHA-1 RSA SSH signatures", func() {
+			key, err := rsa.GenerateKey(rand.Reader, 2048)
+			Expect(err).ToNot(HaveOccurred())
+			signer, err := ssh.NewSignerFromKey(key)
+			Expect(err).ToNot(HaveOccurred())
+			allowedSigners := fmt.Sprintf("git-store@example.com %s", ssh.MarshalAuthorizedKey(signer.PublicKey()))
+			payload := []byte("payload\n")
+
+			_, err = verifySSHSignature(payload, sshSign(signer, ssh.SigAlgoRSASHA2512, payload), allowedSigners)
+			Expect(err).ToNot(HaveOccurred())
+			_, err = verifySSHSignature(payload, sshSign(signer, ssh.SigAlgoRSA, payload), allowedSigners)
+			Expect(err).To(HaveOccurred())
+		})
+
+		It("Should reject a commit signed with an SSH key that is not allowed", func() {
+			otherKey := readPublicKey(generateSSHKey("other"))
+			keyring.AllowedSigners = fmt.Sprintf("other@example.com %s\n", otherKey)
+			_, err := repo.VerifyCommit("master", keyring)
+			Expect(err).To(HaveOccurred())
+		})
+
+		It("Should reject unsigned commits and tags", func() {
+			_, err := repo.VerifyCommit("master~1", keyring)
+			Expect(err).To(HaveOccurred())
+			_, err = repo.VerifyTag("v2.0.1", keyring)
+			Expect(err).To(HaveOccurred())
+		})
+
+		It("Should verify a commit signed with a trusted OpenPGP key", func() {
+			entity, err := openpgp.NewEntity("Git Store", "", "git-store@example.com", nil)
+			Expect(err).ToNot(HaveOccurred())
+			hash := commitOpenPGPSigned(entity)
+			Expect(repo.Fetch()).To(Succeed())
+
+			signer, err := repo.VerifyCommit(hash, &Keyring{OpenPGP: armoredPublicKey(entity)})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(signer.Type).To(Equal(OpenPGPSignature))
+			Expect(signer.Identity).To(Equal("Git Store <git-store@example.com>"))
+			Expect(signer.Fingerprint).To(Equal(fmt.Sprintf("%X", entity.PrimaryKey.Fingerprint)))
+
+			other, err := openpgp.NewEntity("Other", "", "other@example.com", nil)
+			Expect(err).ToNot(HaveOccurred())
+			_, err = repo.VerifyCommit(hash, &Keyring{OpenPGP: armoredPublicKey(other)})
+			Expect(err).To(HaveOccurred())
+		})
+
+		It("Should reject expired and revoked OpenPGP keys", func() {
+			entity, err := openpgp.NewEntity("Git Store", "", "git-store@example.com", nil)
+			Expect(err).ToNot(HaveOccurred())
+			key := openpgp.Key{
+				Entity:        entity,
+				PublicKey:     entity.PrimaryKey,
+				SelfSignature: entity.Identities[primaryIdentity(entity)].SelfSignature,
+			}
+			sig := &packet.Signature{CreationTime: entity.PrimaryKey.CreationTime.Add(time.Hour)}
+			Expect(validateOpenPGPKey(key, sig, time.Now())).To(Succeed())
+
+			lifetime := uint32(60)
+			key.SelfSignature.KeyLifetimeSecs = &lifetime
+			Expect(validateOpenPGPKey(key, sig, time.Now())).ToNot(Succeed())
+			key.SelfSignature.KeyLifetimeSecs = nil
+
+			sig.SigLifetimeSecs = &lifetime
+			Expect(validateOpenPGPKey(key, sig, sig.CreationTime.Add(time.Hour))).ToNot(Succeed())
+			sig.SigLifetimeSecs = nil
+
+			reason := uint8(2)
+			key.SelfSignature.RevocationReason = &reason
+			Expect(validateOpenPGPKey(key, sig, time.Now())).ToNot(Succeed())
+			key.SelfSignature.RevocationReason = nil
+
+			entity.Revocations = []*packet.Signature{{SigType: packet.SigTypeKeyRevocation}}
+			Expect(validateOpenPGPKey(key, sig, time.Now())).ToNot(Succeed())
+		})
+
+		It("Should check out verified references and return the signer", func() {
+			signer, err := repo.CheckoutVerified("v2.0.0", keyring)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(signer.Identity).To(Equal("git-store@example.com"))
+			commit, err := repo.getHeadCommit()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(commit.Hash.String()).To(Equal("b029517f6300c2da0f4b651b8642506cd6aaf45d"))
+		})
+
+		It("Should not move HEAD to references that do not verify", func() {
+			_, err := repo.CheckoutVerified("v2.0.1", keyring)
+			Expect(err).To(HaveOccurred())
+			_, err = repo.CheckoutVerified("f835a00b5e29ae3440a08fd51aadf4a07d6abc25", keyring)
+			Expect(err).To(HaveOccurred())
+
+			commit, err := repo.getHeadCommit()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(commit.Message).To(HavePrefix("Signed with SSH"))
+		})
+	})
+})
+
+// sshSign creates an armored ssh-keygen signature of the payload in the git
+// namespace using the given signature algorithm
+func sshSign(signer ssh.Signer, algorithm string, payload []byte) string {
+	h := sha512.Sum512(payload)
+	signedData := append([]byte(sshSignatureMagic), ssh.Marshal(sshSignedData{
+		Namespace:     sshSignatureNamespace,
+		HashAlgorithm: "sha512",
+		Hash:          h[:],
+	})...)
+	sig, err := signer.(ssh.AlgorithmSigner).SignWithAlgorithm(rand.Reader, signedData, algorithm)
+	Expect(err).ToNot(HaveOccurred())
+	blob := append([]byte(sshSignatureMagic), ssh.Marshal(sshSignature{
+		Version:       1,
+		PublicKey:     signer.PublicKey().Marshal(),
+		Namespace:     sshSignatureNamespace,
+		HashAlgorithm: "sha512",
+		Signature:     ssh.Marshal(sig),
+	})...)
+	return fmt.Sprintf("%s\n%s\n%s\n", sshSignatureHeader, base64.StdEncoding.EncodeToString(blob), sshSignatureFooter)
+}
+
+// armoredPublicKey returns the ASCII armored public key of the entity
+func armoredPublicKey(entity *openpgp.Entity) string {
+	buf := &bytes.Buffer{}
+	w, err := armor.Encode(buf, openpgp.PublicKeyType, nil)
+	Expect(err).ToNot(HaveOccurred())
+	Expect(entity.Serialize(w)).To(Succeed())
+	Expect(w.Close()).To(Succeed())
+	return buf.String()
+}
@@ -0,0 +1,198 @@
+/*
+Copyright 2018 Pusher Ltd.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package gitstore
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha512"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"reflect"
+	"strings"
+
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/ssh"
+	"gopkg.in/src-d/go-git.v4/plumbing"
+	"gopkg.in/src-d/go-git.v4/plumbing/object"
+)
+
+// sshSignatureLineLength is the length ssh-keygen wraps armored signatures at
+const sshSignatureLineLength = 70
+
+// SigningKey signs the commits and tags created through a Repo.
+type SigningKey interface {
+	// Sign returns an ASCII armored detached signature of the payload.
+	Sign(payload []byte) (string, error)
+}
+
+// openPGPSigningKey signs with an OpenPGP private key
+type openPGPSigningKey struct {
+	entity *openpgp.Entity
+}
+
+// NewOpenPGPSigningKey returns a SigningKey that creates OpenPGP signatures, as GnuPG does.
+// The private key of the entity must already be decrypted.
+func NewOpenPGPSigningKey(entity *openpgp.Entity) SigningKey {
+	return &openPGPSigningKey{entity: entity}
+}
+
+// Sign returns an armored OpenPGP signature of the payload.
+func (k *openPGPSigningKey) Sign(payload []byte) (string, error) {
+	signature := &bytes.Buffer{}
+	err := openpgp.ArmoredDetachSign(signature, k.entity, bytes.NewReader(payload), nil)
+	if err != nil {
+		return "", fmt.Errorf("unable to create OpenPGP signature: %v", err)
+	}
+	return fmt.Sprintf("%s\n", strings.TrimSuffix(signature.String(), "\n")), nil
+}
+
+// sshSigningKey signs with an SSH private key
+type sshSigningKey struct {
+	signer ssh.Signer
+}
+
+// NewSSHSigningKey returns a SigningKey that creates SSH signatures, as ssh-keygen does when git is configured with gpg.format=ssh.
+func NewSSHSigningKey(signer ssh.Signer) SigningKey {
+	return &sshSigningKey{signer: signer}
+}
+
+// Sign returns an armored SSH signature of the payload in the git namespace.
+func (k *sshSigningKey) Sign(payload []byte) (string, error) {
+	hash := sha512.Sum512(payload)
+	signedData := append([]byte(sshSignatureMagic), ssh.Marshal(sshSignedData{
+		Namespace:     sshSignatureNamespace,
+		HashAlgorithm: "sha512",
+		Hash:          hash[:],
+	})...)
+
+	var sig *ssh.Signature
+	var err error
+	if algorithmSigner, ok := k.signer.(ssh.AlgorithmSigner); ok && k.signer.PublicKey().Type() == ssh.KeyAlgoRSA {
+		// ssh-keygen rejects SHA-1 RSA signatures
+		sig, err = algorithmSigner.SignWithAlgorithm(rand.Reader, signedData, ssh.SigAlgoRSASHA2512)
+	} else {
+		sig, err = k.signer.Sign(rand.Reader, signedData)
+	}
+	if err != nil {
+		return "", fmt.Errorf("unable to create SSH signature: %v", err)
+	}
+
+	blob := append([]byte(sshSignatureMagic), ssh.Marshal(sshSignature{
+		Version:       1,
+		PublicKey:     k.signer.PublicKey().Marshal(),
+		Namespace:     sshSignatureNamespace,
+		HashAlgorithm: "sha512",
+		Signature:     ssh.Marshal(sig),
+	})...)
+	encoded := base64.StdEncoding.EncodeToString(blob)
+
+	armored := &strings.Builder{}
+	armored.WriteString(sshSignatureHeader + "\n")
+	for len(encoded) > sshSignatureLineLength {
+		armored.WriteString(encoded[:sshSignatureLineLength] + "\n")
+		encoded = encoded[sshSignatureLineLength:]
+	}
+	armored.WriteString(encoded + "\n")
+	armored.WriteString(sshSignatureFooter + "\n")
+	return armored.String(), nil
+}
+
+// sameSigningKey checks whether the keys sign with the same key material,
+// comparing the public keys of the SigningKeys of this package and falling
+// back to equality for other comparable implementations
+func sameSigningKey(a, b SigningKey) bool {
+	aKey, aOK := signingPublicKey(a)
+	bKey, bOK := signingPublicKey(b)
+	if aOK || bOK {
+		return aOK && bOK && bytes.Equal(aKey, bKey)
+	}
+	if a == nil || b == nil {
+		return a == nil && b == nil
+	}
+	if reflect.TypeOf(a) != reflect.TypeOf(b) || !reflect.TypeOf(a).Comparable() {
+		return false
+	}
+	return a == b
+}
+
+// signingPublicKey returns an identifier of the public key of the
+// SigningKeys of this package
+func signingPublicKey(key SigningKey) ([]byte, bool) {
+	switch k := key.(type) {
+	case *openPGPSigningKey:
+		if k == nil || k.entity == nil || k.entity.PrimaryKey == nil {
+			return nil, false
+		}
+		return append([]byte("openpgp:"), k.entity.PrimaryKey.Fingerprint[:]...), true
+	case *sshSigningKey:
+		if k == nil || k.signer == nil {
+			return nil, false
+		}
+		return append([]byte("ssh:"), k.signer.PublicKey().Marshal()...), true
+	}
+	return nil, false
+}
+
+// signCommit sets the signature of the commit to a signature of the commit
+// encoded without a signature
+func signCommit(commit *object.Commit, key SigningKey) error {
+	commit.PGPSignature = ""
+	payload, err := encodedPayload(commit)
+	if err != nil {
+		return err
+	}
+	signature, err := key.Sign(payload)
+	if err != nil {
+		return err
+	}
+	commit.PGPSignature = signature
+	return nil
+}
+
+// signTag sets the signature of the tag to a signature of the tag encoded
+// without a signature
+func signTag(tag *object.Tag, key SigningKey) error {
+	tag.PGPSignature = ""
+	// The signature is appended to the message, which must end in a newline
+	if !strings.HasSuffix(tag.Message, "\n") {
+		tag.Message = fmt.Sprintf("%s\n", tag.Message)
+	}
+	payload, err := encodedPayload(tag)
+	if err != nil {
+		return err
+	}
+	signature, err := key.Sign(payload)
+	if err != nil {
+		return err
+	}
+	tag.PGPSignature = signature
+	return nil
+}
+
+// encodedPayload returns the encoded content of the object
+func encodedPayload(o encodable) ([]byte, error) {
+	obj := &plumbing.MemoryObject{}
+	err := o.Encode(obj)
+	if err != nil {
+		return nil, fmt.Errorf("unable to encode object: %v", err)
+	}
+	reader, err := obj.Reader()
+	if err != nil {
+		return nil, fmt.Errorf("unable to read object: %v", err)
+	}
+	defer reader.Close()
+	return ioutil.ReadAll(reader)
+}
@@ -0,0 +1,158 @@
+/*
+Copyright 2018 Pusher Ltd.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package gitstore
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/ssh"
+	"gopkg.in/src-d/go-git.v4/plumbing/object"
+)
+
+var _ = Describe("GitStore", func() {
+
+	Context("When signing commits and tags", func() {
+		var sourceDir, remoteDir string
+		var author object.Signature
+
+		// getRepo clones the remote with the signing key
+		getRepo := func(key SigningKey) *Repo {
+			repo, err := NewRepoStore("").Get(&RepoRef{
+				URL:        fmt.Sprintf("file://%s", remoteDir),
+				SigningKey: key,
+			})
+			Expect(err).ToNot(HaveOccurred())
+			return repo
+		}
+
+		// commitFile pushes a commit changing a single file
+		commitFile := func(repo *Repo) {
+			txn, err := repo.Begin("master")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(txn.WriteFile("signed.txt", []byte("signed\n"))).To(Succeed())
+			_, err = txn.Commit("Add signed file", author)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(txn.Push(context.Background())).To(Succeed())
+		}
+
+		// allowSigner writes an allowed signers file for git to verify with
+		allowSigner := func(signer ssh.Signer) string {
+			allowedSigners := filepath.Join(remoteDir, "allowed_signers")
+			line := fmt.Sprintf("git-store@example.com %s", ssh.MarshalAuthorizedKey(signer.PublicKey()))
+			Expect(ioutil.WriteFile(allowedSigners, []byte(line), 0644)).To(Succeed())
+			return fmt.Sprintf("gpg.ssh.allowedSignersFile=%s", allowedSigners)
+		}
+
+		BeforeEach(func() {
+			sourceDir = setupRepository()
+			var err error
+			remoteDir, err = ioutil.TempDir("", "git-store-remote")
+			Expect(err).ToNot(HaveOccurred())
+			runGit(remoteDir, "clone", "--bare", "--quiet", sourceDir, ".")
+			author = object.Signature{Name: "Git Store", Email: "git-store@example.com", When: time.Unix(1540000000, 0)}
+		})
+
+		AfterEach(func() {
+			teardownRepository(sourceDir)
+			os.RemoveAll(remoteDir)
+		})
+
+		Context("with an SSH key", func() {
+			var signer ssh.Signer
+			var repo *Repo
+
+			BeforeEach(func() {
+				_, privateKey, err := ed25519.GenerateKey(rand.Reader)
+				Expect(err).ToNot(HaveOccurred())
+				signer, err = ssh.NewSignerFromKey(privateKey)
+				Expect(err).ToNot(HaveOccurred())
+				repo = getRepo(NewSSHSigningKey(signer))
+			})
+
+			It("Should push commits that git verifies", func() {
+				commitFile(repo)
+				runGit(remoteDir, "-c", allowSigner(signer), "verify-commit", "master")
+
+				verified, err := repo.VerifyCommit("master", &Keyring{AllowedSigners: fmt.Sprintf("git-store@example.com %s", ssh.MarshalAuthorizedKey(signer.PublicKey()))})
+				Expect(err).ToNot(HaveOccurred())
+				Expect(verified.Identity).To(Equal("git-store@example.com"))
+			})
+
+			It("Should push tags that git verifies", func() {
+				Expect(repo.CreateTag("v3.0.0", "master", "Release v3.0.0", author)).To(Succeed())
+				runGit(remoteDir, "-c", allowSigner(signer), "verify-tag", "v3.0.0")
+
+				tags, err := repo.Tags()
+				Expect(err).ToNot(HaveOccurred())
+				for _, tag := range tags {
+					if tag.Name == "v3.0.0" {
+						Expect(tag.Message).To(Equal("Release v3.0.0\n"))
+					}
+				}
+			})
+
+			It("Should compare keys by their public key", func() {
+				Expect(sameSigningKey(NewSSHSigningKey(signer), NewSSHSigningKey(signer))).To(BeTrue())
+				_, privateKey, err := ed25519.GenerateKey(rand.Reader)
+				Expect(err).ToNot(HaveOccurred())
+				other, err := ssh.NewSignerFromKey(privateKey)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(sameSigningKey(NewSSHSigningKey(signer), NewSSHSigningKey(other))).To(BeFalse())
+			})
+
+			It("Should sign with RSA keys using SHA-2", func() {
+				privateKey, err := rsa.GenerateKey(rand.Reader, 2048)
+				Expect(err).ToNot(HaveOccurred())
+				rsaSigner, err := ssh.NewSignerFromKey(privateKey)
+				Expect(err).ToNot(HaveOccurred())
+				repo.setSigningKey(NewSSHSigningKey(rsaSigner))
+
+				commitFile(repo)
+				runGit(remoteDir, "-c", allowSigner(rsaSigner), "verify-commit", "master")
+			})
+		})
+
+		Context("with an OpenPGP key", func() {
+			It("Should push signed commits", func() {
+				entity, err := openpgp.NewEntity("Git Store", "", "git-store@example.com", nil)
+				Expect(err).ToNot(HaveOccurred())
+				repo := getRepo(NewOpenPGPSigningKey(entity))
+				commitFile(repo)
+
+				Expect(runGit(remoteDir, "cat-file", "commit", "master")).To(ContainSubstring("-----BEGIN PGP SIGNATURE-----"))
+				commit, err := repo.getCommit("master")
+				Expect(err).ToNot(HaveOccurred())
+				identity, err := commit.Verify(armoredPublicKey(entity))
+				Expect(err).ToNot(HaveOccurred())
+				Expect(identity.PrimaryKey.Fingerprint).To(Equal(entity.PrimaryKey.Fingerprint))
+			})
+		})
+
+		It("Should not sign without a signing key", func() {
+			commitFile(getRepo(nil))
+			Expect(runGit(remoteDir, "cat-file", "commit", "master")).ToNot(ContainSubstring("gpgsig"))
+		})
+	})
+})
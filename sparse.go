@@ -0,0 +1,173 @@
+/*
+Copyright 2018 Pusher Ltd.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package gitstore
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path"
+
+	"github.com/gobwas/glob"
+	"gopkg.in/src-d/go-billy.v4"
+	git "gopkg.in/src-d/go-git.v4"
+	"gopkg.in/src-d/go-git.v4/plumbing"
+	"gopkg.in/src-d/go-git.v4/plumbing/filemode"
+	"gopkg.in/src-d/go-git.v4/plumbing/object"
+)
+
+// compileSparsePaths compiles the globs used to select the files of a sparse
+// checkout
+func compileSparsePaths(paths []string) ([]glob.Glob, error) {
+	globs := []glob.Glob{}
+	for _, path := range paths {
+		g, err := glob.Compile(path)
+		if err != nil {
+			return nil, fmt.Errorf("unable to compile sparse path %q: %v", path, err)
+		}
+		globs = append(globs, g)
+	}
+	return globs, nil
+}
+
+// matchesSparsePaths checks whether the file at path is included in a sparse
+// checkout, all files are included if there are no globs
+func matchesSparsePaths(globs []glob.Glob, path string) bool {
+	if len(globs) == 0 {
+		return true
+	}
+	for _, g := range globs {
+		if g.Match(path) {
+			return true
+		}
+	}
+	return false
+}
+
+// sparseCheckout detaches HEAD at the commit and writes only the files
+// matching the globs into the worktree, removing any others.
+//
+// Go Git does not support sparse checkouts, so the index is not updated.
+func sparseCheckout(repo *git.Repository, hash plumbing.Hash, globs []glob.Glob) error {
+	commit, err := repo.CommitObject(hash)
+	if err != nil {
+		return fmt.Errorf("unable to retrieve commit: %v", err)
+	}
+	worktree, err := repo.Worktree()
+	if err != nil {
+		return fmt.Errorf("unable to load worktree: %v", err)
+	}
+
+	files, err := commit.Files()
+	if err != nil {
+		return fmt.Errorf("unable to load files: %v", err)
+	}
+	wanted := make(map[string]bool)
+	err = files.ForEach(func(file *object.File) error {
+		if !matchesSparsePaths(globs, file.Name) {
+			return nil
+		}
+		wanted[file.Name] = true
+		return writeWorktreeFile(worktree.Filesystem, file)
+	})
+	if err != nil {
+		return fmt.Errorf("unable to write files: %v", err)
+	}
+
+	_, err = removeUnwantedFiles(worktree.Filesystem, "", wanted)
+	if err != nil {
+		return fmt.Errorf("unable to remove files: %v", err)
+	}
+
+	return detachHead(repo, hash)
+}
+
+// writeWorktreeFile writes the file into the filesystem, replacing any
+// existing file at the same path
+func writeWorktreeFile(fs billy.Filesystem, file *object.File) error {
+	if dir := path.Dir(file.Name); dir != "." {
+		err := fs.MkdirAll(dir, 0755)
+		if err != nil {
+			return fmt.Errorf("unable to create directory for %s: %v", file.Name, err)
+		}
+	}
+
+	if file.Mode == filemode.Symlink {
+		target, err := file.Contents()
+		if err != nil {
+			return fmt.Errorf("unable to read symlink %s: %v", file.Name, err)
+		}
+		fs.Remove(file.Name)
+		return fs.Symlink(target, file.Name)
+	}
+
+	mode, err := file.Mode.ToOSFileMode()
+	if err != nil {
+		return fmt.Errorf("unable to determine mode of %s: %v", file.Name, err)
+	}
+	reader, err := file.Reader()
+	if err != nil {
+		return fmt.Errorf("unable to read %s: %v", file.Name, err)
+	}
+	defer reader.Close()
+
+	out, err := fs.OpenFile(file.Name, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, mode.Perm())
+	if err != nil {
+		return fmt.Errorf("unable to create %s: %v", file.Name, err)
+	}
+	defer out.Close()
+	_, err = io.Copy(out, reader)
+	if err != nil {
+		return fmt.Errorf("unable to write %s: %v", file.Name, err)
+	}
+	return nil
+}
+
+// removeUnwantedFiles removes files that are not wanted from the directory,
+// and any directories left empty, returning whether the directory is now empty
+func removeUnwantedFiles(fs billy.Filesystem, dir string, wanted map[string]bool) (bool, error) {
+	infos, err := fs.ReadDir(dir)
+	if err != nil {
+		return false, fmt.Errorf("unable to read directory %s: %v", dir, err)
+	}
+
+	empty := true
+	for _, info := range infos {
+		name := fs.Join(dir, info.Name())
+		if dir == "" && info.Name() == git.GitDirName {
+			empty = false
+			continue
+		}
+
+		if info.IsDir() {
+			dirEmpty, err := removeUnwantedFiles(fs, name, wanted)
+			if err != nil {
+				return false, err
+			}
+			if !dirEmpty {
+				empty = false
+				continue
+			}
+		} else if wanted[name] {
+			empty = false
+			continue
+		}
+
+		err = fs.Remove(name)
+		if err != nil {
+			return false, fmt.Errorf("unable to remove %s: %v", name, err)
+		}
+	}
+	return empty, nil
+}
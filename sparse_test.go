@@ -0,0 +1,129 @@
+/*
+Copyright 2018 Pusher Ltd.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package gitstore
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"gopkg.in/src-d/go-billy.v4"
+)
+
+var _ = Describe("GitStore", func() {
+
+	Context("When performing a sparse checkout", func() {
+		var repo *Repo
+		var worktreeFiles func(fs billy.Filesystem, dir string) []string
+
+		worktreeFiles = func(fs billy.Filesystem, dir string) []string {
+			files := []string{}
+			infos, err := fs.ReadDir(dir)
+			Expect(err).ToNot(HaveOccurred())
+			for _, info := range infos {
+				path := fs.Join(dir, info.Name())
+				if path == ".git" {
+					continue
+				}
+				if info.IsDir() {
+					files = append(files, worktreeFiles(fs, path)...)
+					continue
+				}
+				files = append(files, path)
+			}
+			return files
+		}
+
+		Context("in memory", func() {
+			var fs billy.Filesystem
+
+			BeforeEach(func() {
+				var err error
+				repo, err = NewRepoStore("").Get(&RepoRef{
+					URL:         repositoryURL,
+					SparsePaths: []string{"json/**", "CHANGELOG"},
+				})
+				Expect(err).ToNot(HaveOccurred())
+				worktree, err := repo.repository.Worktree()
+				Expect(err).ToNot(HaveOccurred())
+				fs = worktree.Filesystem
+			})
+
+			It("Should only check out matching files when cloned", func() {
+				Expect(worktreeFiles(fs, "")).To(ConsistOf("CHANGELOG", "json/long.json", "json/short.json"))
+			})
+
+			It("Should only return matching files from GetAllFiles", func() {
+				files, err := repo.GetAllFiles("", false)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(files).To(HaveLen(3))
+				Expect(files).To(HaveKey("json/short.json"))
+			})
+
+			It("Should remove files that no longer match when checking out", func() {
+				Expect(repo.Checkout("b029517f6300c2da0f4b651b8642506cd6aaf45d")).To(Succeed())
+				Expect(worktreeFiles(fs, "")).To(BeEmpty())
+				_, err := fs.Stat("json")
+				Expect(os.IsNotExist(err)).To(BeTrue())
+
+				commit, err := repo.getHeadCommit()
+				Expect(err).ToNot(HaveOccurred())
+				Expect(commit.Hash.String()).To(Equal("b029517f6300c2da0f4b651b8642506cd6aaf45d"))
+			})
+
+			It("Should restore matching files when checking out", func() {
+				Expect(repo.Checkout("b029517f6300c2da0f4b651b8642506cd6aaf45d")).To(Succeed())
+				Expect(repo.Checkout("master")).To(Succeed())
+				Expect(worktreeFiles(fs, "")).To(ConsistOf("CHANGELOG", "json/long.json", "json/short.json"))
+			})
+		})
+
+		Context("into a directory", func() {
+			var tmpDir string
+
+			BeforeEach(func() {
+				var err error
+				tmpDir, err = ioutil.TempDir("", "git-store")
+				Expect(err).ToNot(HaveOccurred())
+				repo, err = NewRepoStore(tmpDir).Get(&RepoRef{
+					URL:         repositoryURL,
+					SparsePaths: []string{"json/**"},
+				})
+				Expect(err).ToNot(HaveOccurred())
+			})
+
+			AfterEach(func() {
+				os.RemoveAll(tmpDir)
+			})
+
+			It("Should only write matching files to disk", func() {
+				repoDir := filepath.Join(tmpDir, repositoryURL)
+				_, err := os.Stat(filepath.Join(repoDir, "json", "short.json"))
+				Expect(err).ToNot(HaveOccurred())
+				_, err = os.Stat(filepath.Join(repoDir, "LICENSE"))
+				Expect(os.IsNotExist(err)).To(BeTrue())
+			})
+		})
+
+		It("Should reject an invalid glob", func() {
+			ref := &RepoRef{
+				URL:         repositoryURL,
+				SparsePaths: []string{"["},
+			}
+			Expect(ref.Validate()).ToNot(Succeed())
+		})
+	})
+})
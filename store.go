@@ -14,13 +14,18 @@ limitations under the License.
 package gitstore
 
 import (
+	"context"
 	"flag"
 	"fmt"
+	"io/ioutil"
+	"os"
 	"path/filepath"
+	"strings"
 	"sync"
 
 	"github.com/golang/glog"
 	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
 	"gopkg.in/src-d/go-git.v4/plumbing/transport"
 	transportHTTP "gopkg.in/src-d/go-git.v4/plumbing/transport/http"
 	transportSSH "gopkg.in/src-d/go-git.v4/plumbing/transport/ssh"
@@ -33,6 +38,7 @@ var (
 // RepoStore manages a collection of git repositories.
 type RepoStore struct {
 	repositories map[string]*AsyncRepoCloner
+	watchers     []*Watcher
 	mutex        sync.RWMutex
 	repoDir      string
 }
@@ -47,18 +53,34 @@ func NewRepoStore(repoDir string) *RepoStore {
 }
 
 // GetAsync returns an AsyncRepoCloner that will retrieve a Repo in the background according to the RepoRef provided.
+// Repositories are cached by URL, so an error is returned if the repository is already cached with different
+// options, such as Depth or SparsePaths, or with a different SigningKey. A SigningKey given for a repository that is
+// cached without one is used for every later commit and tag created through it.
 func (rs *RepoStore) GetAsync(ref *RepoRef) (*AsyncRepoCloner, <-chan struct{}, error) {
 	err := ref.Validate()
 	if err != nil {
 		return nil, nil, fmt.Errorf("invalid repository reference: %v", err)
 	}
 
-	auth, err := rs.constructAuthMethod(ref)
+	auth, err := constructAuthMethod(ref)
 	if err != nil {
 		return nil, nil, fmt.Errorf("unable to construct repository authentication: %v", err)
 	}
+	if len(ref.CABundle) > 0 {
+		err = registerCABundle(ref.URL, ref.CABundle)
+		if err != nil {
+			return nil, nil, fmt.Errorf("unable to register CA bundle: %v", err)
+		}
+	}
 
 	returnRC := func(rc *AsyncRepoCloner) (*AsyncRepoCloner, <-chan struct{}, error) {
+		if option := rc.RepoRef.differingOption(ref); option != "" {
+			return nil, nil, fmt.Errorf("repository %s is already in use with a different %s", ref.URL, option)
+		}
+		err := rc.setSigningKey(ref.SigningKey)
+		if err != nil {
+			return nil, nil, err
+		}
 		if rc.Repo != nil {
 			rc.Repo.setAuth(auth)
 		}
@@ -96,9 +118,10 @@ func (rs *RepoStore) GetAsync(ref *RepoRef) (*AsyncRepoCloner, <-chan struct{},
 		repoDir = filepath.Join(rs.repoDir, ref.URL)
 	}
 	rc := &AsyncRepoCloner{
-		RepoRef: ref,
-		mutex:   sync.Mutex{},
-		repoDir: repoDir,
+		RepoRef:    ref,
+		mutex:      sync.Mutex{},
+		repoDir:    repoDir,
+		signingKey: ref.SigningKey,
 	}
 
 	rs.repositories[ref.URL] = rc
@@ -124,21 +147,71 @@ func (rs *RepoStore) Get(ref *RepoRef) (*Repo, error) {
 	}
 }
 
-func (rs *RepoStore) constructAuthMethod(ref *RepoRef) (transport.AuthMethod, error) {
+// Refresh immediately fetches every cached repository that refers to the same repository as url,
+// and notifies Watchers created from this RepoStore of any references that moved.
+// URLs are compared by host and path, so SSH and HTTP URLs for the same repository match.
+// It returns the number of repositories that were refreshed.
+func (rs *RepoStore) Refresh(ctx context.Context, url string) (int, error) {
+	canonical := canonicalURL(url)
+
+	rs.mutex.RLock()
+	repos := make(map[string]*Repo)
+	for repoURL, rc := range rs.repositories {
+		if canonicalURL(repoURL) != canonical {
+			continue
+		}
+		rc.mutex.Lock()
+		if rc.Repo != nil {
+			repos[repoURL] = rc.Repo
+		}
+		rc.mutex.Unlock()
+	}
+	watchers := make([]*Watcher, len(rs.watchers))
+	copy(watchers, rs.watchers)
+	rs.mutex.RUnlock()
+
+	var errs []string
+	refreshed := 0
+	for repoURL, repo := range repos {
+		err := repo.FetchContext(ctx)
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %v", repoURL, err))
+			continue
+		}
+		refreshed++
+		for _, w := range watchers {
+			w.notify(w.subscriptionsFor(repoURL))
+		}
+	}
+
+	if len(errs) > 0 {
+		return refreshed, fmt.Errorf("unable to refresh repositories: %s", strings.Join(errs, ", "))
+	}
+	return refreshed, nil
+}
+
+func constructAuthMethod(ref *RepoRef) (transport.AuthMethod, error) {
 	if ref.urlType == sshURL {
-		return rs.constructSSHAuthMethod(ref)
+		return constructSSHAuthMethod(ref)
 	} else if ref.urlType == httpURL {
-		return rs.constructHTTPAuthMethod(ref)
+		return constructHTTPAuthMethod(ref)
 	}
 	return nil, nil
 }
 
-func (rs *RepoStore) constructSSHAuthMethod(ref *RepoRef) (transport.AuthMethod, error) {
+func constructSSHAuthMethod(ref *RepoRef) (transport.AuthMethod, error) {
 	auth, err := transportSSH.NewPublicKeys(ref.User, ref.PrivateKey, ref.Pass)
 	if err != nil {
 		return nil, fmt.Errorf("unable to parse private key: %v", err)
 	}
 
+	if len(ref.KnownHosts) > 0 {
+		auth.HostKeyCallback, err = knownHostsCallback(ref.KnownHosts)
+		if err != nil {
+			return nil, fmt.Errorf("unable to parse known hosts: %v", err)
+		}
+	}
+
 	// Ignore host key validation for upstream servers
 	if *insecureIgnoreHostKey {
 		auth.HostKeyCallback = ssh.InsecureIgnoreHostKey()
@@ -146,7 +219,25 @@ func (rs *RepoStore) constructSSHAuthMethod(ref *RepoRef) (transport.AuthMethod,
 	return auth, nil
 }
 
-func (rs *RepoStore) constructHTTPAuthMethod(ref *RepoRef) (transport.AuthMethod, error) {
+// knownHostsCallback constructs a HostKeyCallback that verifies host keys
+// against the contents of a known_hosts file
+func knownHostsCallback(knownHosts []byte) (ssh.HostKeyCallback, error) {
+	// The knownhosts package only reads from files
+	file, err := ioutil.TempFile("", "known_hosts")
+	if err != nil {
+		return nil, fmt.Errorf("unable to create temporary file: %v", err)
+	}
+	defer os.Remove(file.Name())
+	defer file.Close()
+
+	_, err = file.Write(knownHosts)
+	if err != nil {
+		return nil, fmt.Errorf("unable to write temporary file: %v", err)
+	}
+	return knownhosts.New(file.Name())
+}
+
+func constructHTTPAuthMethod(ref *RepoRef) (transport.AuthMethod, error) {
 	auth := &transportHTTP.BasicAuth{
 		Username: ref.User,
 		Password: ref.Pass,
@@ -20,8 +20,18 @@ import (
 
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
+	"golang.org/x/crypto/openpgp"
 )
 
+// uncomparableSigningKey is a SigningKey which panics if compared with ==
+type uncomparableSigningKey struct {
+	payloads []string
+}
+
+func (k uncomparableSigningKey) Sign(payload []byte) (string, error) {
+	return "", nil
+}
+
 var _ = Describe("GitStore", func() {
 
 	Context("When able to clone repo without error", func() {
@@ -56,6 +66,64 @@ var _ = Describe("GitStore", func() {
 		})
 	})
 
+	Context("When a repository is already cached", func() {
+		var rs *RepoStore
+
+		BeforeEach(func() {
+			rs = NewRepoStore("")
+			_, err := rs.Get(&RepoRef{
+				URL: repositoryURL,
+			})
+			Expect(err).ToNot(HaveOccurred())
+		})
+
+		It("Should reuse the repository for the same options", func() {
+			first, err := rs.Get(&RepoRef{URL: repositoryURL})
+			Expect(err).ToNot(HaveOccurred())
+			second, err := rs.Get(&RepoRef{URL: repositoryURL})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(second).To(BeIdenticalTo(first))
+		})
+
+		It("Should refuse a RepoRef with different options", func() {
+			_, err := rs.Get(&RepoRef{URL: repositoryURL, Depth: 1})
+			Expect(err).To(MatchError(ContainSubstring("different Depth")))
+			_, err = rs.Get(&RepoRef{URL: repositoryURL, SparsePaths: []string{"json/*"}})
+			Expect(err).To(MatchError(ContainSubstring("different SparsePaths")))
+			_, err = rs.Get(&RepoRef{URL: repositoryURL, IgnoreFiles: true})
+			Expect(err).To(MatchError(ContainSubstring("different IgnoreFiles")))
+		})
+
+		It("Should keep the signing key of the repository", func() {
+			entity, err := openpgp.NewEntity("Git Store", "", "git-store@example.com", nil)
+			Expect(err).ToNot(HaveOccurred())
+			key := NewOpenPGPSigningKey(entity)
+			first, err := rs.Get(&RepoRef{URL: repositoryURL, SigningKey: key})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(first.signingKey).To(BeIdenticalTo(key))
+
+			// The same key material is accepted even if the SigningKey is constructed again
+			_, err = rs.Get(&RepoRef{URL: repositoryURL, SigningKey: NewOpenPGPSigningKey(entity)})
+			Expect(err).ToNot(HaveOccurred())
+
+			other, err := openpgp.NewEntity("Other", "", "other@example.com", nil)
+			Expect(err).ToNot(HaveOccurred())
+			_, err = rs.Get(&RepoRef{URL: repositoryURL, SigningKey: NewOpenPGPSigningKey(other)})
+			Expect(err).To(MatchError(ContainSubstring("different SigningKey")))
+
+			second, err := rs.Get(&RepoRef{URL: repositoryURL})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(second.signingKey).To(BeIdenticalTo(key))
+		})
+
+		It("Should not panic comparing signing keys which are not comparable", func() {
+			_, err := rs.Get(&RepoRef{URL: repositoryURL, SigningKey: uncomparableSigningKey{}})
+			Expect(err).ToNot(HaveOccurred())
+			_, err = rs.Get(&RepoRef{URL: repositoryURL, SigningKey: uncomparableSigningKey{}})
+			Expect(err).To(MatchError(ContainSubstring("different SigningKey")))
+		})
+	})
+
 	Context("When cloning into a directory", func() {
 		var rs *RepoStore
 		var tmpDir string
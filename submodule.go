@@ -0,0 +1,295 @@
+/*
+Copyright 2018 Pusher Ltd.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package gitstore
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"path"
+	"path/filepath"
+	"strings"
+
+	git "gopkg.in/src-d/go-git.v4"
+	"gopkg.in/src-d/go-git.v4/config"
+	"gopkg.in/src-d/go-git.v4/plumbing"
+	"gopkg.in/src-d/go-git.v4/plumbing/filemode"
+	"gopkg.in/src-d/go-git.v4/plumbing/object"
+	"gopkg.in/src-d/go-git.v4/plumbing/transport"
+)
+
+const gitModulesFile = ".gitmodules"
+
+// CredentialsFunc returns the credentials used to clone the submodule at url.
+// Only the credential fields of the returned RepoRef are used.
+// If it returns nil, the credentials of the parent repository are used if the submodule is on the same host,
+// otherwise the submodule is cloned without credentials.
+type CredentialsFunc func(url string) (*RepoRef, error)
+
+// updateSubmodules checks out the submodules of the HEAD commit at the
+// commits it records, cloning any submodules not yet present.
+//
+// Submodules are cloned as bare repositories as all reads go through commit
+// objects.
+func (r *Repo) updateSubmodules(ctx context.Context) error {
+	commit, err := r.getHeadCommit()
+	if err != nil {
+		return fmt.Errorf("unable to fetch HEAD commit: %v", err)
+	}
+	modules, err := readGitModules(commit)
+	if err != nil {
+		return err
+	}
+	tree, err := commit.Tree()
+	if err != nil {
+		return fmt.Errorf("unable to fetch commit tree: %v", err)
+	}
+
+	r.mutex.RLock()
+	existing := r.submodules
+	parentURL := r.options.clone.URL
+	r.mutex.RUnlock()
+
+	submodules := make(map[string]*Repo)
+	for _, module := range modules.Submodules {
+		if module.Path == "" || module.URL == "" {
+			continue
+		}
+		if !validSubmoduleName(module.Name) {
+			return fmt.Errorf("invalid submodule name %q", module.Name)
+		}
+		entry, err := tree.FindEntry(module.Path)
+		if err != nil || entry.Mode != filemode.Submodule {
+			// Not checked in at this commit
+			continue
+		}
+
+		moduleURL, err := resolveSubmoduleURL(parentURL, module.URL)
+		if err != nil {
+			return fmt.Errorf("unable to resolve URL of submodule %s: %v", module.Name, err)
+		}
+		sub, ok := existing[module.Path]
+		if !ok || sub.options.clone.URL != moduleURL {
+			sub, err = r.cloneSubmodule(ctx, module, moduleURL)
+			if err != nil {
+				return fmt.Errorf("unable to clone submodule %s: %v", module.Name, err)
+			}
+		}
+
+		err = sub.checkoutSubmodule(ctx, entry.Hash)
+		if err != nil {
+			return fmt.Errorf("unable to checkout submodule %s: %v", module.Name, err)
+		}
+		submodules[module.Path] = sub
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.submodules = submodules
+	return nil
+}
+
+// readGitModules parses the .gitmodules file of the commit, returning no
+// submodules if the file does not exist
+func readGitModules(commit *object.Commit) (*config.Modules, error) {
+	modules := config.NewModules()
+	file, err := commit.File(gitModulesFile)
+	if err == object.ErrFileNotFound {
+		return modules, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to load %s: %v", gitModulesFile, err)
+	}
+
+	contents, err := file.Contents()
+	if err != nil {
+		return nil, fmt.Errorf("unable to read %s: %v", gitModulesFile, err)
+	}
+	err = modules.Unmarshal([]byte(contents))
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse %s: %v", gitModulesFile, err)
+	}
+	return modules, nil
+}
+
+// validSubmoduleName checks that the name of a submodule, which names the
+// directory it is cloned into, cannot escape the directory of submodules
+func validSubmoduleName(name string) bool {
+	if name == "" || filepath.IsAbs(name) || path.IsAbs(name) {
+		return false
+	}
+	for _, part := range strings.FieldsFunc(name, func(r rune) bool { return r == '/' || r == '\\' }) {
+		if part == ".." {
+			return false
+		}
+	}
+	return true
+}
+
+// cloneSubmodule clones the repository of a submodule
+func (r *Repo) cloneSubmodule(ctx context.Context, module *config.Submodule, moduleURL string) (*Repo, error) {
+	auth, err := r.submoduleAuth(moduleURL)
+	if err != nil {
+		return nil, fmt.Errorf("unable to construct submodule authentication: %v", err)
+	}
+
+	var repoDir string
+	if r.options.repoDir != "" {
+		repoDir = filepath.Join(fmt.Sprintf("%s.modules", r.options.repoDir), module.Name)
+	}
+	options := &git.CloneOptions{
+		URL:  moduleURL,
+		Auth: auth,
+		Tags: git.NoTags,
+	}
+	repository, err := cloneRepository(ctx, repoDir, true, options)
+	if err != nil {
+		return nil, err
+	}
+	err = cleanNewRepo(repository, nil)
+	if err != nil {
+		return nil, fmt.Errorf("unable to clean new repo: %v", err)
+	}
+
+	return newRepo(repository, auth, repoOptions{
+		clone:       options,
+		repoDir:     repoDir,
+		submodules:  true,
+		credentials: r.options.credentials,
+	}), nil
+}
+
+// checkoutSubmodule moves the submodule to the commit recorded by its parent,
+// fetching if the commit is not yet known, and updates its own submodules
+func (r *Repo) checkoutSubmodule(ctx context.Context, hash plumbing.Hash) error {
+	r.mutex.RLock()
+	_, err := r.repository.CommitObject(hash)
+	r.mutex.RUnlock()
+	if err == plumbing.ErrObjectNotFound {
+		err = r.FetchContext(ctx)
+		if err != nil {
+			return err
+		}
+	}
+	return r.checkoutHash(ctx, hash)
+}
+
+// submoduleAuth constructs the auth method for a submodule URL, falling back
+// to the auth of the parent repository for submodules on the same host.
+// The parent's credentials are never sent to other hosts, which the
+// repository's .gitmodules could otherwise name to collect them
+func (r *Repo) submoduleAuth(moduleURL string) (transport.AuthMethod, error) {
+	r.mutex.RLock()
+	var auth transport.AuthMethod
+	if sameHost(r.options.clone.URL, moduleURL) {
+		auth = r.auth
+	}
+	r.mutex.RUnlock()
+	if r.options.credentials == nil {
+		return auth, nil
+	}
+
+	credentials, err := r.options.credentials(moduleURL)
+	if err != nil {
+		return nil, fmt.Errorf("unable to get credentials: %v", err)
+	}
+	if credentials == nil {
+		return auth, nil
+	}
+
+	ref := &RepoRef{
+		URL:        moduleURL,
+		User:       credentials.User,
+		Pass:       credentials.Pass,
+		PrivateKey: credentials.PrivateKey,
+		KnownHosts: credentials.KnownHosts,
+		CABundle:   credentials.CABundle,
+	}
+	err = ref.Validate()
+	if err != nil {
+		return nil, fmt.Errorf("invalid credentials: %v", err)
+	}
+	if len(ref.CABundle) > 0 {
+		err = registerCABundle(ref.URL, ref.CABundle)
+		if err != nil {
+			return nil, fmt.Errorf("unable to register CA bundle: %v", err)
+		}
+	}
+	return constructAuthMethod(ref)
+}
+
+// resolveSubmoduleURL resolves submodule URLs relative to the URL of the
+// parent repository, as git does for URLs starting with ./ or ../.
+// Absolute URLs must use a network protocol, unless the parent repository is
+// itself local, so that a repository cannot read files from the host
+func resolveSubmoduleURL(parentURL, moduleURL string) (string, error) {
+	if !strings.HasPrefix(moduleURL, "./") && !strings.HasPrefix(moduleURL, "../") {
+		switch urlLocation(moduleURL) {
+		case networkURL:
+		case localURL:
+			if urlLocation(parentURL) != localURL {
+				return "", fmt.Errorf("local URL %s is not allowed for a remote repository", moduleURL)
+			}
+		default:
+			return "", fmt.Errorf("unsupported URL %s", moduleURL)
+		}
+		return moduleURL, nil
+	}
+
+	u, err := url.Parse(parentURL)
+	if err == nil && u.Scheme != "" {
+		u.Path = path.Join(u.Path, moduleURL)
+		return u.String(), nil
+	}
+	if scpLikeURLRegex.MatchString(parentURL) {
+		i := strings.Index(parentURL, ":")
+		return fmt.Sprintf("%s:%s", parentURL[:i], path.Join(parentURL[i+1:], moduleURL)), nil
+	}
+	return "", fmt.Errorf("unable to resolve %s relative to %s", moduleURL, parentURL)
+}
+
+// location is where a repository URL points
+type location int
+
+const (
+	unsupportedURL location = iota
+	networkURL
+	localURL
+)
+
+// urlLocation determines whether the URL is fetched over the network or from
+// the local filesystem
+func urlLocation(rawURL string) location {
+	// Git runs the remote helper named before :: such as ext::<command>
+	if strings.Contains(rawURL, "::") {
+		return unsupportedURL
+	}
+	u, err := url.Parse(rawURL)
+	if err == nil {
+		switch strings.ToLower(u.Scheme) {
+		case "http", "https", "ssh", "git", "git+ssh", "ssh+git":
+			return networkURL
+		case "file":
+			return localURL
+		}
+		if strings.Contains(rawURL, "://") {
+			return unsupportedURL
+		}
+	}
+	// Single letter hosts are Windows drives, eg. C:\repo
+	if matches := scpLikeURLRegex.FindStringSubmatch(rawURL); matches != nil && len(matches[1]) > 1 {
+		return networkURL
+	}
+	return localURL
+}
@@ -0,0 +1,197 @@
+/*
+Copyright 2018 Pusher Ltd.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package gitstore
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	git "gopkg.in/src-d/go-git.v4"
+	"gopkg.in/src-d/go-git.v4/plumbing/transport"
+	transportHTTP "gopkg.in/src-d/go-git.v4/plumbing/transport/http"
+)
+
+var _ = Describe("GitStore", func() {
+
+	Context("When resolving submodule URLs", func() {
+		for parent, expected := range map[string]string{
+			"https://github.com/org/repo":   "https://github.com/org/lib.git",
+			"file:///tmp/repo":              "file:///tmp/lib.git",
+			"git@github.com:org/repo.git":   "git@github.com:org/lib.git",
+			"ssh://git@github.com/org/repo": "ssh://git@github.com/org/lib.git",
+		} {
+			parent, expected := parent, expected
+			It(fmt.Sprintf("Should resolve ../lib.git relative to %s", parent), func() {
+				Expect(resolveSubmoduleURL(parent, "../lib.git")).To(Equal(expected))
+			})
+		}
+
+		It("Should leave absolute URLs unchanged", func() {
+			Expect(resolveSubmoduleURL("https://github.com/org/repo", "https://example.com/lib")).To(Equal("https://example.com/lib"))
+			Expect(resolveSubmoduleURL("https://github.com/org/repo", "git@example.com:org/lib.git")).To(Equal("git@example.com:org/lib.git"))
+			Expect(resolveSubmoduleURL("file:///tmp/repo", "/tmp/lib")).To(Equal("/tmp/lib"))
+		})
+
+		for _, moduleURL := range []string{"file:///etc", "/etc", "C:\\Windows", "ext::sh -c touch /tmp/pwned", "ftp://example.com/lib"} {
+			moduleURL := moduleURL
+			It(fmt.Sprintf("Should reject %s for a remote repository", moduleURL), func() {
+				_, err := resolveSubmoduleURL("https://github.com/org/repo", moduleURL)
+				Expect(err).To(HaveOccurred())
+			})
+		}
+	})
+
+	Context("When validating submodule names", func() {
+		for _, name := range []string{"lib", "libs/sub", "..lib"} {
+			name := name
+			It(fmt.Sprintf("Should allow %s", name), func() {
+				Expect(validSubmoduleName(name)).To(BeTrue())
+			})
+		}
+
+		for _, name := range []string{"", "/tmp/lib", "../lib", "libs/../../lib", "libs\\..\\..\\lib"} {
+			name := name
+			It(fmt.Sprintf("Should reject %s", name), func() {
+				Expect(validSubmoduleName(name)).To(BeFalse())
+			})
+		}
+	})
+
+	Context("When authenticating submodules", func() {
+		var parent *Repo
+		var auth transport.AuthMethod
+
+		BeforeEach(func() {
+			auth = &transportHTTP.BasicAuth{Username: "user", Password: "secret"}
+			parent = newRepo(nil, auth, repoOptions{
+				clone: &git.CloneOptions{URL: "https://github.com/org/repo"},
+			})
+		})
+
+		It("Should use the parent credentials for submodules on the same host", func() {
+			Expect(parent.submoduleAuth("git@github.com:org/lib.git")).To(Equal(auth))
+		})
+
+		It("Should not send the parent credentials to other hosts", func() {
+			Expect(parent.submoduleAuth("https://example.com/org/lib")).To(BeNil())
+		})
+
+		It("Should not send the parent credentials to other hosts when no credentials are provided", func() {
+			parent.options.credentials = func(url string) (*RepoRef, error) {
+				return nil, nil
+			}
+			Expect(parent.submoduleAuth("https://example.com/org/lib")).To(BeNil())
+		})
+	})
+
+	Context("When cloning a repository with submodules", func() {
+		var repositoryDir, submoduleDir string
+		var repoRef *RepoRef
+
+		commitSubmoduleFile := func(content string) string {
+			err := ioutil.WriteFile(filepath.Join(submoduleDir, "lib.txt"), []byte(content), 0644)
+			Expect(err).ToNot(HaveOccurred())
+			runGit(submoduleDir, "add", "lib.txt")
+			runGit(submoduleDir, "commit", "-m", "Update lib.txt")
+			return runGit(submoduleDir, "rev-parse", "HEAD")
+		}
+
+		BeforeEach(func() {
+			repositoryDir = setupRepository()
+			var err error
+			submoduleDir, err = ioutil.TempDir("", "git-store-submodule")
+			Expect(err).ToNot(HaveOccurred())
+			runGit(submoduleDir, "init")
+			commitSubmoduleFile("first\n")
+
+			runGit(repositoryDir, "-c", "protocol.file.allow=always", "submodule", "add", submoduleDir, "libs/sub")
+			// Relative URLs are resolved against the URL of the parent repository
+			runGit(repositoryDir, "config", "-f", ".gitmodules", "submodule.libs/sub.url", fmt.Sprintf("../%s", filepath.Base(submoduleDir)))
+			runGit(repositoryDir, "add", ".gitmodules")
+			runGit(repositoryDir, "commit", "-m", "Add submodule")
+
+			repoRef = &RepoRef{
+				URL:        fmt.Sprintf("file://%s", repositoryDir),
+				Submodules: true,
+			}
+		})
+
+		AfterEach(func() {
+			teardownRepository(repositoryDir)
+			os.RemoveAll(submoduleDir)
+		})
+
+		It("Should include the files of submodules in GetAllFiles", func() {
+			repo, err := NewRepoStore("").Get(repoRef)
+			Expect(err).ToNot(HaveOccurred())
+
+			files, err := repo.GetAllFiles("", false)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(files).To(HaveKey("libs/sub/lib.txt"))
+			Expect(files["libs/sub/lib.txt"].Contents()).To(Equal("first\n"))
+			Expect(files).To(HaveKey("LICENSE"))
+		})
+
+		It("Should filter submodule files by subPath", func() {
+			repo, err := NewRepoStore("").Get(repoRef)
+			Expect(err).ToNot(HaveOccurred())
+
+			files, err := repo.GetAllFiles("libs/**", false)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(files).To(HaveLen(1))
+		})
+
+		It("Should update submodules when checking out", func() {
+			repo, err := NewRepoStore("").Get(repoRef)
+			Expect(err).ToNot(HaveOccurred())
+
+			hash := commitSubmoduleFile("second\n")
+			checkoutDir := filepath.Join(repositoryDir, "libs", "sub")
+			runGit(checkoutDir, "-c", "protocol.file.allow=always", "fetch", "origin")
+			runGit(checkoutDir, "checkout", hash)
+			runGit(repositoryDir, "add", "libs/sub")
+			runGit(repositoryDir, "commit", "-m", "Update submodule")
+
+			Expect(repo.Checkout("master")).To(Succeed())
+			files, err := repo.GetAllFiles("", false)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(files["libs/sub/lib.txt"].Contents()).To(Equal("second\n"))
+		})
+
+		It("Should not include submodule files unless enabled", func() {
+			repoRef.Submodules = false
+			repo, err := NewRepoStore("").Get(repoRef)
+			Expect(err).ToNot(HaveOccurred())
+
+			files, err := repo.GetAllFiles("", false)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(files).ToNot(HaveKey("libs/sub/lib.txt"))
+		})
+
+		It("Should request credentials for each submodule", func() {
+			requested := []string{}
+			repoRef.SubmoduleCredentials = func(url string) (*RepoRef, error) {
+				requested = append(requested, url)
+				return nil, nil
+			}
+			_, err := NewRepoStore("").Get(repoRef)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(requested).To(ConsistOf(fmt.Sprintf("file://%s", submoduleDir)))
+		})
+	})
+})
@@ -0,0 +1,173 @@
+/*
+Copyright 2018 Pusher Ltd.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package gitstore
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sync"
+
+	"gopkg.in/src-d/go-git.v4/plumbing/transport"
+	"gopkg.in/src-d/go-git.v4/plumbing/transport/client"
+	transportHTTP "gopkg.in/src-d/go-git.v4/plumbing/transport/http"
+)
+
+// hostTransport is an http.RoundTripper that verifies servers against the
+// certificate authorities registered for their host, using the default
+// transport for any other host.
+//
+// Go Git only supports a single HTTP client per protocol, and does not pass
+// the context of a fetch to every request, so CA bundles cannot be scoped to
+// a single repository. Instead every bundle registered for a host is trusted
+// for that host, so registering a bundle never removes trust another
+// repository on the host relies on.
+//
+// Registering a bundle installs a Go Git https client for the whole process,
+// including code outside this package. It only handles the hosts with
+// registered bundles, and passes every other host to the https client that
+// was installed before it.
+type hostTransport struct {
+	transports map[string]*caTransport
+	mutex      sync.RWMutex
+}
+
+// caTransport is the transport for a single host along with the bundles it
+// trusts
+type caTransport struct {
+	transport *http.Transport
+	bundles   [][]byte
+	digests   map[[sha256.Size]byte]bool
+}
+
+// hostClient is a Go Git transport that uses the CA bundle client for hosts
+// with registered bundles, and the fallback client for all other hosts
+type hostClient struct {
+	ca       transport.Transport
+	fallback transport.Transport
+}
+
+var (
+	httpsTransport = &hostTransport{
+		transports: make(map[string]*caTransport),
+	}
+	installHTTPSTransport sync.Once
+)
+
+// registerCABundle trusts the PEM encoded certificate authorities, in
+// addition to the system roots and any bundles already registered, for the
+// host of the repository URL.
+// The existing transport, and its pooled connections, are kept if the bundle
+// is already registered
+func registerCABundle(repoURL string, bundle []byte) error {
+	u, err := url.Parse(repoURL)
+	if err != nil {
+		return fmt.Errorf("unable to parse URL: %v", err)
+	}
+	if !x509.NewCertPool().AppendCertsFromPEM(bundle) {
+		return fmt.Errorf("no certificates found in CA bundle")
+	}
+
+	installHTTPSTransport.Do(func() {
+		client.InstallProtocol("https", &hostClient{
+			ca:       transportHTTP.NewClient(&http.Client{Transport: httpsTransport}),
+			fallback: client.Protocols["https"],
+		})
+	})
+
+	digest := sha256.Sum256(bundle)
+	httpsTransport.mutex.Lock()
+	defer httpsTransport.mutex.Unlock()
+	existing, ok := httpsTransport.transports[u.Host]
+	if ok && existing.digests[digest] {
+		return nil
+	}
+
+	ca := &caTransport{
+		bundles: [][]byte{bundle},
+		digests: map[[sha256.Size]byte]bool{digest: true},
+	}
+	if ok {
+		ca.bundles = append(ca.bundles, existing.bundles...)
+		for d := range existing.digests {
+			ca.digests[d] = true
+		}
+	}
+
+	pool, err := x509.SystemCertPool()
+	if err != nil || pool == nil {
+		pool = x509.NewCertPool()
+	}
+	for _, b := range ca.bundles {
+		pool.AppendCertsFromPEM(b)
+	}
+	// Keep the proxy, dial, handshake and idle timeouts of the default
+	// transport
+	if defaultTransport, ok := http.DefaultTransport.(*http.Transport); ok {
+		ca.transport = defaultTransport.Clone()
+	} else {
+		ca.transport = &http.Transport{Proxy: http.ProxyFromEnvironment}
+	}
+	ca.transport.TLSClientConfig = &tls.Config{RootCAs: pool}
+
+	httpsTransport.transports[u.Host] = ca
+	if ok {
+		existing.transport.CloseIdleConnections()
+	}
+	return nil
+}
+
+// RoundTrip implements http.RoundTripper
+func (t *hostTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	t.mutex.RLock()
+	ca, ok := t.transports[req.URL.Host]
+	t.mutex.RUnlock()
+	if !ok {
+		return http.DefaultTransport.RoundTrip(req)
+	}
+	return ca.transport.RoundTrip(req)
+}
+
+// hasHost checks whether a CA bundle is registered for the host
+func (t *hostTransport) hasHost(host string) bool {
+	t.mutex.RLock()
+	defer t.mutex.RUnlock()
+	_, ok := t.transports[host]
+	return ok
+}
+
+// clientFor returns the client handling the endpoint
+func (c *hostClient) clientFor(ep *transport.Endpoint) transport.Transport {
+	host := ep.Host
+	if ep.Port != 0 {
+		host = fmt.Sprintf("%s:%d", ep.Host, ep.Port)
+	}
+	if c.fallback == nil || httpsTransport.hasHost(host) {
+		return c.ca
+	}
+	return c.fallback
+}
+
+// NewUploadPackSession implements transport.Transport
+func (c *hostClient) NewUploadPackSession(ep *transport.Endpoint, auth transport.AuthMethod) (transport.UploadPackSession, error) {
+	return c.clientFor(ep).NewUploadPackSession(ep, auth)
+}
+
+// NewReceivePackSession implements transport.Transport
+func (c *hostClient) NewReceivePackSession(ep *transport.Endpoint, auth transport.AuthMethod) (transport.ReceivePackSession, error) {
+	return c.clientFor(ep).NewReceivePackSession(ep, auth)
+}
@@ -0,0 +1,149 @@
+/*
+Copyright 2018 Pusher Ltd.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package gitstore
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"gopkg.in/src-d/go-git.v4/plumbing/transport"
+	"gopkg.in/src-d/go-git.v4/plumbing/transport/client"
+)
+
+var _ = Describe("GitStore", func() {
+
+	Context("When registering a CA bundle", func() {
+		var server *httptest.Server
+
+		BeforeEach(func() {
+			server = httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusOK)
+			}))
+		})
+
+		AfterEach(func() {
+			server.Close()
+		})
+
+		It("Should not trust the server by default", func() {
+			req, err := http.NewRequest(http.MethodGet, server.URL, nil)
+			Expect(err).ToNot(HaveOccurred())
+			_, err = httpsTransport.RoundTrip(req)
+			Expect(err).To(HaveOccurred())
+		})
+
+		It("Should trust the server once its CA is registered", func() {
+			bundle := pem.EncodeToMemory(&pem.Block{
+				Type:  "CERTIFICATE",
+				Bytes: server.Certificate().Raw,
+			})
+			Expect(registerCABundle(server.URL, bundle)).To(Succeed())
+
+			req, err := http.NewRequest(http.MethodGet, server.URL, nil)
+			Expect(err).ToNot(HaveOccurred())
+			resp, err := httpsTransport.RoundTrip(req)
+			Expect(err).ToNot(HaveOccurred())
+			defer resp.Body.Close()
+			Expect(resp.StatusCode).To(Equal(http.StatusOK))
+		})
+
+		It("Should reuse the transport when the bundle is already registered", func() {
+			bundle := pem.EncodeToMemory(&pem.Block{
+				Type:  "CERTIFICATE",
+				Bytes: server.Certificate().Raw,
+			})
+			Expect(registerCABundle(server.URL, bundle)).To(Succeed())
+			host := server.Listener.Addr().String()
+			transport := httpsTransport.transports[host].transport
+
+			Expect(registerCABundle(server.URL, bundle)).To(Succeed())
+			Expect(httpsTransport.transports[host].transport).To(BeIdenticalTo(transport))
+		})
+
+		It("Should keep trusting earlier bundles for the host", func() {
+			key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+			Expect(err).ToNot(HaveOccurred())
+			template := &x509.Certificate{
+				SerialNumber:          big.NewInt(1),
+				Subject:               pkix.Name{CommonName: "Other CA"},
+				NotBefore:             time.Now(),
+				NotAfter:              time.Now().Add(time.Hour),
+				IsCA:                  true,
+				BasicConstraintsValid: true,
+			}
+			otherCA, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+			Expect(err).ToNot(HaveOccurred())
+
+			Expect(registerCABundle(server.URL, pem.EncodeToMemory(&pem.Block{
+				Type:  "CERTIFICATE",
+				Bytes: server.Certificate().Raw,
+			}))).To(Succeed())
+			Expect(registerCABundle(server.URL, pem.EncodeToMemory(&pem.Block{
+				Type:  "CERTIFICATE",
+				Bytes: otherCA,
+			}))).To(Succeed())
+			Expect(httpsTransport.transports[server.Listener.Addr().String()].bundles).To(HaveLen(2))
+
+			req, err := http.NewRequest(http.MethodGet, server.URL, nil)
+			Expect(err).ToNot(HaveOccurred())
+			resp, err := httpsTransport.RoundTrip(req)
+			Expect(err).ToNot(HaveOccurred())
+			defer resp.Body.Close()
+			Expect(resp.StatusCode).To(Equal(http.StatusOK))
+		})
+
+		It("Should keep the timeouts of the default transport", func() {
+			bundle := pem.EncodeToMemory(&pem.Block{
+				Type:  "CERTIFICATE",
+				Bytes: server.Certificate().Raw,
+			})
+			Expect(registerCABundle(server.URL, bundle)).To(Succeed())
+			transport := httpsTransport.transports[server.Listener.Addr().String()].transport
+			defaultTransport := http.DefaultTransport.(*http.Transport)
+			Expect(transport.TLSHandshakeTimeout).To(Equal(defaultTransport.TLSHandshakeTimeout))
+			Expect(transport.IdleConnTimeout).To(Equal(defaultTransport.IdleConnTimeout))
+		})
+
+		It("Should leave hosts without bundles to the previous https client", func() {
+			bundle := pem.EncodeToMemory(&pem.Block{
+				Type:  "CERTIFICATE",
+				Bytes: server.Certificate().Raw,
+			})
+			Expect(registerCABundle(server.URL, bundle)).To(Succeed())
+			installed, ok := client.Protocols["https"].(*hostClient)
+			Expect(ok).To(BeTrue())
+
+			ep, err := transport.NewEndpoint(server.URL + "/org/repo")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(installed.clientFor(ep)).To(BeIdenticalTo(installed.ca))
+			ep, err = transport.NewEndpoint("https://example.com/org/repo")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(installed.clientFor(ep)).To(BeIdenticalTo(installed.fallback))
+		})
+
+		It("Should reject a bundle without certificates", func() {
+			Expect(registerCABundle("https://example.com/org/repo", []byte("not a certificate"))).ToNot(Succeed())
+		})
+	})
+})
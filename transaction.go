@@ -0,0 +1,536 @@
+/*
+Copyright 2018 Pusher Ltd.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package gitstore
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+
+	git "gopkg.in/src-d/go-git.v4"
+	"gopkg.in/src-d/go-git.v4/config"
+	"gopkg.in/src-d/go-git.v4/plumbing"
+	"gopkg.in/src-d/go-git.v4/plumbing/filemode"
+	"gopkg.in/src-d/go-git.v4/plumbing/object"
+	"gopkg.in/src-d/go-git.v4/plumbing/storer"
+)
+
+// defaultPushRetries is the number of times a transaction is replayed onto a
+// remote branch that moved before Push gives up
+const defaultPushRetries = 3
+
+// Transaction collects changes to the files of a branch and commits and pushes them to the remote repository.
+//
+// Changes are applied to the commit objects directly, so transactions work for bare and sparse repositories
+// and do not affect the checked out worktree.
+type Transaction struct {
+	Force      bool // Force overwrites the remote branch if it moved, rather than replaying the changes onto it.
+	MaxRetries int  // MaxRetries is the number of times the changes are replayed onto a remote branch that moved, defaults to 3.
+
+	repo    *Repo
+	branch  string
+	base    plumbing.Hash      // base is the commit the changes are applied to.
+	changes map[string]*[]byte // changes contains the new content of each changed file, nil for deletions.
+	commit  plumbing.Hash      // commit is the commit created by Commit.
+	message string
+	author  object.Signature
+	mutex   sync.Mutex
+}
+
+// TransactionConflictError is returned by Push when files changed by the transaction were also changed on the
+// remote branch since the transaction began.
+type TransactionConflictError struct {
+	Branch string   // Branch is the branch the transaction was pushed to.
+	Paths  []string // Paths are the files changed both by the transaction and on the remote branch.
+}
+
+func (e *TransactionConflictError) Error() string {
+	return fmt.Sprintf("files changed on branch %s since the transaction began: %s", e.Branch, strings.Join(e.Paths, ", "))
+}
+
+// Begin starts a Transaction that changes files on the remote branch, as of the last fetch.
+func (r *Repo) Begin(branch string) (*Transaction, error) {
+	hash, err := r.remoteBranchHash(branch)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Transaction{
+		MaxRetries: defaultPushRetries,
+		repo:       r,
+		branch:     branch,
+		base:       hash,
+		changes:    make(map[string]*[]byte),
+	}, nil
+}
+
+// WriteFile sets the content of the file at path, creating it if it does not exist.
+// The mode of existing executable files is preserved.
+func (t *Transaction) WriteFile(path string, content []byte) error {
+	path, err := cleanTransactionPath(path)
+	if err != nil {
+		return err
+	}
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	data := append([]byte{}, content...)
+	t.changes[path] = &data
+	return nil
+}
+
+// DeleteFile removes the file at path.
+// It returns an error if the file does not exist on the branch.
+func (t *Transaction) DeleteFile(path string) error {
+	path, err := cleanTransactionPath(path)
+	if err != nil {
+		return err
+	}
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if data, ok := t.changes[path]; ok && data != nil {
+		// Deleting a file written in this transaction
+		t.changes[path] = nil
+		return nil
+	}
+	commit, err := t.repo.commitObject(t.base)
+	if err != nil {
+		return err
+	}
+	_, err = commit.File(path)
+	if err != nil {
+		return fmt.Errorf("unable to delete %s: %v", path, err)
+	}
+	t.changes[path] = nil
+	return nil
+}
+
+// Commit creates a commit containing the changes on top of the branch.
+// The author is also used as the committer.
+// If the RepoRef has a SigningKey, the commit is signed with it.
+// The commit is not visible to other readers of the Repo until it has been pushed.
+func (t *Transaction) Commit(message string, author object.Signature) (plumbing.Hash, error) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if len(t.changes) == 0 {
+		return plumbing.ZeroHash, fmt.Errorf("no changes to commit")
+	}
+
+	t.message = message
+	t.author = author
+	hash, err := t.repo.commitChanges(t.base, t.changes, message, author, true)
+	if err != nil {
+		return plumbing.ZeroHash, err
+	}
+	t.commit = hash
+	return hash, nil
+}
+
+// Push pushes the commit to the remote branch.
+//
+// If the remote branch has moved since the transaction began, the remote is fetched and
+// the changes are committed again on top of it, up to MaxRetries times.
+// If any file changed by the transaction was also changed on the remote branch, a *TransactionConflictError
+// is returned and nothing is pushed.
+// If Force is set, the remote branch is overwritten instead.
+func (t *Transaction) Push(ctx context.Context) error {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if t.commit.IsZero() {
+		return fmt.Errorf("no commit to push, Commit must be called before Push")
+	}
+
+	for attempt := 0; ; attempt++ {
+		err := t.repo.pushCommit(ctx, t.commit, t.branch, t.Force)
+		if err == nil {
+			return nil
+		}
+		if t.Force || attempt >= t.MaxRetries {
+			return fmt.Errorf("unable to push to branch %s: %v", t.branch, err)
+		}
+		moved, movedErr := t.repo.remoteBranchMoved(ctx, t.branch, t.base)
+		if movedErr != nil || !moved {
+			return fmt.Errorf("unable to push to branch %s: %v", t.branch, err)
+		}
+
+		err = t.replay(ctx)
+		if _, ok := err.(*TransactionConflictError); ok {
+			return err
+		}
+		if err != nil {
+			return fmt.Errorf("unable to replay changes: %v", err)
+		}
+	}
+}
+
+// replay fetches the remote and commits the changes again on top of the
+// current remote branch, provided none of the changed files were changed on
+// the remote branch.
+// If the remote branch already contains the changes no commit is created and
+// the remote branch itself is pushed, which leaves it unchanged
+func (t *Transaction) replay(ctx context.Context) error {
+	err := t.repo.FetchContext(ctx)
+	if err != nil {
+		return err
+	}
+	base, err := t.repo.remoteBranchHash(t.branch)
+	if err != nil {
+		return err
+	}
+
+	oldTree, err := t.repo.commitTree(t.base)
+	if err != nil {
+		return err
+	}
+	newTree, err := t.repo.commitTree(base)
+	if err != nil {
+		return err
+	}
+
+	changes := make(map[string]*[]byte)
+	conflicts := []string{}
+	for path, data := range t.changes {
+		oldEntry, oldErr := oldTree.FindEntry(path)
+		newEntry, newErr := newTree.FindEntry(path)
+		if oldErr != nil && newErr != nil {
+			changes[path] = data
+			continue
+		}
+		if oldErr == nil && newErr == nil && sameEntry(*oldEntry, true, *newEntry, true) {
+			changes[path] = data
+			continue
+		}
+		if data == nil && newErr != nil {
+			// Deleted on the remote branch too, so no longer needed
+			continue
+		}
+		conflicts = append(conflicts, path)
+	}
+	if len(conflicts) > 0 {
+		sort.Strings(conflicts)
+		return &TransactionConflictError{Branch: t.branch, Paths: conflicts}
+	}
+
+	hash, err := t.repo.commitChanges(base, changes, t.message, t.author, false)
+	if err != nil {
+		return err
+	}
+	t.base = base
+	t.commit = hash
+	return nil
+}
+
+// remoteBranchMoved checks whether the remote currently advertises the branch
+// at a commit other than base
+func (r *Repo) remoteBranchMoved(ctx context.Context, branch string, base plumbing.Hash) (bool, error) {
+	refs, err := r.ListRemoteRefs(ctx)
+	if err != nil {
+		return false, err
+	}
+	name := plumbing.NewBranchReferenceName(branch).String()
+	for _, ref := range refs {
+		if ref.Name == name {
+			return ref.Hash != base, nil
+		}
+	}
+	return false, nil
+}
+
+// remoteBranchHash returns the commit the remote branch pointed to as of the
+// last fetch
+func (r *Repo) remoteBranchHash(branch string) (plumbing.Hash, error) {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	ref, err := r.repository.Reference(plumbing.NewRemoteReferenceName(git.DefaultRemoteName, branch), true)
+	if err != nil {
+		return plumbing.ZeroHash, fmt.Errorf("unable to resolve branch %s: %v", branch, err)
+	}
+	return ref.Hash(), nil
+}
+
+// commitObject loads the commit with the given hash
+func (r *Repo) commitObject(hash plumbing.Hash) (*object.Commit, error) {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	commit, err := r.repository.CommitObject(hash)
+	if err != nil {
+		return nil, fmt.Errorf("unable to retrieve commit %s: %v", hash, err)
+	}
+	return commit, nil
+}
+
+// commitTree loads the tree of the commit with the given hash
+func (r *Repo) commitTree(hash plumbing.Hash) (*object.Tree, error) {
+	commit, err := r.commitObject(hash)
+	if err != nil {
+		return nil, err
+	}
+	tree, err := commit.Tree()
+	if err != nil {
+		return nil, fmt.Errorf("unable to fetch commit tree: %v", err)
+	}
+	return tree, nil
+}
+
+// commitChanges writes a commit applying the changes to the tree of the
+// parent commit. Unless allowEmpty is set, the parent is returned rather than
+// a commit that leaves its tree unchanged
+func (r *Repo) commitChanges(parent plumbing.Hash, changes map[string]*[]byte, message string, author object.Signature, allowEmpty bool) (plumbing.Hash, error) {
+	parentCommit, err := r.commitObject(parent)
+	if err != nil {
+		return plumbing.ZeroHash, err
+	}
+	tree, err := parentCommit.Tree()
+	if err != nil {
+		return plumbing.ZeroHash, fmt.Errorf("unable to fetch commit tree: %v", err)
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	s := r.repository.Storer
+	entries := make(map[string]*object.TreeEntry)
+	for path, data := range changes {
+		if data == nil {
+			entries[path] = nil
+			continue
+		}
+		blob, err := writeBlob(s, *data)
+		if err != nil {
+			return plumbing.ZeroHash, err
+		}
+		entries[path] = &object.TreeEntry{Hash: blob}
+	}
+
+	treeHash, _, err := writeTree(s, tree, entries)
+	if err != nil {
+		return plumbing.ZeroHash, fmt.Errorf("unable to write tree: %v", err)
+	}
+	if !allowEmpty && treeHash == tree.Hash {
+		return parent, nil
+	}
+	return r.writeCommit(treeHash, []plumbing.Hash{parent}, message, author)
+}
+
+// writeCommit writes a commit of the tree, signed if the Repo has a signing
+// key.
+//
+// Note: The caller must hold the write lock.
+func (r *Repo) writeCommit(tree plumbing.Hash, parents []plumbing.Hash, message string, author object.Signature) (plumbing.Hash, error) {
+	commit := &object.Commit{
+		Author:       author,
+		Committer:    author,
+		Message:      message,
+		TreeHash:     tree,
+		ParentHashes: parents,
+	}
+	if r.signingKey != nil {
+		err := signCommit(commit, r.signingKey)
+		if err != nil {
+			return plumbing.ZeroHash, fmt.Errorf("unable to sign commit: %v", err)
+		}
+	}
+	return writeObject(r.repository.Storer, commit)
+}
+
+// pushCommit pushes the commit to the remote branch and updates the remote
+// tracking branch to match
+func (r *Repo) pushCommit(ctx context.Context, commit plumbing.Hash, branch string, force bool) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	err := r.pushHash(ctx, commit, plumbing.NewBranchReferenceName(branch), force)
+	if err != nil {
+		return err
+	}
+
+	err = r.repository.Storer.SetReference(plumbing.NewHashReference(plumbing.NewRemoteReferenceName(git.DefaultRemoteName, branch), commit))
+	if err != nil {
+		return fmt.Errorf("unable to update remote branch: %v", err)
+	}
+	return nil
+}
+
+// pushHash points the remote reference at the object with the given hash.
+//
+// Note: The caller must hold the write lock.
+func (r *Repo) pushHash(ctx context.Context, hash plumbing.Hash, target plumbing.ReferenceName, force bool) error {
+	// Go Git can only push local references, so a temporary reference is
+	// created rather than a local branch, which would be resolved in place of
+	// the remote branch
+	source := plumbing.ReferenceName(fmt.Sprintf("refs/gitstore/push/%s", strings.TrimPrefix(target.String(), "refs/")))
+	err := r.repository.Storer.SetReference(plumbing.NewHashReference(source, hash))
+	if err != nil {
+		return fmt.Errorf("unable to create reference: %v", err)
+	}
+	defer r.repository.Storer.RemoveReference(source)
+
+	refSpec := fmt.Sprintf("%s:%s", source, target)
+	if force {
+		refSpec = fmt.Sprintf("+%s", refSpec)
+	}
+	return r.pushRefSpecs(ctx, config.RefSpec(refSpec))
+}
+
+// pushRefSpecs pushes the refspecs to origin.
+//
+// Note: The caller must hold the write lock.
+func (r *Repo) pushRefSpecs(ctx context.Context, refSpecs ...config.RefSpec) error {
+	err := r.repository.PushContext(ctx, &git.PushOptions{
+		RemoteName: git.DefaultRemoteName,
+		RefSpecs:   refSpecs,
+		Auth:       r.auth,
+	})
+	if err == git.NoErrAlreadyUpToDate {
+		return nil
+	}
+	return err
+}
+
+// cleanTransactionPath normalises a path within the repository
+func cleanTransactionPath(p string) (string, error) {
+	cleaned := path.Clean(strings.TrimPrefix(p, "/"))
+	if cleaned == "." || cleaned == ".." || strings.HasPrefix(cleaned, "../") {
+		return "", fmt.Errorf("invalid path %q", p)
+	}
+	return cleaned, nil
+}
+
+// writeTree writes a tree equal to base with the changes applied, where
+// changes are keyed by their path relative to the tree and nil changes
+// delete the path. Changes without a mode keep the mode of executable files.
+// It returns the hash of the new tree and whether it is empty.
+func writeTree(s storer.EncodedObjectStorer, base *object.Tree, changes map[string]*object.TreeEntry) (plumbing.Hash, bool, error) {
+	entries := make(map[string]object.TreeEntry)
+	if base != nil {
+		for _, entry := range base.Entries {
+			entries[entry.Name] = entry
+		}
+	}
+
+	// Group changes to files within subdirectories by the subdirectory
+	subChanges := make(map[string]map[string]*object.TreeEntry)
+	for p, change := range changes {
+		parts := strings.SplitN(p, "/", 2)
+		if len(parts) == 2 {
+			if subChanges[parts[0]] == nil {
+				subChanges[parts[0]] = make(map[string]*object.TreeEntry)
+			}
+			subChanges[parts[0]][parts[1]] = change
+			continue
+		}
+
+		if change == nil {
+			delete(entries, p)
+			continue
+		}
+		mode := change.Mode
+		if mode == filemode.Empty {
+			mode = filemode.Regular
+			if existing, ok := entries[p]; ok && existing.Mode == filemode.Executable {
+				mode = filemode.Executable
+			}
+		}
+		entries[p] = object.TreeEntry{Name: p, Mode: mode, Hash: change.Hash}
+	}
+
+	for name, changes := range subChanges {
+		var subBase *object.Tree
+		existing, ok := entries[name]
+		isDir := ok && existing.Mode == filemode.Dir
+		if isDir {
+			var err error
+			subBase, err = object.GetTree(s, existing.Hash)
+			if err != nil {
+				return plumbing.ZeroHash, false, fmt.Errorf("unable to load tree %s: %v", name, err)
+			}
+		}
+		hash, empty, err := writeTree(s, subBase, changes)
+		if err != nil {
+			return plumbing.ZeroHash, false, err
+		}
+		if empty {
+			// Only remove the directory, rather than a file replacing it
+			if isDir {
+				delete(entries, name)
+			}
+			continue
+		}
+		entries[name] = object.TreeEntry{Name: name, Mode: filemode.Dir, Hash: hash}
+	}
+
+	tree := &object.Tree{}
+	for _, entry := range entries {
+		tree.Entries = append(tree.Entries, entry)
+	}
+	sort.Slice(tree.Entries, func(i, j int) bool {
+		return treeEntrySortName(tree.Entries[i]) < treeEntrySortName(tree.Entries[j])
+	})
+
+	hash, err := writeObject(s, tree)
+	if err != nil {
+		return plumbing.ZeroHash, false, err
+	}
+	return hash, len(tree.Entries) == 0, nil
+}
+
+// treeEntrySortName returns the name git sorts tree entries by, which
+// includes a trailing slash for directories
+func treeEntrySortName(entry object.TreeEntry) string {
+	if entry.Mode == filemode.Dir {
+		return fmt.Sprintf("%s/", entry.Name)
+	}
+	return entry.Name
+}
+
+// writeBlob stores the content as a blob object
+func writeBlob(s storer.EncodedObjectStorer, content []byte) (plumbing.Hash, error) {
+	obj := s.NewEncodedObject()
+	obj.SetType(plumbing.BlobObject)
+	w, err := obj.Writer()
+	if err != nil {
+		return plumbing.ZeroHash, fmt.Errorf("unable to create blob: %v", err)
+	}
+	_, err = w.Write(content)
+	if err != nil {
+		w.Close()
+		return plumbing.ZeroHash, fmt.Errorf("unable to write blob: %v", err)
+	}
+	err = w.Close()
+	if err != nil {
+		return plumbing.ZeroHash, fmt.Errorf("unable to write blob: %v", err)
+	}
+	return s.SetEncodedObject(obj)
+}
+
+// encodable is implemented by the Go Git objects that can be stored
+type encodable interface {
+	Encode(plumbing.EncodedObject) error
+}
+
+// writeObject encodes the object into the storer
+func writeObject(s storer.EncodedObjectStorer, o encodable) (plumbing.Hash, error) {
+	obj := s.NewEncodedObject()
+	err := o.Encode(obj)
+	if err != nil {
+		return plumbing.ZeroHash, fmt.Errorf("unable to encode object: %v", err)
+	}
+	hash, err := s.SetEncodedObject(obj)
+	if err != nil {
+		return plumbing.ZeroHash, fmt.Errorf("unable to store object: %v", err)
+	}
+	return hash, nil
+}
@@ -0,0 +1,224 @@
+/*
+Copyright 2018 Pusher Ltd.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package gitstore
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"gopkg.in/src-d/go-git.v4/plumbing"
+	"gopkg.in/src-d/go-git.v4/plumbing/object"
+)
+
+var _ = Describe("GitStore", func() {
+
+	Context("When writing to a repository", func() {
+		var remoteDir, sourceDir, otherDir string
+		var repo *Repo
+		var author object.Signature
+
+		// pushConcurrentChange commits a file from a separate clone, moving
+		// the remote branch after the transaction has begun
+		pushConcurrentChange := func(name, content string) string {
+			err := ioutil.WriteFile(filepath.Join(otherDir, name), []byte(content), 0644)
+			Expect(err).ToNot(HaveOccurred())
+			runGit(otherDir, "add", name)
+			runGit(otherDir, "commit", "-m", "Concurrent change")
+			runGit(otherDir, "push", "origin", "master")
+			return runGit(otherDir, "rev-parse", "HEAD")
+		}
+
+		BeforeEach(func() {
+			sourceDir = setupRepository()
+			var err error
+			remoteDir, err = ioutil.TempDir("", "git-store-remote")
+			Expect(err).ToNot(HaveOccurred())
+			runGit(remoteDir, "clone", "--bare", "--quiet", sourceDir, ".")
+			otherDir, err = ioutil.TempDir("", "git-store-other")
+			Expect(err).ToNot(HaveOccurred())
+			runGit(otherDir, "clone", "--quiet", remoteDir, ".")
+
+			repo, err = NewRepoStore("").Get(&RepoRef{URL: fmt.Sprintf("file://%s", remoteDir)})
+			Expect(err).ToNot(HaveOccurred())
+			author = object.Signature{Name: "Git Store", Email: "git-store@example.com", When: time.Unix(1540000000, 0)}
+		})
+
+		AfterEach(func() {
+			teardownRepository(sourceDir)
+			os.RemoveAll(remoteDir)
+			os.RemoveAll(otherDir)
+		})
+
+		It("Should push written and deleted files to the remote branch", func() {
+			base := runGit(remoteDir, "rev-parse", "master")
+			txn, err := repo.Begin("master")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(txn.WriteFile("new/dir/file.txt", []byte("new file\n"))).To(Succeed())
+			Expect(txn.WriteFile("LICENSE", []byte("replaced\n"))).To(Succeed())
+			Expect(txn.DeleteFile("CHANGELOG")).To(Succeed())
+
+			hash, err := txn.Commit("Update files", author)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(txn.Push(context.Background())).To(Succeed())
+
+			Expect(runGit(remoteDir, "rev-parse", "master")).To(Equal(hash.String()))
+			Expect(runGit(remoteDir, "rev-parse", "master^")).To(Equal(base))
+			Expect(runGit(remoteDir, "show", "master:new/dir/file.txt")).To(Equal("new file"))
+			Expect(runGit(remoteDir, "show", "master:LICENSE")).To(Equal("replaced"))
+			Expect(runGit(remoteDir, "ls-tree", "--name-only", "master")).ToNot(ContainSubstring("CHANGELOG"))
+			Expect(runGit(remoteDir, "log", "-1", "--format=%an <%ae> %s", "master")).To(Equal("Git Store <git-store@example.com> Update files"))
+			// The trees written must be valid for git itself
+			runGit(remoteDir, "fsck", "--strict")
+		})
+
+		It("Should remove directories left empty", func() {
+			txn, err := repo.Begin("master")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(txn.DeleteFile("json/long.json")).To(Succeed())
+			Expect(txn.DeleteFile("json/short.json")).To(Succeed())
+			_, err = txn.Commit("Remove json", author)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(txn.Push(context.Background())).To(Succeed())
+
+			Expect(runGit(remoteDir, "ls-tree", "-d", "--name-only", "master")).ToNot(ContainSubstring("json"))
+		})
+
+		It("Should replay the changes when the remote branch has moved", func() {
+			txn, err := repo.Begin("master")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(txn.WriteFile("ours.txt", []byte("ours\n"))).To(Succeed())
+			_, err = txn.Commit("Add ours", author)
+			Expect(err).ToNot(HaveOccurred())
+
+			concurrent := pushConcurrentChange("theirs.txt", "theirs\n")
+			Expect(txn.Push(context.Background())).To(Succeed())
+
+			Expect(runGit(remoteDir, "rev-parse", "master^")).To(Equal(concurrent))
+			Expect(runGit(remoteDir, "show", "master:ours.txt")).To(Equal("ours"))
+			Expect(runGit(remoteDir, "show", "master:theirs.txt")).To(Equal("theirs"))
+		})
+
+		It("Should not overwrite changes to the same file on the remote branch", func() {
+			txn, err := repo.Begin("master")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(txn.WriteFile("CHANGELOG", []byte("ours\n"))).To(Succeed())
+			Expect(txn.WriteFile("ours.txt", []byte("ours\n"))).To(Succeed())
+			_, err = txn.Commit("Update changelog", author)
+			Expect(err).ToNot(HaveOccurred())
+
+			concurrent := pushConcurrentChange("CHANGELOG", "theirs\n")
+			err = txn.Push(context.Background())
+			Expect(err).To(Equal(&TransactionConflictError{Branch: "master", Paths: []string{"CHANGELOG"}}))
+			Expect(runGit(remoteDir, "rev-parse", "master")).To(Equal(concurrent))
+		})
+
+		It("Should replay deletions of files also deleted on the remote branch", func() {
+			txn, err := repo.Begin("master")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(txn.DeleteFile("CHANGELOG")).To(Succeed())
+			Expect(txn.WriteFile("ours.txt", []byte("ours\n"))).To(Succeed())
+			_, err = txn.Commit("Remove changelog", author)
+			Expect(err).ToNot(HaveOccurred())
+
+			runGit(otherDir, "rm", "--quiet", "CHANGELOG")
+			runGit(otherDir, "commit", "-m", "Concurrent removal")
+			runGit(otherDir, "push", "origin", "master")
+			Expect(txn.Push(context.Background())).To(Succeed())
+			Expect(runGit(remoteDir, "show", "master:ours.txt")).To(Equal("ours"))
+		})
+
+		It("Should not create an empty commit when the remote branch already has the changes", func() {
+			txn, err := repo.Begin("master")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(txn.DeleteFile("CHANGELOG")).To(Succeed())
+			_, err = txn.Commit("Remove changelog", author)
+			Expect(err).ToNot(HaveOccurred())
+
+			runGit(otherDir, "rm", "--quiet", "CHANGELOG")
+			runGit(otherDir, "commit", "-m", "Concurrent removal")
+			runGit(otherDir, "push", "origin", "master")
+			concurrent := runGit(otherDir, "rev-parse", "HEAD")
+			Expect(txn.Push(context.Background())).To(Succeed())
+			Expect(runGit(remoteDir, "rev-parse", "master")).To(Equal(concurrent))
+		})
+
+		It("Should fail when the remote branch has moved and retries are disabled", func() {
+			txn, err := repo.Begin("master")
+			Expect(err).ToNot(HaveOccurred())
+			txn.MaxRetries = 0
+			Expect(txn.WriteFile("ours.txt", []byte("ours\n"))).To(Succeed())
+			_, err = txn.Commit("Add ours", author)
+			Expect(err).ToNot(HaveOccurred())
+
+			concurrent := pushConcurrentChange("theirs.txt", "theirs\n")
+			Expect(txn.Push(context.Background())).ToNot(Succeed())
+			Expect(runGit(remoteDir, "rev-parse", "master")).To(Equal(concurrent))
+		})
+
+		It("Should overwrite the remote branch when forced", func() {
+			txn, err := repo.Begin("master")
+			Expect(err).ToNot(HaveOccurred())
+			txn.Force = true
+			Expect(txn.WriteFile("ours.txt", []byte("ours\n"))).To(Succeed())
+			hash, err := txn.Commit("Add ours", author)
+			Expect(err).ToNot(HaveOccurred())
+
+			pushConcurrentChange("theirs.txt", "theirs\n")
+			Expect(txn.Push(context.Background())).To(Succeed())
+			Expect(runGit(remoteDir, "rev-parse", "master")).To(Equal(hash.String()))
+			Expect(runGit(remoteDir, "ls-tree", "--name-only", "master")).ToNot(ContainSubstring("theirs.txt"))
+		})
+
+		It("Should not leave local references behind", func() {
+			txn, err := repo.Begin("master")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(txn.WriteFile("ours.txt", []byte("ours\n"))).To(Succeed())
+			_, err = txn.Commit("Add ours", author)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(txn.Push(context.Background())).To(Succeed())
+
+			refs, err := repo.repository.References()
+			Expect(err).ToNot(HaveOccurred())
+			var names []string
+			refs.ForEach(func(ref *plumbing.Reference) error {
+				names = append(names, ref.Name().String())
+				return nil
+			})
+			Expect(names).ToNot(ContainElement(HavePrefix("refs/gitstore/")))
+		})
+
+		It("Should not allow pushing before committing", func() {
+			txn, err := repo.Begin("master")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(txn.Push(context.Background())).ToNot(Succeed())
+		})
+
+		It("Should not allow deleting a file that does not exist", func() {
+			txn, err := repo.Begin("master")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(txn.DeleteFile("missing.txt")).ToNot(Succeed())
+		})
+
+		It("Should not allow beginning on a branch that does not exist", func() {
+			_, err := repo.Begin("missing")
+			Expect(err).To(HaveOccurred())
+		})
+	})
+})
@@ -0,0 +1,285 @@
+/*
+Copyright 2018 Pusher Ltd.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package gitstore
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/gobwas/glob"
+	"github.com/golang/glog"
+	"gopkg.in/src-d/go-git.v4/plumbing"
+)
+
+// WatchEvent is delivered to a Subscription when the watched reference moves.
+type WatchEvent struct {
+	URL     string        // URL is the URL of the repository that changed.
+	Ref     string        // Ref is the watched reference.
+	OldHash plumbing.Hash // OldHash is the commit the reference pointed to before, zero if it did not previously resolve.
+	NewHash plumbing.Hash // NewHash is the commit the reference points to now.
+	Changes []*FileChange // Changes contains the changed files matching the subscription's path glob, nil if OldHash is zero.
+}
+
+// Watcher periodically fetches repositories from a RepoStore and notifies subscribers when references move.
+// Repositories shared by multiple subscriptions are only fetched once per interval.
+type Watcher struct {
+	store         *RepoStore
+	interval      time.Duration
+	jitter        time.Duration
+	subscriptions map[string][]*Subscription
+	mutex         sync.Mutex
+}
+
+// Subscription represents interest in changes to a reference and path glob within a repository.
+type Subscription struct {
+	RepoRef  *RepoRef // RepoRef is the repository being watched.
+	Ref      string   // Ref is the git reference being watched.
+	PathGlob string   // PathGlob limits events to changes of files matching the glob.
+	repo     *Repo
+	events   chan WatchEvent
+	done     chan struct{}
+	lastHash plumbing.Hash
+	watcher  *Watcher
+	once     sync.Once
+	mutex    sync.Mutex
+}
+
+// NewWatcher initializes a new Watcher that fetches repositories from the RepoStore every interval,
+// plus a random delay of up to jitter to avoid many watchers fetching in lockstep.
+func (rs *RepoStore) NewWatcher(interval, jitter time.Duration) *Watcher {
+	w := &Watcher{
+		store:         rs,
+		interval:      interval,
+		jitter:        jitter,
+		subscriptions: make(map[string][]*Subscription),
+		mutex:         sync.Mutex{},
+	}
+
+	rs.mutex.Lock()
+	defer rs.mutex.Unlock()
+	rs.watchers = append(rs.watchers, w)
+	return w
+}
+
+// Watch subscribes to changes of the reference within the repository.
+// If pathGlob is set, events are only delivered when a file matching the glob changed.
+//
+// The repository is cloned if it is not already present in the RepoStore.
+func (w *Watcher) Watch(ref *RepoRef, gitRef, pathGlob string) (*Subscription, error) {
+	if pathGlob != "" {
+		_, err := glob.Compile(pathGlob)
+		if err != nil {
+			return nil, fmt.Errorf("unable to compile pathGlob matcher: %v", err)
+		}
+	}
+
+	repo, err := w.store.Get(ref)
+	if err != nil {
+		return nil, fmt.Errorf("unable to get repository: %v", err)
+	}
+
+	sub := &Subscription{
+		RepoRef:  ref,
+		Ref:      gitRef,
+		PathGlob: pathGlob,
+		repo:     repo,
+		events:   make(chan WatchEvent, 1),
+		done:     make(chan struct{}),
+		watcher:  w,
+	}
+	// A reference that does not resolve yet is reported once it appears
+	if hash, err := repo.parseReference(gitRef); err == nil {
+		sub.lastHash = *hash
+	}
+
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	w.subscriptions[ref.URL] = append(w.subscriptions[ref.URL], sub)
+	return sub, nil
+}
+
+// Run polls the watched repositories until the context is cancelled.
+func (w *Watcher) Run(ctx context.Context) {
+	for {
+		delay := w.interval
+		if w.jitter > 0 {
+			delay += time.Duration(rand.Int63n(int64(w.jitter)))
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(delay):
+			w.poll(ctx)
+		}
+	}
+}
+
+// poll fetches every watched repository once and checks its subscriptions
+func (w *Watcher) poll(ctx context.Context) {
+	w.mutex.Lock()
+	urls := make([]string, 0, len(w.subscriptions))
+	for url := range w.subscriptions {
+		urls = append(urls, url)
+	}
+	w.mutex.Unlock()
+
+	for _, url := range urls {
+		w.pollRepo(ctx, url)
+	}
+}
+
+// pollRepo fetches a single repository and notifies its subscriptions of
+// any references that moved
+func (w *Watcher) pollRepo(ctx context.Context, url string) {
+	subs := w.subscriptionsFor(url)
+	if len(subs) == 0 {
+		return
+	}
+
+	// Subscriptions to the same URL share a Repo from the store
+	err := subs[0].repo.FetchContext(ctx)
+	if err != nil {
+		glog.Errorf("Unable to fetch repository %s: %v", url, err)
+		return
+	}
+	w.notify(subs)
+}
+
+// notify checks each subscription against the already fetched repository
+// and delivers events for references that moved
+func (w *Watcher) notify(subs []*Subscription) {
+	for _, sub := range subs {
+		err := sub.update()
+		if err != nil {
+			glog.Errorf("Unable to check %s in repository %s: %v", sub.Ref, sub.RepoRef.URL, err)
+		}
+	}
+}
+
+// update compares the current hash of the subscription's reference against
+// the last delivered hash and queues an event if relevant files changed
+func (s *Subscription) update() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	select {
+	case <-s.done:
+		// The events channel is closed
+		return nil
+	default:
+	}
+	hash, err := s.repo.parseReference(s.Ref)
+	if err != nil {
+		return fmt.Errorf("unable to parse ref %s: %v", s.Ref, err)
+	}
+	if *hash == s.lastHash {
+		return nil
+	}
+
+	oldHash := s.lastHash
+	var pending *WatchEvent
+	select {
+	case event := <-s.events:
+		// Replace the undelivered event with one covering both moves
+		pending = &event
+		oldHash = event.OldHash
+	default:
+	}
+
+	event := WatchEvent{
+		URL:     s.RepoRef.URL,
+		Ref:     s.Ref,
+		OldHash: oldHash,
+		NewHash: *hash,
+	}
+	if !oldHash.IsZero() {
+		event.Changes, err = s.repo.Diff(oldHash.String(), hash.String(), s.PathGlob)
+		if err != nil {
+			if pending != nil {
+				s.send(*pending)
+			}
+			return fmt.Errorf("unable to diff references: %v", err)
+		}
+	}
+
+	if s.PathGlob != "" && !oldHash.IsZero() && len(event.Changes) == 0 {
+		// Nothing relevant to this subscription changed
+		s.lastHash = *hash
+		return nil
+	}
+	s.send(event)
+	return nil
+}
+
+// send queues the event without blocking and records its hash as delivered.
+// The caller must hold the subscription's mutex and have emptied the buffer
+func (s *Subscription) send(event WatchEvent) {
+	// Only the holder of the mutex sends, so the buffer has space
+	s.events <- event
+	s.lastHash = event.NewHash
+}
+
+// Events returns the channel on which events for the subscription are delivered.
+//
+// Events are queued without blocking the Watcher. If the reference moves again before an event is received,
+// the pending event is replaced by a single event from its OldHash to the latest hash.
+func (s *Subscription) Events() <-chan WatchEvent {
+	return s.events
+}
+
+// Close stops delivery of events to the subscription.
+// Any undelivered event is discarded and the Events channel is closed.
+func (s *Subscription) Close() {
+	s.once.Do(func() {
+		s.watcher.remove(s)
+		s.mutex.Lock()
+		defer s.mutex.Unlock()
+		close(s.done)
+		select {
+		case <-s.events:
+		default:
+		}
+		close(s.events)
+	})
+}
+
+// subscriptionsFor returns a copy of the subscriptions for a repository URL
+func (w *Watcher) subscriptionsFor(url string) []*Subscription {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	subs := make([]*Subscription, len(w.subscriptions[url]))
+	copy(subs, w.subscriptions[url])
+	return subs
+}
+
+// remove deletes the subscription from the watcher
+func (w *Watcher) remove(sub *Subscription) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	subs := w.subscriptions[sub.RepoRef.URL]
+	for i, s := range subs {
+		if s == sub {
+			subs = append(subs[:i], subs[i+1:]...)
+			break
+		}
+	}
+	if len(subs) == 0 {
+		delete(w.subscriptions, sub.RepoRef.URL)
+		return
+	}
+	w.subscriptions[sub.RepoRef.URL] = subs
+}
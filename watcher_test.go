@@ -0,0 +1,156 @@
+/*
+Copyright 2018 Pusher Ltd.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package gitstore
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("GitStore", func() {
+
+	Context("When watching a repository for changes", func() {
+		var repositoryDir string
+		var repoRef *RepoRef
+		var watcher *Watcher
+		var cancel context.CancelFunc
+
+		commitFile := func(path, content string) string {
+			err := ioutil.WriteFile(filepath.Join(repositoryDir, path), []byte(content), 0644)
+			Expect(err).ToNot(HaveOccurred())
+			runGit(repositoryDir, "add", path)
+			runGit(repositoryDir, "commit", "-m", fmt.Sprintf("Update %s", path))
+			return runGit(repositoryDir, "rev-parse", "HEAD")
+		}
+
+		BeforeEach(func() {
+			repositoryDir = setupRepository()
+			repoRef = &RepoRef{
+				URL: fmt.Sprintf("file://%s", repositoryDir),
+			}
+			watcher = NewRepoStore("").NewWatcher(50*time.Millisecond, 10*time.Millisecond)
+
+			var ctx context.Context
+			ctx, cancel = context.WithCancel(context.Background())
+			go watcher.Run(ctx)
+		})
+
+		AfterEach(func() {
+			cancel()
+			teardownRepository(repositoryDir)
+		})
+
+		It("Should deliver an event when the reference moves", func() {
+			sub, err := watcher.Watch(repoRef, "master", "")
+			Expect(err).ToNot(HaveOccurred())
+			defer sub.Close()
+
+			newHash := commitFile("CHANGELOG", "Updated changelog\n")
+
+			var event WatchEvent
+			Eventually(sub.Events(), 5*time.Second).Should(Receive(&event))
+			Expect(event.URL).To(Equal(repoRef.URL))
+			Expect(event.Ref).To(Equal("master"))
+			Expect(event.OldHash.String()).To(Equal("f835a00b5e29ae3440a08fd51aadf4a07d6abc25"))
+			Expect(event.NewHash.String()).To(Equal(newHash))
+			Expect(event.Changes).To(HaveLen(1))
+			Expect(event.Changes[0].Path()).To(Equal("CHANGELOG"))
+		})
+
+		It("Should only deliver events for changes matching the path glob", func() {
+			sub, err := watcher.Watch(repoRef, "master", "json/*")
+			Expect(err).ToNot(HaveOccurred())
+			defer sub.Close()
+
+			commitFile("CHANGELOG", "Updated changelog\n")
+			Consistently(sub.Events(), 500*time.Millisecond).ShouldNot(Receive())
+
+			newHash := commitFile("json/short.json", "{}\n")
+			var event WatchEvent
+			Eventually(sub.Events(), 5*time.Second).Should(Receive(&event))
+			Expect(event.NewHash.String()).To(Equal(newHash))
+			Expect(event.Changes).To(HaveLen(1))
+			Expect(event.Changes[0].Path()).To(Equal("json/short.json"))
+		})
+
+		It("Should deliver events to every subscriber of a repository", func() {
+			first, err := watcher.Watch(repoRef, "master", "")
+			Expect(err).ToNot(HaveOccurred())
+			defer first.Close()
+			second, err := watcher.Watch(repoRef, "master", "CHANGELOG")
+			Expect(err).ToNot(HaveOccurred())
+			defer second.Close()
+
+			commitFile("CHANGELOG", "Updated changelog\n")
+			Eventually(first.Events(), 5*time.Second).Should(Receive())
+			Eventually(second.Events(), 5*time.Second).Should(Receive())
+		})
+
+		It("Should not block other subscribers on a slow subscriber", func() {
+			slow, err := watcher.Watch(repoRef, "master", "")
+			Expect(err).ToNot(HaveOccurred())
+			defer slow.Close()
+			fast, err := watcher.Watch(repoRef, "master", "")
+			Expect(err).ToNot(HaveOccurred())
+			defer fast.Close()
+
+			commitFile("CHANGELOG", "Updated changelog\n")
+			Eventually(fast.Events(), 5*time.Second).Should(Receive())
+			newHash := commitFile("LICENSE", "Updated license\n")
+			Eventually(fast.Events(), 5*time.Second).Should(Receive())
+
+			// The undelivered event is replaced by one covering both commits
+			var event WatchEvent
+			Expect(slow.Events()).To(Receive(&event))
+			Expect(event.OldHash.String()).To(Equal("f835a00b5e29ae3440a08fd51aadf4a07d6abc25"))
+			Expect(event.NewHash.String()).To(Equal(newHash))
+			Expect(event.Changes).To(HaveLen(2))
+			Consistently(slow.Events(), 200*time.Millisecond).ShouldNot(Receive())
+		})
+
+		It("Should stop delivering events once closed", func() {
+			sub, err := watcher.Watch(repoRef, "master", "")
+			Expect(err).ToNot(HaveOccurred())
+			sub.Close()
+
+			commitFile("CHANGELOG", "Updated changelog\n")
+			Consistently(sub.Events(), 500*time.Millisecond).ShouldNot(Receive())
+		})
+
+		It("Should close the events channel once closed", func() {
+			sub, err := watcher.Watch(repoRef, "master", "")
+			Expect(err).ToNot(HaveOccurred())
+
+			ended := make(chan struct{})
+			go func() {
+				defer close(ended)
+				for range sub.Events() {
+				}
+			}()
+			sub.Close()
+			Eventually(ended, time.Second).Should(BeClosed())
+		})
+
+		It("Should reject an invalid path glob", func() {
+			_, err := watcher.Watch(repoRef, "master", "[")
+			Expect(err).To(HaveOccurred())
+		})
+	})
+})
@@ -0,0 +1,306 @@
+/*
+Copyright 2018 Pusher Ltd.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package gitstore
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// maxWebhookPayload is the largest webhook body accepted, matching the limit
+// GitHub applies to its payloads
+const maxWebhookPayload = 25 * 1024 * 1024
+
+// webhookRefreshTimeout bounds how long a refresh triggered by a webhook may
+// take
+const webhookRefreshTimeout = 5 * time.Minute
+
+type webhookProvider int
+
+const (
+	_ webhookProvider = iota
+	githubWebhook
+	gitlabWebhook
+	bitbucketWebhook
+	giteaWebhook
+)
+
+// WebhookHandler is an http.Handler that receives push webhooks and refreshes the matching repositories
+// of a RepoStore immediately, rather than waiting for the next poll.
+//
+// GitHub, GitLab, Bitbucket and Gitea payloads are supported.
+type WebhookHandler struct {
+	store  *RepoStore
+	secret []byte
+	ctx    context.Context
+	cancel context.CancelFunc
+	// inFlight records the canonical URLs being refreshed and whether another
+	// push arrived while the refresh was running
+	inFlight map[string]bool
+	mutex    sync.Mutex
+}
+
+// webhookPayload contains the fields of the supported push payloads that
+// identify the pushed repository
+type webhookPayload struct {
+	Repository struct {
+		CloneURL   string `json:"clone_url"`
+		SSHURL     string `json:"ssh_url"`
+		GitURL     string `json:"git_url"`
+		HTMLURL    string `json:"html_url"`
+		GitHTTPURL string `json:"git_http_url"`
+		GitSSHURL  string `json:"git_ssh_url"`
+		Homepage   string `json:"homepage"`
+		Links      struct {
+			HTML struct {
+				Href string `json:"href"`
+			} `json:"html"`
+			Clone []struct {
+				Href string `json:"href"`
+			} `json:"clone"`
+		} `json:"links"`
+	} `json:"repository"`
+	Project struct {
+		GitHTTPURL string `json:"git_http_url"`
+		GitSSHURL  string `json:"git_ssh_url"`
+		WebURL     string `json:"web_url"`
+	} `json:"project"`
+}
+
+// NewWebhookHandler constructs a WebhookHandler for the RepoStore.
+// The secret is used to validate the signature (or token for GitLab) of each request and must not be empty.
+func (rs *RepoStore) NewWebhookHandler(secret string) (*WebhookHandler, error) {
+	if secret == "" {
+		return nil, fmt.Errorf("webhook secret must not be empty")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	return &WebhookHandler{
+		store:    rs,
+		secret:   []byte(secret),
+		ctx:      ctx,
+		cancel:   cancel,
+		inFlight: make(map[string]bool),
+		mutex:    sync.Mutex{},
+	}, nil
+}
+
+// Close cancels any refreshes in progress.
+// Requests received after Close are still validated but no longer refresh repositories.
+func (h *WebhookHandler) Close() {
+	h.cancel()
+}
+
+// ServeHTTP handles a single webhook request.
+// Valid push events are acknowledged immediately and the matching repositories refreshed in the background.
+func (h *WebhookHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	provider, event := detectWebhookProvider(r.Header)
+	if provider == 0 {
+		http.Error(w, "unrecognised webhook", http.StatusBadRequest)
+		return
+	}
+
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, maxWebhookPayload))
+	if err != nil {
+		http.Error(w, "unable to read body", http.StatusBadRequest)
+		return
+	}
+
+	if !h.validSignature(provider, r.Header, body) {
+		http.Error(w, "invalid signature", http.StatusUnauthorized)
+		return
+	}
+
+	if !isPushEvent(provider, event) {
+		// Acknowledge other events such as pings without acting on them
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	var payload webhookPayload
+	err = json.Unmarshal(body, &payload)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("unable to parse payload: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	urls := payload.repositoryURLs()
+	if len(urls) == 0 {
+		http.Error(w, "payload does not identify a repository", http.StatusBadRequest)
+		return
+	}
+
+	h.refresh(urls)
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// refresh refreshes the repositories matching any of the URLs in the
+// background, ensuring each repository is only refreshed once when a payload
+// names it several ways.
+// Pushes received while a repository is already being refreshed are coalesced
+// into a single further refresh
+func (h *WebhookHandler) refresh(urls []string) {
+	if h.ctx.Err() != nil {
+		return
+	}
+
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	for _, url := range urls {
+		canonical := canonicalURL(url)
+		if _, ok := h.inFlight[canonical]; ok {
+			h.inFlight[canonical] = true
+			continue
+		}
+		h.inFlight[canonical] = false
+		go h.refreshRepository(canonical, url)
+	}
+}
+
+// refreshRepository refreshes the repository until no further push arrived
+// during the last refresh
+func (h *WebhookHandler) refreshRepository(canonical, url string) {
+	for {
+		ctx, cancel := context.WithTimeout(h.ctx, webhookRefreshTimeout)
+		refreshed, err := h.store.Refresh(ctx, url)
+		cancel()
+		if err != nil {
+			glog.Errorf("Unable to refresh repository from webhook: %v", err)
+		} else {
+			glog.V(2).Infof("Refreshed %d repositories for %s", refreshed, url)
+		}
+
+		h.mutex.Lock()
+		if !h.inFlight[canonical] || h.ctx.Err() != nil {
+			delete(h.inFlight, canonical)
+			h.mutex.Unlock()
+			return
+		}
+		h.inFlight[canonical] = false
+		h.mutex.Unlock()
+	}
+}
+
+// detectWebhookProvider determines the webhook provider and event type from
+// the request headers.
+// Gitea also sends GitHub headers so must be checked first.
+func detectWebhookProvider(header http.Header) (webhookProvider, string) {
+	switch {
+	case header.Get("X-Gitea-Event") != "":
+		return giteaWebhook, header.Get("X-Gitea-Event")
+	case header.Get("X-GitHub-Event") != "":
+		return githubWebhook, header.Get("X-GitHub-Event")
+	case header.Get("X-Gitlab-Event") != "":
+		return gitlabWebhook, header.Get("X-Gitlab-Event")
+	case header.Get("X-Event-Key") != "":
+		return bitbucketWebhook, header.Get("X-Event-Key")
+	}
+	return 0, ""
+}
+
+// isPushEvent checks whether the event type indicates references were pushed
+func isPushEvent(provider webhookProvider, event string) bool {
+	switch provider {
+	case githubWebhook, giteaWebhook:
+		return event == "push"
+	case gitlabWebhook:
+		return event == "Push Hook" || event == "Tag Push Hook"
+	case bitbucketWebhook:
+		return event == "repo:push" || event == "repo:refs_changed"
+	}
+	return false
+}
+
+// validSignature checks the request against the configured secret using the
+// scheme of the webhook provider
+func (h *WebhookHandler) validSignature(provider webhookProvider, header http.Header, body []byte) bool {
+	if len(h.secret) == 0 {
+		return false
+	}
+
+	switch provider {
+	case githubWebhook:
+		if signature := header.Get("X-Hub-Signature-256"); signature != "" {
+			return validHMAC(sha256.New, h.secret, body, strings.TrimPrefix(signature, "sha256="))
+		}
+		return validHMAC(sha1.New, h.secret, body, strings.TrimPrefix(header.Get("X-Hub-Signature"), "sha1="))
+	case giteaWebhook:
+		return validHMAC(sha256.New, h.secret, body, header.Get("X-Gitea-Signature"))
+	case bitbucketWebhook:
+		return validHMAC(sha256.New, h.secret, body, strings.TrimPrefix(header.Get("X-Hub-Signature"), "sha256="))
+	case gitlabWebhook:
+		// GitLab sends the secret token itself rather than a signature
+		return subtle.ConstantTimeCompare([]byte(header.Get("X-Gitlab-Token")), h.secret) == 1
+	}
+	return false
+}
+
+// validHMAC checks that the hex encoded signature is the HMAC of the body
+func validHMAC(hashFunc func() hash.Hash, secret, body []byte, signature string) bool {
+	expected, err := hex.DecodeString(signature)
+	if err != nil || len(expected) == 0 {
+		return false
+	}
+	mac := hmac.New(hashFunc, secret)
+	mac.Write(body)
+	return hmac.Equal(mac.Sum(nil), expected)
+}
+
+// repositoryURLs returns every URL the payload gives for the pushed repository
+func (p *webhookPayload) repositoryURLs() []string {
+	candidates := []string{
+		p.Repository.CloneURL,
+		p.Repository.SSHURL,
+		p.Repository.GitURL,
+		p.Repository.HTMLURL,
+		p.Repository.GitHTTPURL,
+		p.Repository.GitSSHURL,
+		p.Repository.Homepage,
+		p.Repository.Links.HTML.Href,
+		p.Project.GitHTTPURL,
+		p.Project.GitSSHURL,
+		p.Project.WebURL,
+	}
+	for _, clone := range p.Repository.Links.Clone {
+		candidates = append(candidates, clone.Href)
+	}
+
+	urls := []string{}
+	for _, url := range candidates {
+		if url != "" {
+			urls = append(urls, url)
+		}
+	}
+	return urls
+}
@@ -0,0 +1,180 @@
+/*
+Copyright 2018 Pusher Ltd.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package gitstore
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("GitStore", func() {
+
+	Context("When receiving webhooks", func() {
+		const secret = "webhook-secret"
+		var repositoryDir string
+		var repoURL string
+		var handler *WebhookHandler
+		var sub *Subscription
+
+		sign := func(body string) string {
+			mac := hmac.New(sha256.New, []byte(secret))
+			mac.Write([]byte(body))
+			return hex.EncodeToString(mac.Sum(nil))
+		}
+
+		send := func(body string, headers map[string]string) int {
+			req := httptest.NewRequest(http.MethodPost, "/", bytes.NewBufferString(body))
+			for key, value := range headers {
+				req.Header.Set(key, value)
+			}
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+			return rec.Code
+		}
+
+		BeforeEach(func() {
+			repositoryDir = setupRepository()
+			repoURL = fmt.Sprintf("file://%s", repositoryDir)
+
+			rs := NewRepoStore("")
+			// Poll rarely so that only webhooks trigger events
+			watcher := rs.NewWatcher(time.Hour, 0)
+			var err error
+			sub, err = watcher.Watch(&RepoRef{URL: repoURL}, "master", "")
+			Expect(err).ToNot(HaveOccurred())
+			handler, err = rs.NewWebhookHandler(secret)
+			Expect(err).ToNot(HaveOccurred())
+
+			err = ioutil.WriteFile(filepath.Join(repositoryDir, "CHANGELOG"), []byte("Updated changelog\n"), 0644)
+			Expect(err).ToNot(HaveOccurred())
+			runGit(repositoryDir, "commit", "-a", "-m", "Update changelog")
+		})
+
+		AfterEach(func() {
+			sub.Close()
+			handler.Close()
+			teardownRepository(repositoryDir)
+		})
+
+		It("Should refresh the repository for a signed GitHub push", func() {
+			body := fmt.Sprintf(`{"ref":"refs/heads/master","repository":{"clone_url":"%s.git"}}`, repoURL)
+			code := send(body, map[string]string{
+				"X-GitHub-Event":      "push",
+				"X-Hub-Signature-256": "sha256=" + sign(body),
+			})
+			Expect(code).To(Equal(http.StatusAccepted))
+			Eventually(sub.Events(), 5*time.Second).Should(Receive())
+		})
+
+		It("Should refresh the repository for a GitLab push with a valid token", func() {
+			body := fmt.Sprintf(`{"project":{"git_http_url":"%s"}}`, repoURL)
+			code := send(body, map[string]string{
+				"X-Gitlab-Event": "Push Hook",
+				"X-Gitlab-Token": secret,
+			})
+			Expect(code).To(Equal(http.StatusAccepted))
+			Eventually(sub.Events(), 5*time.Second).Should(Receive())
+		})
+
+		It("Should refresh the repository for a signed Bitbucket push", func() {
+			body := fmt.Sprintf(`{"repository":{"links":{"clone":[{"href":"%s"}]}}}`, repoURL)
+			code := send(body, map[string]string{
+				"X-Event-Key":     "repo:refs_changed",
+				"X-Hub-Signature": "sha256=" + sign(body),
+			})
+			Expect(code).To(Equal(http.StatusAccepted))
+			Eventually(sub.Events(), 5*time.Second).Should(Receive())
+		})
+
+		It("Should refresh the repository for a signed Gitea push", func() {
+			body := fmt.Sprintf(`{"repository":{"clone_url":"%s"}}`, repoURL)
+			code := send(body, map[string]string{
+				"X-Gitea-Event":     "push",
+				"X-GitHub-Event":    "push",
+				"X-Gitea-Signature": sign(body),
+			})
+			Expect(code).To(Equal(http.StatusAccepted))
+			Eventually(sub.Events(), 5*time.Second).Should(Receive())
+		})
+
+		It("Should reject requests with an invalid signature", func() {
+			body := fmt.Sprintf(`{"repository":{"clone_url":"%s"}}`, repoURL)
+			code := send(body, map[string]string{
+				"X-GitHub-Event":      "push",
+				"X-Hub-Signature-256": "sha256=" + sign("something else"),
+			})
+			Expect(code).To(Equal(http.StatusUnauthorized))
+
+			code = send(body, map[string]string{
+				"X-Gitlab-Event": "Push Hook",
+				"X-Gitlab-Token": "wrong",
+			})
+			Expect(code).To(Equal(http.StatusUnauthorized))
+			Consistently(sub.Events(), 500*time.Millisecond).ShouldNot(Receive())
+		})
+
+		It("Should acknowledge non-push events without refreshing", func() {
+			body := `{"zen":"Keep it logically awesome."}`
+			code := send(body, map[string]string{
+				"X-GitHub-Event":      "ping",
+				"X-Hub-Signature-256": "sha256=" + sign(body),
+			})
+			Expect(code).To(Equal(http.StatusOK))
+		})
+
+		It("Should require a secret", func() {
+			_, err := NewRepoStore("").NewWebhookHandler("")
+			Expect(err).To(HaveOccurred())
+		})
+
+		It("Should coalesce pushes received while a refresh is in progress", func() {
+			body := fmt.Sprintf(`{"repository":{"clone_url":"%s"}}`, repoURL)
+			headers := map[string]string{
+				"X-GitHub-Event":      "push",
+				"X-Hub-Signature-256": "sha256=" + sign(body),
+			}
+			for i := 0; i < 10; i++ {
+				Expect(send(body, headers)).To(Equal(http.StatusAccepted))
+			}
+
+			Eventually(func() int {
+				handler.mutex.Lock()
+				defer handler.mutex.Unlock()
+				Expect(len(handler.inFlight)).To(BeNumerically("<=", 1))
+				return len(handler.inFlight)
+			}, 5*time.Second).Should(BeZero())
+			Eventually(sub.Events(), 5*time.Second).Should(Receive())
+		})
+
+		It("Should reject unrecognised requests", func() {
+			Expect(send("{}", map[string]string{})).To(Equal(http.StatusBadRequest))
+
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+			Expect(rec.Code).To(Equal(http.StatusMethodNotAllowed))
+		})
+	})
+})